@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris"
+)
+
+//the admin API is disabled unless a token is configured (SUBARUWEBQL_ADMIN_TOKEN), requests carry it as a bearer token
+var ADMIN_TOKEN = ""
+
+var SERVER_ADDRESS = ":8081"
+
+//readiness probes of the upstream TAP host are reused for this long
+const READY_PROBE_INTERVAL = 15 * time.Second
+const READY_PROBE_TIMEOUT = 5 //[s]
+
+var started = time.Now()
+
+type ReadinessCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type DatasetInfo struct {
+	DataId      string    `json:"dataId"`
+	Title       string    `json:"title"`
+	State       string    `json:"state"` //loading or loaded
+	Virtual     bool      `json:"virtual"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Depth       int       `json:"depth"`
+	HeapBytes   int64     `json:"heap_bytes"`
+	MappedBytes int64     `json:"mapped_bytes"`
+	LastAccess  time.Time `json:"last_access"`
+	Connections int       `json:"connections"`
+}
+
+var upstream_probe = struct {
+	sync.Mutex
+	checked time.Time
+	err     error
+}{}
+
+//upstream_probe_url is the TAP endpoint the VOTables are downloaded from, without a query
+func upstream_probe_url() string {
+	address := default_votable_url("")
+
+	if u, err := url.Parse(address); err == nil {
+		u.RawQuery = ""
+		return u.String()
+	}
+
+	return address
+}
+
+//check_writable creates and removes a file in dir
+func check_writable(dir string) error {
+	file, err := ioutil.TempFile(dir, ".readyz-")
+
+	if err != nil {
+		return err
+	}
+
+	name := file.Name()
+	file.Close()
+
+	return os.Remove(name)
+}
+
+func check_upstream() error {
+	upstream_probe.Lock()
+	defer upstream_probe.Unlock()
+
+	if time.Since(upstream_probe.checked) < READY_PROBE_INTERVAL {
+		return upstream_probe.err
+	}
+
+	upstream_probe.err = probe_url(upstream_probe_url(), READY_PROBE_TIMEOUT)
+	upstream_probe.checked = time.Now()
+
+	return upstream_probe.err
+}
+
+func readiness_checks() ([]ReadinessCheck, bool) {
+	checks := []struct {
+		name  string
+		check func() error
+	}{
+		{"VOTABLECACHE", func() error { return check_writable(VOTABLECACHE) }},
+		{"FITSCACHE", func() error { return check_writable(FITSCACHE) }},
+		{"accepting datasets", accepting_datasets},
+		{"upstream " + VOTABLESERVER, check_upstream},
+	}
+
+	results := make([]ReadinessCheck, len(checks))
+	ready := true
+
+	for i, c := range checks {
+		results[i].Name = c.name
+
+		if err := c.check(); err != nil {
+			results[i].Error = err.Error()
+			ready = false
+		} else {
+			results[i].OK = true
+		}
+	}
+
+	return results, ready
+}
+
+//GET /healthz answers as long as the daemon is serving
+func healthz_handler(ctx iris.Context) {
+	ctx.JSON(iris.Map{"status": "ok", "server": SERVER_STRING, "uptime": time.Since(started).String()})
+}
+
+//GET /readyz fails with 503 while a cache directory is not writable or the upstream TAP host is unreachable
+func readyz_handler(ctx iris.Context) {
+	checks, ready := readiness_checks()
+
+	status := "ready"
+
+	if !ready {
+		status = "not ready"
+		ctx.StatusCode(iris.StatusServiceUnavailable)
+	}
+
+	ctx.JSON(iris.Map{"status": status, "checks": checks})
+}
+
+//admin_auth guards the admin API
+func admin_auth(ctx iris.Context) {
+	if ADMIN_TOKEN == "" {
+		http_error(ctx, iris.StatusForbidden, errors.New("the admin API is disabled"))
+		return
+	}
+
+	token := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(ADMIN_TOKEN)) != 1 {
+		ctx.Header("WWW-Authenticate", "Bearer")
+		http_error(ctx, iris.StatusUnauthorized, errors.New("invalid admin token"))
+		return
+	}
+
+	ctx.Next()
+}
+
+func dataset_info(subaru *SubaruDataset) DatasetInfo {
+	subaru.RLock()
+	defer subaru.RUnlock()
+
+	info := DatasetInfo{DataId: subaru.dataId, Title: subaru.title, State: "loading", Virtual: subaru.virtual, LastAccess: subaru.timestamp}
+
+	if subaru.has_fits {
+		heap, mapped := dataset_bytes(&subaru.fits)
+
+		info.State = "loaded"
+		info.Width, info.Height, info.Depth = subaru.fits.width, subaru.fits.height, subaru.fits.depth
+		info.HeapBytes, info.MappedBytes = int64(heap), int64(mapped)
+	}
+
+	ws_sessions.RLock()
+	info.Connections = len(ws_sessions.conns[subaru.dataId])
+	ws_sessions.RUnlock()
+
+	return info
+}
+
+//evict_dataset forgets a dataset, pixels mapped from the pixel cache are unmapped once the requests
+//and websocket messages in flight are done with them
+func evict_dataset(dataId string) bool {
+	datasets.Lock()
+	subaru, ok := datasets.subaru[dataId]
+	delete(datasets.subaru, dataId)
+	datasets.Unlock()
+
+	if ok {
+		retire_dataset(subaru)
+	}
+
+	return ok
+}
+
+//drop_failed_dataset forgets a dataset that could not be loaded so that the next request starts afresh,
+//unless it has been replaced already
+func drop_failed_dataset(subaru *SubaruDataset) {
+	datasets.Lock()
+
+	if datasets.subaru[subaru.dataId] == subaru {
+		delete(datasets.subaru, subaru.dataId)
+	}
+
+	datasets.Unlock()
+
+	retire_dataset(subaru)
+}
+
+//cache_files lists the entries of a dataset in the given cache: votable, fits, pixels or all
+func cache_files(dataId, cache string) ([]string, error) {
+	if dataId == "" || strings.ContainsAny(dataId, "/\\") || strings.Contains(dataId, "..") {
+		return nil, fmt.Errorf("invalid dataId '%s'", dataId)
+	}
+
+	pixels, stats := pixel_cache_files(dataId)
+
+	files := map[string][]string{
+		"votable": {VOTABLECACHE + "/" + dataId + ".xml"},
+		"fits":    {FITSCACHE + "/" + dataId + ".fits"},
+		"pixels":  {pixels, stats},
+	}
+
+	if cache == "all" {
+		return append(append(files["votable"], files["fits"]...), files["pixels"]...), nil
+	}
+
+	list, ok := files[cache]
+
+	if !ok {
+		return nil, fmt.Errorf("unknown cache '%s'", cache)
+	}
+
+	return list, nil
+}
+
+func purge_cache(dataId, cache string) ([]string, error) {
+	list, err := cache_files(dataId, cache)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+
+	for _, filename := range list {
+		if err := os.Remove(filename); err == nil {
+			removed = append(removed, filename)
+		} else if !os.IsNotExist(err) {
+			return removed, err
+		}
+	}
+
+	return removed, nil
+}
+
+//GET /subaruwebql/admin/datasets
+func admin_datasets_handler(ctx iris.Context) {
+	datasets.RLock()
+	list := make([]*SubaruDataset, 0, len(datasets.subaru))
+
+	for _, subaru := range datasets.subaru {
+		list = append(list, subaru)
+	}
+
+	datasets.RUnlock()
+
+	infos := make([]DatasetInfo, len(list))
+
+	for i, subaru := range list {
+		infos[i] = dataset_info(subaru)
+	}
+
+	ctx.JSON(infos)
+}
+
+//DELETE /subaruwebql/admin/datasets/{dataId}
+func admin_evict_handler(ctx iris.Context) {
+	dataId := ctx.Params().Get("dataId")
+
+	if !evict_dataset(dataId) {
+		http_error(ctx, iris.StatusNotFound, fmt.Errorf("unknown dataId %s", dataId))
+		return
+	}
+
+	request_logger(ctx).Info("dataset evicted", "dataId", dataId)
+
+	ctx.JSON(iris.Map{"evicted": dataId})
+}
+
+//POST /subaruwebql/admin/datasets/{dataId}/reload[?purge=votable|fits|pixels|all]
+//evicts the dataset, optionally purges its cache entries and loads it again; 409 while it is still loading
+func admin_reload_handler(ctx iris.Context) {
+	dataId := ctx.Params().Get("dataId")
+
+	if !safe_dataId.MatchString(dataId) {
+		http_error(ctx, iris.StatusBadRequest, fmt.Errorf("%w '%s'", errInvalidDataId, dataId))
+		return
+	}
+
+	if subaru, ok := get_dataset(dataId); ok {
+		if subaru.virtual {
+			http_error(ctx, iris.StatusBadRequest, fmt.Errorf("%s is computed on the server and cannot be reloaded", dataId))
+			return
+		}
+
+		subaru.RLock()
+		loading := !subaru.has_fits
+		subaru.RUnlock()
+
+		//purging or evicting now would pull the files from under the download or the decoder
+		if loading {
+			http_error(ctx, iris.StatusConflict, fmt.Errorf("%s is still loading", dataId))
+			return
+		}
+	}
+
+	var removed []string
+
+	if cache := ctx.FormValue("purge"); cache != "" {
+		var err error
+
+		if removed, err = purge_cache(dataId, cache); err != nil {
+			http_error(ctx, iris.StatusBadRequest, err)
+			return
+		}
+	}
+
+	evict_dataset(dataId)
+
+	if _, err := launch_subaru(dataId, ""); err != nil {
+		http_error(ctx, iris.StatusServiceUnavailable, err)
+		return
+	}
+
+	request_logger(ctx).Info("dataset reloaded", "dataId", dataId, "purged", removed)
+
+	ctx.StatusCode(iris.StatusAccepted)
+	ctx.JSON(iris.Map{"reloading": dataId, "purged": removed})
+}
+
+//DELETE /subaruwebql/admin/cache?dataId=...&cache=votable|fits|pixels|all
+func admin_purge_handler(ctx iris.Context) {
+	dataId := ctx.FormValue("dataId")
+	cache := ctx.FormValue("cache")
+
+	if cache == "" {
+		cache = "all"
+	}
+
+	removed, err := purge_cache(dataId, cache)
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	request_logger(ctx).Info("cache purged", "dataId", dataId, "cache", cache, "removed", removed)
+
+	ctx.JSON(iris.Map{"purged": removed})
+}
+
+//GET /subaruwebql/admin/config shows the effective configuration, the admin token excepted
+func admin_config_handler(ctx iris.Context) {
+	ctx.JSON(iris.Map{
+		"server":         SERVER_STRING,
+		"version":        VERSION_STRING,
+		"address":        SERVER_ADDRESS,
+		"votable_server": VOTABLESERVER,
+		"votable_cache":  VOTABLECACHE,
+		"fits_cache":     FITSCACHE,
+		"catalogue_dir":  CATALOGUE_DIR,
+		"log_format":     LOG_FORMAT,
+		"log_level":      LOG_LEVEL,
+		"gomaxprocs":     runtime.GOMAXPROCS(0),
+		"uptime":         time.Since(started).String(),
+	})
+}
+
+func register_admin_routes(app *iris.Application) {
+	app.Get("/healthz", healthz_handler)
+	app.Get("/readyz", readyz_handler)
+
+	admin := app.Party("/subaruwebql/admin", admin_auth)
+	admin.Get("/datasets", admin_datasets_handler)
+	admin.Delete("/datasets/{dataId}", admin_evict_handler)
+	admin.Post("/datasets/{dataId}/reload", admin_reload_handler)
+	admin.Delete("/cache", admin_purge_handler)
+	admin.Get("/config", admin_config_handler)
+}
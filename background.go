@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/kataras/iris"
+)
+
+//the default background mesh cell size [pixel]
+const BACK_SIZE = 64
+
+//the smallest mesh cell accepted [pixel], the largest is the image itself
+const BACK_MIN_SIZE = 8
+
+//cells with fewer valid pixels than this fraction are interpolated from their neighbours
+const BACK_MIN_FRACTION = 0.5
+
+//the size of the median filter applied to the mesh [cells], suppresses cells biased by bright objects
+const BACK_FILTER_SIZE = 3
+
+//display layers derived from the background model
+const DISPLAY_IMAGE = 0
+const DISPLAY_SUBTRACTED = 1
+const DISPLAY_BACKGROUND = 2
+const DISPLAY_RMS = 3
+
+var DISPLAY_LAYERS = []string{"image", "subtracted", "background", "rms"}
+
+//Background is a coarse mesh of sigma-clipped sky levels and noise
+type Background struct {
+	mesh   int
+	nx, ny int
+	level  []float32
+	rms    []float32
+}
+
+//make_background estimates the sky in mesh x mesh cells
+func make_background(fits *FITS, mesh int) *Background {
+	if mesh <= 0 {
+		mesh = BACK_SIZE
+	}
+
+	//the mesh comes from the query string and sizes the buffers below
+	mesh = min_int(max_int(mesh, BACK_MIN_SIZE), max_int(BACK_MIN_SIZE, max_int(fits.width, fits.height)))
+
+	bg := &Background{mesh: mesh}
+	bg.nx = (fits.width + mesh - 1) / mesh
+	bg.ny = (fits.height + mesh - 1) / mesh
+	bg.level = make([]float32, bg.nx*bg.ny)
+	bg.rms = make([]float32, bg.nx*bg.ny)
+
+	valid := make([]bool, bg.nx*bg.ny)
+	values := make([]float32, 0, min_int(mesh, fits.width)*min_int(mesh, fits.height))
+
+	for cy := 0; cy < bg.ny; cy++ {
+		for cx := 0; cx < bg.nx; cx++ {
+			values = values[:0]
+			total := 0
+
+			for y := cy * mesh; y < (cy+1)*mesh && y < fits.height; y++ {
+				for x := cx * mesh; x < (cx+1)*mesh && x < fits.width; x++ {
+					total++
+					value := fits.data[y*fits.width+x]
+
+					if is_valid_pixel(fits, value) {
+						values = append(values, value)
+					}
+				}
+			}
+
+			if float64(len(values)) < BACK_MIN_FRACTION*float64(total) {
+				continue
+			}
+
+			median, std, _ := sigma_clip(values, 3.0, 5)
+
+			bg.level[cy*bg.nx+cx] = float32(median)
+			bg.rms[cy*bg.nx+cx] = float32(std)
+			valid[cy*bg.nx+cx] = true
+		}
+	}
+
+	fill_background_holes(bg, valid)
+	median_filter_background(bg, BACK_FILTER_SIZE)
+
+	return bg
+}
+
+//median_filter_background smooths the mesh with a size x size median filter, clamped at the edges
+func median_filter_background(bg *Background, size int) {
+	if size < 2 {
+		return
+	}
+
+	half := size / 2
+	level := make([]float32, len(bg.level))
+	rms := make([]float32, len(bg.rms))
+	levels := make([]float32, 0, size*size)
+	rmss := make([]float32, 0, size*size)
+
+	for cy := 0; cy < bg.ny; cy++ {
+		for cx := 0; cx < bg.nx; cx++ {
+			levels = levels[:0]
+			rmss = rmss[:0]
+
+			for y := cy - half; y <= cy+half; y++ {
+				for x := cx - half; x <= cx+half; x++ {
+					if x < 0 || y < 0 || x >= bg.nx || y >= bg.ny {
+						continue
+					}
+
+					levels = append(levels, bg.level[y*bg.nx+x])
+					rmss = append(rmss, bg.rms[y*bg.nx+x])
+				}
+			}
+
+			level[cy*bg.nx+cx] = median_float32(levels)
+			rms[cy*bg.nx+cx] = median_float32(rmss)
+		}
+	}
+
+	bg.level = level
+	bg.rms = rms
+}
+
+//fill_background_holes replaces the rejected cells with the mean of their valid neighbours, growing outwards
+func fill_background_holes(bg *Background, valid []bool) {
+	for {
+		missing := 0
+		filled := make([]bool, len(valid))
+		copy(filled, valid)
+
+		for cy := 0; cy < bg.ny; cy++ {
+			for cx := 0; cx < bg.nx; cx++ {
+				if valid[cy*bg.nx+cx] {
+					continue
+				}
+
+				var level, rms float32
+				count := 0
+
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						x, y := cx+dx, cy+dy
+
+						if x < 0 || y < 0 || x >= bg.nx || y >= bg.ny || !valid[y*bg.nx+x] {
+							continue
+						}
+
+						level += bg.level[y*bg.nx+x]
+						rms += bg.rms[y*bg.nx+x]
+						count++
+					}
+				}
+
+				if count == 0 {
+					missing++
+					continue
+				}
+
+				bg.level[cy*bg.nx+cx] = level / float32(count)
+				bg.rms[cy*bg.nx+cx] = rms / float32(count)
+				filled[cy*bg.nx+cx] = true
+			}
+		}
+
+		copy(valid, filled)
+
+		if missing == 0 || missing == len(valid) {
+			return
+		}
+	}
+}
+
+//background_at interpolates the mesh bicubically between cell centres at the zero-based pixel (i, j)
+func background_at(bg *Background, i, j int) (float32, float32) {
+	fx := (float64(i)+0.5)/float64(bg.mesh) - 0.5
+	fy := (float64(j)+0.5)/float64(bg.mesh) - 0.5
+
+	cx := int(math.Floor(fx))
+	cy := int(math.Floor(fy))
+	tx := fx - float64(cx)
+	ty := fy - float64(cy)
+
+	clamp := func(v, n int) int {
+		if v < 0 {
+			return 0
+		}
+
+		if v > n-1 {
+			return n - 1
+		}
+
+		return v
+	}
+
+	var level, rms float64
+
+	for dy := -1; dy <= 2; dy++ {
+		wy := cubic_weight(float64(dy) - ty)
+		y := clamp(cy+dy, bg.ny)
+
+		for dx := -1; dx <= 2; dx++ {
+			w := wy * cubic_weight(float64(dx)-tx)
+			x := clamp(cx+dx, bg.nx)
+
+			level += w * float64(bg.level[y*bg.nx+x])
+			rms += w * float64(bg.rms[y*bg.nx+x])
+		}
+	}
+
+	//the cubic kernel overshoots a little, the noise must stay positive
+	if rms < 0 {
+		rms = 0
+	}
+
+	return float32(level), float32(rms)
+}
+
+//BackgroundLayers holds full-resolution images derived from the background model
+//each is a FITS sharing the geometry and WCS of the original, with its own statistics
+type BackgroundLayers struct {
+	bg         *Background
+	subtracted FITS
+	model      FITS
+	rms        FITS
+}
+
+func make_layer_FITS(fits *FITS, data []float32) FITS {
+	layer := FITS{BITPIX: -32, NAXIS: 2, width: fits.width, height: fits.height, data: data, IGNRVAL: fits.IGNRVAL, header: fits.header, wcs: fits.wcs}
+	make_image_statistics(&layer)
+
+	return layer
+}
+
+func make_background_layers(fits *FITS, mesh int) *BackgroundLayers {
+	bg := make_background(fits, mesh)
+
+	subtracted := make([]float32, len(fits.data))
+	model := make([]float32, len(fits.data))
+	rms := make([]float32, len(fits.data))
+
+	for j := 0; j < fits.height; j++ {
+		for i := 0; i < fits.width; i++ {
+			index := j*fits.width + i
+			level, noise := background_at(bg, i, j)
+
+			model[index] = level
+			rms[index] = noise
+
+			if value := fits.data[index]; is_valid_pixel(fits, value) {
+				subtracted[index] = value - level
+			} else {
+				subtracted[index] = float32(math.NaN())
+			}
+		}
+	}
+
+	return &BackgroundLayers{bg: bg, subtracted: make_layer_FITS(fits, subtracted), model: make_layer_FITS(fits, model), rms: make_layer_FITS(fits, rms)}
+}
+
+//parse_display_layer accepts either a layer name or its number
+func parse_display_layer(s string) (int, error) {
+	if s == "" {
+		return DISPLAY_IMAGE, nil
+	}
+
+	for layer, name := range DISPLAY_LAYERS {
+		if s == name || s == strconv.Itoa(layer) {
+			return layer, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown display layer '%s'", s)
+}
+
+//display_layer returns the image to be displayed, the background layers are modelled on first use
+func display_layer(subaru *SubaruDataset, layer int) (*FITS, error) {
+	if layer == DISPLAY_IMAGE {
+		return &subaru.fits, nil
+	}
+
+	if layer < 0 || layer >= len(DISPLAY_LAYERS) {
+		return nil, fmt.Errorf("unknown display layer %d", layer)
+	}
+
+	layers, err := background_layers(subaru)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch layer {
+	case DISPLAY_SUBTRACTED:
+		return &layers.subtracted, nil
+	case DISPLAY_BACKGROUND:
+		return &layers.model, nil
+	default:
+		return &layers.rms, nil
+	}
+}
+
+//background_layers models the background of a dataset once, a failed attempt is retried by the next request
+func background_layers(subaru *SubaruDataset) (layers *BackgroundLayers, err error) {
+	subaru.background_lock.Lock()
+	defer subaru.background_lock.Unlock()
+
+	subaru.RLock()
+	layers = subaru.background
+	subaru.RUnlock()
+
+	if layers != nil {
+		return layers, nil
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			layers, err = nil, fmt.Errorf("the background could not be modelled: %v", r)
+		}
+	}()
+
+	layers = make_background_layers(&subaru.fits, BACK_SIZE)
+
+	subaru.Lock()
+	subaru.background = layers
+	subaru.Unlock()
+
+	return layers, nil
+}
+
+type LayerStatistics struct {
+	Layer  string  `json:"layer"`
+	Min    float32 `json:"min"`
+	Max    float32 `json:"max"`
+	Median float32 `json:"median"`
+	MAD    float32 `json:"mad"`
+}
+
+type BackgroundInfo struct {
+	DataId string            `json:"dataId"`
+	Mesh   int               `json:"mesh"`
+	NX     int               `json:"nx"`
+	NY     int               `json:"ny"`
+	Filter int               `json:"filter"`
+	Layers []LayerStatistics `json:"layers"`
+}
+
+//GET /subaruwebql/background?dataId=... returns the statistics of every display layer
+func background_handler(ctx iris.Context) {
+	subaru, ok := loaded_dataset_or_fail(ctx)
+
+	if !ok {
+		return
+	}
+
+	info := BackgroundInfo{DataId: subaru.dataId, Filter: BACK_FILTER_SIZE}
+
+	for layer, name := range DISPLAY_LAYERS {
+		fits, err := display_layer(subaru, layer)
+
+		if err != nil {
+			http_error(ctx, iris.StatusInternalServerError, err)
+			return
+		}
+
+		info.Layers = append(info.Layers, LayerStatistics{Layer: name, Min: fits.min, Max: fits.max, Median: fits.median, MAD: fits.mad})
+	}
+
+	//modelled by the layers above, the mesh is the one actually used
+	layers, err := background_layers(subaru)
+
+	if err != nil {
+		http_error(ctx, iris.StatusInternalServerError, err)
+		return
+	}
+
+	info.Mesh, info.NX, info.NY = layers.bg.mesh, layers.bg.nx, layers.bg.ny
+
+	ctx.JSON(info)
+}
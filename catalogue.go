@@ -0,0 +1,681 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andelf/go-curl"
+	"github.com/jvo203/SubaruWebQL/wcs"
+	"github.com/kataras/iris"
+)
+
+//remote catalogues, either Simple Cone Search (the RA, DEC and SR parameters are appended to URL)
+//or TAP (an ADQL query against Table is sent to URL/sync)
+type catalogueService struct {
+	Protocol string //scs or tap
+	URL      string
+	Table    string
+	RA, Dec  string //the TAP position columns
+}
+
+var CATALOGUE_SERVICES = map[string]catalogueService{
+	"gaia":  {Protocol: "tap", URL: "https://gea.esac.esa.int/tap-server/tap", Table: "gaiadr3.gaia_source", RA: "ra", Dec: "dec"},
+	"2mass": {Protocol: "scs", URL: "https://vizier.cds.unistra.fr/viz-bin/conesearch/II/246/out?"},
+}
+
+//local VOTable (.xml, .vot) or CSV catalogues, requested as catalogue=local:<file name>
+var CATALOGUE_DIR = "CATALOGUES"
+
+const CATALOGUE_MAX_ROWS = 50000
+const CATALOGUE_TIMEOUT = 60 //[s]
+
+type CatalogueSource struct {
+	Id  string   `json:"id"`
+	RA  float64  `json:"ra"`
+	Dec float64  `json:"dec"`
+	X   float64  `json:"x"`
+	Y   float64  `json:"y"`
+	Mag *float64 `json:"mag"`
+}
+
+type CatalogueOverlay struct {
+	DataId    string            `json:"dataId"`
+	Catalogue string            `json:"catalogue"`
+	RA        float64           `json:"ra"`     //the cone centre (ICRS) [deg]
+	Dec       float64           `json:"dec"`    //ditto
+	Radius    float64           `json:"radius"` //[deg]
+	Sources   []CatalogueSource `json:"sources"`
+}
+
+//catalogueTable is a parsed VOTable or CSV table, cells are kept as text
+type catalogueTable struct {
+	names []string
+	ucds  []string
+	rows  [][]string
+}
+
+type xmlVOField struct {
+	Name string `xml:"name,attr"`
+	UCD  string `xml:"ucd,attr"`
+}
+
+type xmlVORow struct {
+	Cells []string `xml:"TD"`
+}
+
+type xmlVOTable struct {
+	Fields []xmlVOField `xml:"FIELD"`
+	Rows   []xmlVORow   `xml:"DATA>TABLEDATA>TR"`
+}
+
+type xmlVOResource struct {
+	Tables    []xmlVOTable    `xml:"TABLE"`
+	Resources []xmlVOResource `xml:"RESOURCE"`
+}
+
+type xmlVOTableDoc struct {
+	Resources []xmlVOResource `xml:"RESOURCE"`
+}
+
+//first_table finds the first TABLE, possibly in nested resources
+func first_table(resources []xmlVOResource) *xmlVOTable {
+	for i := range resources {
+		if len(resources[i].Tables) > 0 {
+			return &resources[i].Tables[0]
+		}
+
+		if t := first_table(resources[i].Resources); t != nil {
+			return t
+		}
+	}
+
+	return nil
+}
+
+//read_VOTable_catalogue supports the TABLEDATA serialisation only
+func read_VOTable_catalogue(r io.Reader) (*catalogueTable, error) {
+	var doc xmlVOTableDoc
+
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	t := first_table(doc.Resources)
+
+	if t == nil {
+		return nil, errors.New("the VOTable has no TABLE")
+	}
+
+	table := &catalogueTable{}
+
+	for _, field := range t.Fields {
+		table.names = append(table.names, field.Name)
+		table.ucds = append(table.ucds, field.UCD)
+	}
+
+	for _, row := range t.Rows {
+		table.rows = append(table.rows, row.Cells)
+	}
+
+	return table, nil
+}
+
+//read_CSV_catalogue expects the column names in the first row
+func read_CSV_catalogue(r io.Reader) (*catalogueTable, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+
+	records, err := reader.ReadAll()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return nil, errors.New("the CSV file is empty")
+	}
+
+	table := &catalogueTable{names: records[0], ucds: make([]string, len(records[0])), rows: records[1:]}
+
+	for i := range table.names {
+		table.names[i] = strings.TrimSpace(table.names[i])
+	}
+
+	return table, nil
+}
+
+//find_column prefers the UCDs (VOTable 1.x and the older UCD1 style), then the usual column names
+func (t *catalogueTable) find_column(ucds []string, names []string) int {
+	for _, ucd := range ucds {
+		for i, u := range t.ucds {
+			if strings.EqualFold(u, ucd) {
+				return i
+			}
+		}
+	}
+
+	for _, name := range names {
+		for i, n := range t.names {
+			if strings.EqualFold(n, name) {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+func (t *catalogueTable) magnitude_column(name string) int {
+	if name != "" {
+		return t.find_column(nil, []string{name})
+	}
+
+	for i, u := range t.ucds {
+		u = strings.ToLower(u)
+
+		if strings.HasPrefix(u, "phot.mag") && !strings.Contains(u, "stat.error") {
+			return i
+		}
+	}
+
+	for i, n := range t.names {
+		n = strings.ToLower(n)
+
+		if strings.Contains(n, "mag") && !strings.HasPrefix(n, "e_") && !strings.Contains(n, "err") {
+			return i
+		}
+	}
+
+	return -1
+}
+
+//parse_angle accepts decimal degrees or sexagesimal "dd mm ss" / "dd:mm:ss" (hours for RA)
+func parse_angle(s string, hours bool) (float64, error) {
+	s = strings.TrimSpace(s)
+
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		return v, nil
+	}
+
+	parts := strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ':' })
+
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid angle '%s'", s)
+	}
+
+	var v [3]float64
+
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(part, 64)
+
+		if err != nil {
+			return 0, fmt.Errorf("invalid angle '%s'", s)
+		}
+
+		v[i] = math.Abs(f)
+	}
+
+	angle := v[0] + v[1]/60 + v[2]/3600
+
+	if strings.HasPrefix(parts[0], "-") {
+		angle = -angle
+	}
+
+	if hours {
+		angle *= 15
+	}
+
+	return angle, nil
+}
+
+//angular_distance [deg]
+func angular_distance(ra1, dec1, ra2, dec2 float64) float64 {
+	d2r := math.Pi / 180
+	s := math.Sin((dec2-dec1)*d2r/2)*math.Sin((dec2-dec1)*d2r/2) +
+		math.Cos(dec1*d2r)*math.Cos(dec2*d2r)*math.Sin((ra2-ra1)*d2r/2)*math.Sin((ra2-ra1)*d2r/2)
+
+	return 2 * math.Asin(math.Min(1, math.Sqrt(s))) / d2r
+}
+
+//image_cone returns the ICRS centre of the image and the radius [deg] reaching its corners
+func image_cone(fits *FITS) (float64, float64, float64, error) {
+	if fits.wcs == nil {
+		return 0, 0, 0, errors.New("the image has no usable WCS")
+	}
+
+	frame := fits.wcs.Frame()
+
+	to_icrs := func(x, y float64) (float64, float64, error) {
+		ra, dec, err := fits.wcs.PixelToSky(x, y)
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		return wcs.Convert(ra, dec, frame, wcs.ICRS)
+	}
+
+	ra, dec, err := to_icrs(0.5*float64(fits.width+1), 0.5*float64(fits.height+1))
+
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	radius := 0.0
+
+	for _, corner := range [][2]float64{{0.5, 0.5}, {float64(fits.width) + 0.5, 0.5}, {0.5, float64(fits.height) + 0.5}, {float64(fits.width) + 0.5, float64(fits.height) + 0.5}} {
+		if r, d, err := to_icrs(corner[0], corner[1]); err == nil {
+			radius = math.Max(radius, angular_distance(ra, dec, r, d))
+		}
+	}
+
+	//a small margin for the distortions
+	return ra, dec, 1.05 * radius, nil
+}
+
+//a download in progress, later requests for the same file wait for its outcome
+type fetchCall struct {
+	done chan struct{}
+	err  error
+}
+
+var fetches = struct {
+	sync.Mutex
+	calls map[string]*fetchCall
+}{calls: make(map[string]*fetchCall)}
+
+//fetch_to_file downloads address into filename, concurrent requests for the same file share one download
+func fetch_to_file(address, filename string, timeout int) error {
+	return share_fetch(filename, func() error {
+		return download_to_file(address, filename, timeout)
+	})
+}
+
+//share_fetch runs fetch unless one with the same key is in progress, in which case its outcome is returned
+func share_fetch(key string, fetch func() error) error {
+	fetches.Lock()
+
+	if call, ok := fetches.calls[key]; ok {
+		fetches.Unlock()
+		<-call.done
+
+		return call.err
+	}
+
+	call := &fetchCall{done: make(chan struct{})}
+	fetches.calls[key] = call
+	fetches.Unlock()
+
+	defer func() {
+		fetches.Lock()
+		delete(fetches.calls, key)
+		fetches.Unlock()
+
+		close(call.done)
+	}()
+
+	call.err = fetch()
+
+	return call.err
+}
+
+//download_to_file downloads address through a temporary file of its own, timeout is in seconds
+//a private curl handle is used as catalogue requests run concurrently
+func download_to_file(address, filename string, timeout int) error {
+	done, err := begin_cache_io()
+
+	if err != nil {
+		return err
+	}
+
+	defer done()
+
+	handle := curl.EasyInit()
+	defer handle.Cleanup()
+
+	tmpfile, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+
+	if err != nil {
+		return err
+	}
+
+	tmpname := tmpfile.Name()
+	tmpfile.Chmod(0644)
+
+	//a transfer checkpointed by a shutdown is resumed
+	partial := filename + ".partial"
+	var offset int64
+
+	if stat, err := os.Stat(partial); err == nil && os.Rename(partial, tmpname) == nil {
+		tmpfile.Close()
+		offset = stat.Size()
+
+		if tmpfile, err = os.OpenFile(tmpname, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return err
+		}
+	}
+
+	resumed := rangeCheck{offset: offset}
+	var range_err error
+
+	headers := func(buf []byte, userdata interface{}) bool {
+		resumed.header(string(buf))
+		return true
+	}
+
+	writeFile := func(buf []byte, userdata interface{}) bool {
+		file := userdata.(*os.File)
+
+		if download_aborted() {
+			return false
+		}
+
+		restart, err := resumed.restart()
+
+		if err != nil {
+			range_err = err
+			return false
+		}
+
+		if restart {
+			if err := file.Truncate(0); err != nil {
+				range_err = err
+				return false
+			}
+
+			offset = 0
+		}
+
+		if _, err := file.Write(buf); err != nil {
+			return false
+		}
+
+		return true
+	}
+
+	handle.Setopt(curl.OPT_URL, address)
+	handle.Setopt(curl.OPT_FOLLOWLOCATION, true)
+	handle.Setopt(curl.OPT_FAILONERROR, true)
+	handle.Setopt(curl.OPT_TIMEOUT, timeout)
+	handle.Setopt(curl.OPT_RESUME_FROM_LARGE, offset)
+	handle.Setopt(curl.OPT_WRITEFUNCTION, writeFile)
+	handle.Setopt(curl.OPT_WRITEDATA, tmpfile)
+	handle.Setopt(curl.OPT_HEADERFUNCTION, headers)
+
+	start := time.Now()
+	err = handle.Perform()
+
+	if range_err != nil {
+		err = range_err
+	}
+
+	var size int64
+
+	if stat, serr := tmpfile.Stat(); serr == nil {
+		size = stat.Size() - offset
+	}
+
+	count_download(address, size, start, err)
+	tmpfile.Close()
+
+	if err != nil && download_aborted() {
+		os.Rename(tmpname, partial)
+		logger.Info("download checkpointed", "url", address, "bytes", size+offset)
+		return errShuttingDown
+	}
+
+	if err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+
+	return os.Rename(tmpname, filename)
+}
+
+//probe_url checks that an upstream server answers at all, any HTTP status will do
+func probe_url(address string, timeout int) error {
+	handle := curl.EasyInit()
+	defer handle.Cleanup()
+
+	handle.Setopt(curl.OPT_URL, address)
+	handle.Setopt(curl.OPT_NOBODY, true)
+	handle.Setopt(curl.OPT_CONNECTTIMEOUT, timeout)
+	handle.Setopt(curl.OPT_TIMEOUT, timeout)
+
+	return handle.Perform()
+}
+
+func cone_search_url(service catalogueService, ra, dec, radius float64) (string, error) {
+	switch service.Protocol {
+	case "scs":
+		return fmt.Sprintf("%sRA=%.7f&DEC=%.7f&SR=%.6f&VERB=1", service.URL, ra, dec, radius), nil
+	case "tap":
+		query := fmt.Sprintf("SELECT TOP %d * FROM %s WHERE 1=CONTAINS(POINT('ICRS', %s, %s), CIRCLE('ICRS', %.7f, %.7f, %.6f))",
+			CATALOGUE_MAX_ROWS, service.Table, service.RA, service.Dec, ra, dec, radius)
+
+		return service.URL + "/sync?REQUEST=doQuery&LANG=ADQL&FORMAT=votable&QUERY=" + url.QueryEscape(query), nil
+	default:
+		return "", fmt.Errorf("unknown protocol '%s'", service.Protocol)
+	}
+}
+
+//load_catalogue reads a local catalogue or queries a remote one, caching the answers in VOTABLECACHE
+func load_catalogue(name string, ra, dec, radius float64) (*catalogueTable, error) {
+	if strings.HasPrefix(name, "local:") {
+		filename := filepath.Join(CATALOGUE_DIR, filepath.Base(strings.TrimPrefix(name, "local:")))
+
+		file, err := os.Open(filename)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer file.Close()
+
+		if strings.EqualFold(filepath.Ext(filename), ".csv") {
+			return read_CSV_catalogue(file)
+		}
+
+		return read_VOTable_catalogue(file)
+	}
+
+	service, ok := CATALOGUE_SERVICES[name]
+
+	if !ok {
+		return nil, fmt.Errorf("unknown catalogue '%s'", name)
+	}
+
+	query, err := cone_search_url(service, ra, dec, radius)
+
+	if err != nil {
+		return nil, err
+	}
+
+	h := fnv.New64a()
+	io.WriteString(h, query)
+	filename := fmt.Sprintf("%s/catalogue-%s-%016x.xml", VOTABLECACHE, name, h.Sum64())
+
+	_, err = os.Stat(filename)
+	count_cache("votable", err == nil)
+
+	if err != nil {
+		if err := fetch_to_file(query, filename, CATALOGUE_TIMEOUT); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+	}
+
+	file, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	return read_VOTable_catalogue(file)
+}
+
+//make_catalogue_overlay projects the catalogue onto the image, keeping the sources that fall on it
+//and those within [magmin, magmax] (NaN: no limit)
+func make_catalogue_overlay(subaru *SubaruDataset, name, magcol string, magmin, magmax float64) (CatalogueOverlay, error) {
+	fits := &subaru.fits
+
+	ra, dec, radius, err := image_cone(fits)
+
+	if err != nil {
+		return CatalogueOverlay{}, err
+	}
+
+	table, err := load_catalogue(name, ra, dec, radius)
+
+	if err != nil {
+		return CatalogueOverlay{}, err
+	}
+
+	ra_col := table.find_column([]string{"pos.eq.ra;meta.main", "POS_EQ_RA_MAIN", "pos.eq.ra"}, []string{"ra", "raj2000", "_raj2000", "ra_icrs", "radeg", "alpha"})
+	dec_col := table.find_column([]string{"pos.eq.dec;meta.main", "POS_EQ_DEC_MAIN", "pos.eq.dec"}, []string{"dec", "dej2000", "_dej2000", "de_icrs", "dec_icrs", "decdeg", "delta"})
+	id_col := table.find_column([]string{"meta.id;meta.main", "ID_MAIN", "meta.id"}, []string{"id", "source_id", "name"})
+	mag_col := table.magnitude_column(magcol)
+
+	if ra_col < 0 || dec_col < 0 {
+		return CatalogueOverlay{}, errors.New("no RA/Dec columns found in the catalogue")
+	}
+
+	if magcol != "" && mag_col < 0 {
+		return CatalogueOverlay{}, fmt.Errorf("no column '%s' in the catalogue", magcol)
+	}
+
+	overlay := CatalogueOverlay{DataId: subaru.dataId, Catalogue: name, RA: ra, Dec: dec, Radius: radius, Sources: make([]CatalogueSource, 0)}
+	frame := fits.wcs.Frame()
+
+	for n, row := range table.rows {
+		if ra_col >= len(row) || dec_col >= len(row) {
+			continue
+		}
+
+		src_ra, err1 := parse_angle(row[ra_col], true)
+		src_dec, err2 := parse_angle(row[dec_col], false)
+
+		if err1 != nil || err2 != nil {
+			continue
+		}
+
+		src := CatalogueSource{Id: strconv.Itoa(n + 1), RA: src_ra, Dec: src_dec}
+
+		if id_col >= 0 && id_col < len(row) {
+			src.Id = strings.TrimSpace(row[id_col])
+		}
+
+		if mag_col >= 0 && mag_col < len(row) {
+			if mag, err := strconv.ParseFloat(strings.TrimSpace(row[mag_col]), 64); err == nil && !math.IsNaN(mag) {
+				src.Mag = &mag
+			}
+		}
+
+		if !math.IsNaN(magmin) || !math.IsNaN(magmax) {
+			if src.Mag == nil || *src.Mag < magmin || *src.Mag > magmax {
+				continue
+			}
+		}
+
+		lon, lat, err := wcs.Convert(src_ra, src_dec, wcs.ICRS, frame)
+
+		if err != nil {
+			continue
+		}
+
+		x, y, err := fits.wcs.SkyToPixel(lon, lat)
+
+		if err != nil || x < 0.5 || y < 0.5 || x > float64(fits.width)+0.5 || y > float64(fits.height)+0.5 {
+			continue
+		}
+
+		src.X, src.Y = x, y
+		overlay.Sources = append(overlay.Sources, src)
+	}
+
+	return overlay, nil
+}
+
+func catalogue_overlay_votable(overlay CatalogueOverlay) *VOTable {
+	t := &VOTable{Resource: overlay.DataId, Name: overlay.Catalogue}
+
+	t.Fields = []VOField{
+		{Name: "id", Datatype: "char", UCD: "meta.id;meta.main"},
+		{Name: "ra", Datatype: "double", Unit: "deg", UCD: "pos.eq.ra;meta.main"},
+		{Name: "dec", Datatype: "double", Unit: "deg", UCD: "pos.eq.dec;meta.main"},
+		{Name: "x", Datatype: "double", Unit: "pix", UCD: "pos.cartesian.x;instr.det"},
+		{Name: "y", Datatype: "double", Unit: "pix", UCD: "pos.cartesian.y;instr.det"},
+		{Name: "mag", Datatype: "double", Unit: "mag", UCD: "phot.mag"},
+	}
+
+	for _, src := range overlay.Sources {
+		t.Rows = append(t.Rows, []interface{}{src.Id, src.RA, src.Dec, src.X, src.Y, src.Mag})
+	}
+
+	return t
+}
+
+//GET /subaruwebql/catalogue?dataId=...&catalogue=gaia|2mass|local:<file>[&magcol=...][&magmin=...][&magmax=...][&format=votable]
+func catalogue_handler(ctx iris.Context) {
+	subaru, ok := loaded_dataset_or_fail(ctx)
+
+	if !ok {
+		return
+	}
+
+	name := strings.TrimSpace(ctx.FormValue("catalogue"))
+
+	if _, ok := CATALOGUE_SERVICES[name]; !ok && !strings.HasPrefix(name, "local:") {
+		http_error(ctx, iris.StatusBadRequest, fmt.Errorf("unknown catalogue '%s'", name))
+		return
+	}
+
+	magmin, magmax := math.NaN(), math.NaN()
+
+	if v, ok := form_float(ctx, "magmin"); ok {
+		magmin = v
+	}
+
+	if v, ok := form_float(ctx, "magmax"); ok {
+		magmax = v
+	}
+
+	//a single limit leaves the other side open
+	if !math.IsNaN(magmin) && math.IsNaN(magmax) {
+		magmax = math.Inf(1)
+	}
+
+	if !math.IsNaN(magmax) && math.IsNaN(magmin) {
+		magmin = math.Inf(-1)
+	}
+
+	overlay, err := make_catalogue_overlay(subaru, name, strings.TrimSpace(ctx.FormValue("magcol")), magmin, magmax)
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadGateway, err)
+		return
+	}
+
+	if ctx.FormValue("format") == "votable" {
+		ctx.ContentType("application/x-votable+xml")
+		catalogue_overlay_votable(overlay).Write(ctx)
+		return
+	}
+
+	ctx.JSON(overlay)
+}
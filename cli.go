@@ -0,0 +1,616 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//the offline command line runs the server's FITS pipeline on local files without starting the daemon:
+//	subarud header FILE...                  the header cards as JSON
+//	subarud stats [-hist] FILE...           the image statistics as JSON
+//	subarud preview [options] FILE...       PNG previews
+//	subarud cutout [options] FILE           a FITS cutout
+//	subarud cache [options] FILE...         copy into FITSCACHE and write the pixel cache
+//gzipped files (.gz) are accepted everywhere
+
+const PREVIEW_DEFAULT_SIZE = 1024
+
+//the softening of the log stretch
+const PREVIEW_LOG_SCALE = 1000.0
+
+var CLI_COMMANDS = []string{"header", "stats", "preview", "cutout", "cache"}
+
+//the usage has been printed already
+var errUsage = errors.New("usage")
+
+//colormaps are linear gradients through these colours
+var COLORMAPS = map[string][]color.NRGBA{
+	"gray":    {{0, 0, 0, 255}, {255, 255, 255, 255}},
+	"heat":    {{0, 0, 0, 255}, {192, 0, 0, 255}, {255, 160, 0, 255}, {255, 255, 255, 255}},
+	"cool":    {{0, 255, 255, 255}, {255, 0, 255, 255}},
+	"rainbow": {{0, 0, 255, 255}, {0, 255, 255, 255}, {0, 255, 0, 255}, {255, 255, 0, 255}, {255, 0, 0, 255}},
+	"viridis": {{68, 1, 84, 255}, {59, 82, 139, 255}, {33, 145, 140, 255}, {94, 201, 98, 255}, {253, 231, 37, 255}},
+}
+
+type HeaderInfo struct {
+	File   string   `json:"file"`
+	BITPIX int      `json:"bitpix"`
+	NAXIS  int      `json:"naxis"`
+	Width  int      `json:"width"`
+	Height int      `json:"height"`
+	Depth  int      `json:"depth"`
+	WCS    bool     `json:"wcs"`
+	Cards  []string `json:"cards"`
+}
+
+type StatsInfo struct {
+	File        string  `json:"file"`
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+	Depth       int     `json:"depth"`
+	Min         float32 `json:"min"`
+	Max         float32 `json:"max"`
+	Median      float32 `json:"median"`
+	MAD         float32 `json:"mad"`
+	Black       float32 `json:"black"`
+	White       float32 `json:"white"`
+	Sensitivity float32 `json:"sensitivity"`
+	Hist        []int   `json:"hist,omitempty"`
+}
+
+//run_cli dispatches a subcommand and returns the exit status: 0 on success, 1 on failures and 2 on usage errors
+func run_cli(args []string) int {
+	if len(args) == 0 {
+		cli_usage()
+		return 2
+	}
+
+	var err error
+
+	switch args[0] {
+	case "header":
+		err = cli_header(args[1:])
+	case "stats":
+		err = cli_stats(args[1:])
+	case "preview":
+		err = cli_preview(args[1:])
+	case "cutout":
+		err = cli_cutout(args[1:])
+	case "cache":
+		err = cli_cache(args[1:])
+	case "help", "-h", "-help", "--help":
+		cli_usage()
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "subarud: unknown command '%s'\n", args[0])
+		cli_usage()
+		return 2
+	}
+
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+
+	if errors.Is(err, errUsage) {
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "subarud %s: %s\n", args[0], err)
+		return 1
+	}
+
+	return 0
+}
+
+func cli_usage() {
+	fmt.Fprintf(os.Stderr, "usage: subarud [%s] [options] FILE...\n", strings.Join(CLI_COMMANDS, "|"))
+	fmt.Fprintln(os.Stderr, "without a command the HTTP server is started, 'subarud COMMAND -h' lists the options of a command")
+}
+
+//cli_flags parses the options of a command, at least min_files files must follow them
+func cli_flags(set *flag.FlagSet, args []string, min_files int) ([]string, error) {
+	set.SetOutput(os.Stderr)
+
+	if err := set.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, err
+		}
+
+		return nil, errUsage
+	}
+
+	if set.NArg() < min_files {
+		fmt.Fprintf(os.Stderr, "subarud %s: no FITS file given\n", set.Name())
+		set.Usage()
+		return nil, errUsage
+	}
+
+	return set.Args(), nil
+}
+
+//read_local_FITS reads a local file, gunzipping .gz files
+func read_local_FITS(filename string) ([]byte, error) {
+	fp, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer fp.Close()
+
+	var reader io.Reader = fp
+
+	if strings.HasSuffix(filename, ".gz") {
+		zr, err := gzip.NewReader(fp)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer zr.Close()
+		reader = zr
+	}
+
+	return ioutil.ReadAll(reader)
+}
+
+func load_local_FITS(filename string) (*FITS, error) {
+	buf, err := read_local_FITS(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return decode_local_FITS(filename, buf)
+}
+
+//decode_local_FITS decodes a local file exactly like a downloaded dataset, the reader's panics become errors
+func decode_local_FITS(filename string, buf []byte) (fits *FITS, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fits, err = nil, fmt.Errorf("%s: %v", filename, r)
+		}
+	}()
+
+	fits = new(FITS)
+	decode_FITS(fits, bytes.NewBuffer(buf), logger.With("file", filename))
+
+	return fits, nil
+}
+
+//read_local_header reads the header only, the reader panics on malformed files
+func read_local_header(filename string, buf []byte) (fits *FITS, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fits, err = nil, fmt.Errorf("%s: %v", filename, r)
+		}
+	}()
+
+	fits = new(FITS)
+	read_FITS_header(fits, bytes.NewBuffer(buf))
+
+	return fits, nil
+}
+
+//read_local_votable reads the metadata of a dataset, checking that the daemon can parse it
+func read_local_votable(filename string) (buf []byte, err error) {
+	if buf, err = ioutil.ReadFile(filename); err != nil {
+		return nil, err
+	}
+
+	fp, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer fp.Close()
+
+	defer func() {
+		if r := recover(); r != nil {
+			buf, err = nil, fmt.Errorf("%s: %v", filename, r)
+		}
+	}()
+
+	parseXMLVOTable(&SubaruDataset{}, fp)
+
+	return buf, nil
+}
+
+//local_dataId names a local file the way the archive names its datasets, i.e. without the extension
+func local_dataId(filename string) string {
+	base := strings.TrimSuffix(filepath.Base(filename), ".gz")
+
+	for _, ext := range []string{".fits", ".fit", ".fts"} {
+		if strings.HasSuffix(strings.ToLower(base), ext) {
+			return base[:len(base)-len(ext)]
+		}
+	}
+
+	return base
+}
+
+func print_json(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(v)
+}
+
+func cli_header(args []string) error {
+	set := flag.NewFlagSet("header", flag.ContinueOnError)
+	files, err := cli_flags(set, args, 1)
+
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range files {
+		buf, err := read_local_FITS(filename)
+
+		if err != nil {
+			return err
+		}
+
+		fits, err := read_local_header(filename, buf)
+
+		if err != nil {
+			return err
+		}
+
+		info := HeaderInfo{File: filename, BITPIX: fits.BITPIX, NAXIS: fits.NAXIS, Width: fits.width, Height: fits.height, Depth: fits.depth,
+			WCS: make_FITS_wcs(fits.header) != nil, Cards: make([]string, len(fits.header))}
+
+		for i, card := range fits.header {
+			info.Cards[i] = strings.TrimRight(card, " ")
+		}
+
+		if err := print_json(info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func cli_stats(args []string) error {
+	set := flag.NewFlagSet("stats", flag.ContinueOnError)
+	hist := set.Bool("hist", false, "include the histogram")
+	files, err := cli_flags(set, args, 1)
+
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range files {
+		fits, err := load_local_FITS(filename)
+
+		if err != nil {
+			return err
+		}
+
+		info := StatsInfo{File: filename, Width: fits.width, Height: fits.height, Depth: fits.depth,
+			Min: fits.min, Max: fits.max, Median: fits.median, MAD: fits.mad,
+			Black: fits.black, Sensitivity: fits.sensitivity}
+
+		if fits.sensitivity > 0 {
+			info.White = fits.black + 1/fits.sensitivity
+		}
+
+		if *hist {
+			info.Hist = fits.hist[:]
+		}
+
+		if err := print_json(info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//preview_stretch maps a pixel onto [0, 1] like the viewer: linear, sqrt, log or asinh between the black and white points
+func preview_stretch(fits *FITS, v float32, stretch string, soft float64) float64 {
+	switch stretch {
+	case "sqrt":
+		return math.Sqrt(channel_linear(fits, v))
+	case "log":
+		return math.Log1p(PREVIEW_LOG_SCALE*channel_linear(fits, v)) / math.Log1p(PREVIEW_LOG_SCALE)
+	case "asinh":
+		return channel_asinh(fits, v, soft)
+	default:
+		return channel_linear(fits, v)
+	}
+}
+
+func colormap_color(colors []color.NRGBA, t float64) color.NRGBA {
+	pos := math.Max(0, math.Min(1, t)) * float64(len(colors)-1)
+	i := int(pos)
+
+	if i >= len(colors)-1 {
+		return colors[len(colors)-1]
+	}
+
+	f := pos - float64(i)
+	mix := func(a, b uint8) uint8 { return uint8(float64(a) + f*(float64(b)-float64(a)) + 0.5) }
+
+	return color.NRGBA{mix(colors[i].R, colors[i+1].R), mix(colors[i].G, colors[i+1].G), mix(colors[i].B, colors[i+1].B), 255}
+}
+
+//make_preview downsamples the whole image so that its longer side is at most size and renders it north up,
+//invalid pixels are transparent
+func make_preview(fits *FITS, size int, stretch string, soft float64, colors []color.NRGBA) *image.NRGBA {
+	width, height := fits.width, fits.height
+
+	if width > size || height > size {
+		scale := float64(size) / float64(max_int(width, height))
+		width = max_int(1, int(float64(width)*scale+0.5))
+		height = max_int(1, int(float64(height)*scale+0.5))
+	}
+
+	pixels := downsample_region(fits, 0, 0, fits.width, fits.height, width, height)
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	parallel_for(height, 1+PARALLEL_GRAIN/width, func(chunk, start, end int) {
+		for j := start; j < end; j++ {
+			for i := 0; i < width; i++ {
+				v := pixels[j*width+i]
+
+				if is_valid_pixel(fits, v) {
+					img.SetNRGBA(i, height-1-j, colormap_color(colors, preview_stretch(fits, v, stretch, soft)))
+				}
+			}
+		}
+	})
+
+	return img
+}
+
+func cli_preview(args []string) error {
+	set := flag.NewFlagSet("preview", flag.ContinueOnError)
+	output := set.String("o", "", "the output PNG (a single FILE only), by default DIR/<dataId>.png")
+	dir := set.String("dir", ".", "the output directory")
+	size := set.Int("size", PREVIEW_DEFAULT_SIZE, "the longer side of the preview [pixel]")
+	stretch := set.String("stretch", "linear", "linear, sqrt, log or asinh")
+	soft := set.Float64("soft", 3, "the asinh softening in units of the MAD")
+	colormap := set.String("colormap", "gray", "gray, heat, cool, rainbow or viridis")
+	files, err := cli_flags(set, args, 1)
+
+	if err != nil {
+		return err
+	}
+
+	colors, ok := COLORMAPS[*colormap]
+
+	if !ok {
+		return fmt.Errorf("unknown colormap '%s'", *colormap)
+	}
+
+	switch *stretch {
+	case "linear", "sqrt", "log", "asinh":
+	default:
+		return fmt.Errorf("unknown stretch '%s'", *stretch)
+	}
+
+	if *size <= 0 {
+		return fmt.Errorf("invalid size %d", *size)
+	}
+
+	if *output != "" && len(files) > 1 {
+		return errors.New("-o takes a single FILE, use -dir for several")
+	}
+
+	for _, filename := range files {
+		fits, err := load_local_FITS(filename)
+
+		if err != nil {
+			return err
+		}
+
+		target := *output
+
+		if target == "" {
+			target = filepath.Join(*dir, local_dataId(filename)+".png")
+		}
+
+		var buf bytes.Buffer
+
+		if err := png.Encode(&buf, make_preview(fits, *size, *stretch, *soft, colors)); err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(target, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+
+		logger.Info("preview written", "file", filename, "preview", target)
+	}
+
+	return nil
+}
+
+func cli_cutout(args []string) error {
+	set := flag.NewFlagSet("cutout", flag.ContinueOnError)
+	output := set.String("o", "", "the output FITS file, by default <dataId>_<x>_<y>_<width>x<height>.fits")
+	x1 := set.Float64("x1", math.NaN(), "the pixel box in inclusive FITS pixel coordinates")
+	y1 := set.Float64("y1", math.NaN(), "")
+	x2 := set.Float64("x2", math.NaN(), "")
+	y2 := set.Float64("y2", math.NaN(), "")
+	ra := set.Float64("ra", math.NaN(), "or the centre of a sky box [deg]")
+	dec := set.Float64("dec", math.NaN(), "")
+	width := set.Float64("width", math.NaN(), "the sky box size [arcsec]")
+	height := set.Float64("height", math.NaN(), "defaults to the width")
+	bitpix := set.Int("bitpix", -32, "-32, -64, 8, 16 or 32")
+	compress := set.Bool("gzip", false, "gzip the cutout")
+	files, err := cli_flags(set, args, 1)
+
+	if err != nil {
+		return err
+	}
+
+	if len(files) > 1 {
+		return errors.New("a single FILE is cut at a time")
+	}
+
+	fits, err := load_local_FITS(files[0])
+
+	if err != nil {
+		return err
+	}
+
+	bx1, by1, bx2, by2 := *x1, *y1, *x2, *y2
+
+	if math.IsNaN(bx1) || math.IsNaN(by1) || math.IsNaN(bx2) || math.IsNaN(by2) {
+		if math.IsNaN(*ra) || math.IsNaN(*dec) || math.IsNaN(*width) {
+			return errors.New("either -x1,-y1,-x2,-y2 or -ra,-dec,-width[,-height] are required")
+		}
+
+		if math.IsNaN(*height) {
+			*height = *width
+		}
+
+		if bx1, by1, bx2, by2, err = cutout_sky_box(fits, *ra, *dec, *width, *height); err != nil {
+			return err
+		}
+	}
+
+	x0, y0, w, h, err := cutout_pixel_box(fits, bx1, by1, bx2, by2)
+
+	if err != nil {
+		return err
+	}
+
+	cutout, err := make_FITS_cutout(fits, x0, y0, w, h, *bitpix)
+
+	if err != nil {
+		return err
+	}
+
+	target := *output
+
+	if target == "" {
+		target = fmt.Sprintf("%s_%d_%d_%dx%d.fits", local_dataId(files[0]), x0+1, y0+1, w, h)
+
+		if *compress {
+			target += ".gz"
+		}
+	}
+
+	if *compress {
+		var gz bytes.Buffer
+
+		zw := gzip.NewWriter(&gz)
+		zw.Write(cutout)
+		zw.Close()
+
+		cutout = gz.Bytes()
+	}
+
+	if err := ioutil.WriteFile(target, cutout, 0644); err != nil {
+		return err
+	}
+
+	logger.Info("cutout written", "file", files[0], "cutout", target, "x", x0+1, "y", y0+1, "width", w, "height", h)
+
+	return nil
+}
+
+//cli_cache copies local files into FITSCACHE under their dataId and writes their pixel cache;
+//the daemon still fetches the VOTable of a dataset from the archive unless it is given with -votable
+func cli_cache(args []string) error {
+	set := flag.NewFlagSet("cache", flag.ContinueOnError)
+	dataId := set.String("dataId", "", "the dataId (a single FILE only), by default the file name without the extension")
+	votable := set.String("votable", "", "the VOTable describing the dataset (a single FILE only), kept in VOTABLECACHE")
+	force := set.Bool("force", false, "replace datasets already cached")
+	files, err := cli_flags(set, args, 1)
+
+	if err != nil {
+		return err
+	}
+
+	if *dataId != "" && len(files) > 1 {
+		return errors.New("-dataId takes a single FILE")
+	}
+
+	if *votable != "" && len(files) > 1 {
+		return errors.New("-votable takes a single FILE")
+	}
+
+	var metadata []byte
+
+	if *votable != "" {
+		if metadata, err = read_local_votable(*votable); err != nil {
+			return err
+		}
+	}
+
+	for _, filename := range files {
+		id := *dataId
+
+		if id == "" {
+			id = local_dataId(filename)
+		}
+
+		//the daemon only loads the datasets it can name
+		if !safe_dataId.MatchString(id) {
+			return fmt.Errorf("%w '%s', give one with -dataId", errInvalidDataId, id)
+		}
+
+		target := FITSCACHE + "/" + id + ".fits"
+
+		if file_exists(target) && !*force {
+			logger.Info("dataset already cached", "file", filename, "dataId", id)
+			continue
+		}
+
+		buf, err := read_local_FITS(filename)
+
+		if err != nil {
+			return err
+		}
+
+		fits, err := decode_local_FITS(filename, buf)
+
+		if err != nil {
+			return err
+		}
+
+		if err := write_file_atomic(target, func(fp *os.File) error {
+			_, err := fp.Write(buf)
+			return err
+		}); err != nil {
+			return err
+		}
+
+		if err := write_pixel_cache(id, fits); err != nil {
+			return err
+		}
+
+		if metadata != nil {
+			if err := write_file_atomic(VOTABLECACHE+"/"+id+".xml", func(fp *os.File) error {
+				_, err := fp.Write(metadata)
+				return err
+			}); err != nil {
+				return err
+			}
+		}
+
+		logger.Info("dataset cached", "file", filename, "dataId", id, "width", fits.width, "height", fits.height, "depth", fits.depth)
+	}
+
+	return nil
+}
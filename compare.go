@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/kataras/iris"
+)
+
+//pixels brighter than this many sigma above the sky in both images take part in the flux scaling
+const COMPARE_SCALE_NSIGMA = 10
+
+//the fewest pixels for an automatic flux scale, below this the scale defaults to 1
+const COMPARE_SCALE_MIN_PIXELS = 50
+
+//match_to_reference reprojects b onto the pixel grid of a and matches its sky level and flux scale:
+//b' = k*(b - sky_b) + sky_a; k <= 0 estimates the scale from the pixels bright in both images
+func match_to_reference(a, b *FITS, k float64, method int) ([]float32, float64, error) {
+	grid, _, err := reference_grid(a)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	plane, err := reproject(b, &grid, method)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	//the sky of b is measured after resampling, flux-conserving resampling changes the pixel units
+	valid := make([]float32, 0, len(plane))
+
+	for _, value := range plane {
+		if !math.IsNaN(float64(value)) {
+			valid = append(valid, value)
+		}
+	}
+
+	if len(valid) == 0 {
+		return nil, 0, errors.New("the datasets do not overlap")
+	}
+
+	sky_a, sky_b := float64(a.median), float64(median_float32(valid))
+
+	for i, value := range valid {
+		valid[i] = float32(math.Abs(float64(value) - sky_b))
+	}
+
+	if k <= 0 {
+		sigma_a := 1.4826 * float64(a.mad)
+		sigma_b := 1.4826 * float64(median_float32(valid))
+
+		var ratios []float32
+
+		for i, value := range plane {
+			va := a.data[i]
+
+			if math.IsNaN(float64(value)) || !is_valid_pixel(a, va) {
+				continue
+			}
+
+			da := float64(va) - sky_a
+			db := float64(value) - sky_b
+
+			if da > COMPARE_SCALE_NSIGMA*sigma_a && db > COMPARE_SCALE_NSIGMA*sigma_b {
+				ratios = append(ratios, float32(da/db))
+			}
+		}
+
+		k = 1
+
+		if len(ratios) >= COMPARE_SCALE_MIN_PIXELS {
+			k = float64(median_float32(ratios))
+		}
+	}
+
+	for i, value := range plane {
+		if !math.IsNaN(float64(value)) {
+			plane[i] = float32(k*(float64(value)-sky_b) + sky_a)
+		}
+	}
+
+	return plane, k, nil
+}
+
+//start_comparison builds a virtual dataset on the pixel grid of a: a - b', a / b' or b' alone for blinking
+func start_comparison(a, b *SubaruDataset, mode string, k float64, method int) (*SubaruDataset, error) {
+	if a.fits.wcs == nil || b.fits.wcs == nil {
+		return nil, errors.New("both datasets need a usable WCS")
+	}
+
+	dataId := virtual_dataId(mode, a.dataId, b.dataId, k, method)
+
+	var title string
+
+	switch mode {
+	case "difference":
+		title = a.dataId + " - " + b.dataId
+	case "ratio":
+		title = a.dataId + " / " + b.dataId
+	case "blink":
+		title = b.dataId + " matched to " + a.dataId
+	default:
+		return nil, fmt.Errorf("unknown comparison mode '%s'", mode)
+	}
+
+	return make_virtual_dataset(dataId, title, []*SubaruDataset{a, b}, func() (FITS, error) {
+		matched, scale, err := match_to_reference(&a.fits, &b.fits, k, method)
+
+		if err != nil {
+			return FITS{}, err
+		}
+
+		dataset_logger(dataId).Info("flux scale matched", "title", title, "scale", scale)
+
+		data := matched
+
+		if mode != "blink" {
+			data = make([]float32, len(matched))
+
+			for i, vb := range matched {
+				va := a.fits.data[i]
+
+				if math.IsNaN(float64(vb)) || !is_valid_pixel(&a.fits, va) || (mode == "ratio" && vb == 0) {
+					data[i] = float32(math.NaN())
+				} else if mode == "ratio" {
+					data[i] = va / vb
+				} else {
+					data[i] = va - vb
+				}
+			}
+		}
+
+		grid, cards, _ := reference_grid(&a.fits)
+		cards = append(cards, make_FITS_card("FLXSCALE", fits_float_value(scale), "flux scale applied to "+b.dataId))
+
+		return make_virtual_FITS(&grid, cards, data), nil
+	})
+}
+
+//make_blink_frames renders the same viewport of both datasets, the partner with the stretch of subaru
+//so that only real changes show when the client alternates between them
+//the partner must share the pixel grid (e.g. a blink dataset made by start_comparison)
+func make_blink_frames(subaru, partner *SubaruDataset, hdr wsHeader, x, y, width, height, dst_width, dst_height int) ([][]byte, error) {
+	if partner.fits.width != subaru.fits.width || partner.fits.height != subaru.fits.height {
+		return nil, errors.New("the blink partner must be on the same pixel grid")
+	}
+
+	flags := hdr.flags & (WS_FLAG_LZ4 | WS_FLAG_FLOAT32)
+	frames := make([][]byte, 2)
+
+	for n, fits := range []*FITS{&subaru.fits, &partner.fits} {
+		params, pixels, err := make_viewport(fits, x, y, width, height, dst_width, dst_height)
+
+		if err != nil {
+			return nil, err
+		}
+
+		params = append(params, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(params[24:], uint32(n))
+
+		frames[n] = make_ws_frame(WS_MSG_BLINK_DATA, flags, hdr.request_id, params, encode_pixels(&subaru.fits, flags, pixels))
+	}
+
+	return frames, nil
+}
+
+//GET /subaruwebql/compare?a=dataId&b=dataId[&mode=difference|ratio|blink][&scale=auto|none|k][&interpolation=...]
+//b is reprojected onto the grid of a; blink yields the matched b to be requested with WS_MSG_BLINK alongside a
+func compare_handler(ctx iris.Context) {
+	ids := []string{strings.TrimSpace(ctx.FormValue("a")), strings.TrimSpace(ctx.FormValue("b"))}
+
+	if ids[0] == "" || ids[1] == "" {
+		http_error(ctx, iris.StatusBadRequest, errors.New("two dataIds are needed"))
+		return
+	}
+
+	mode := strings.ToLower(ctx.FormValue("mode"))
+
+	if mode == "" {
+		mode = "difference"
+	}
+
+	k := 0.0
+
+	switch scale := strings.ToLower(ctx.FormValue("scale")); scale {
+	case "", "auto":
+	case "none":
+		k = 1
+	default:
+		value, err := strconv.ParseFloat(scale, 64)
+
+		if err != nil || value <= 0 {
+			http_error(ctx, iris.StatusBadRequest, fmt.Errorf("invalid flux scale '%s'", scale))
+			return
+		}
+
+		k = value
+	}
+
+	method, err := parse_reprojection(ctx.FormValue("interpolation"))
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	subarus, ok := launched_datasets_or_wait(ctx, ids)
+
+	if !ok {
+		return
+	}
+
+	subaru, err := start_comparison(subarus[0], subarus[1], mode, k, method)
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	ctx.JSON(VirtualDatasetInfo{DataId: subaru.dataId, Title: subaru.title, URL: "/subaruwebql/SubaruWebQL.html?dataId=" + subaru.dataId})
+}
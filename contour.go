@@ -0,0 +1,524 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/kataras/iris"
+)
+
+//the image is box-filtered down to at most CONTOUR_MAX_GRID pixels on the longer side,
+//a finer downsampling than that is coarsened
+const CONTOUR_MAX_GRID = 2048
+
+const CONTOUR_MAX_LEVELS = 64
+
+//the smoothing kernel (3 sigma either side) fits into the shorter side of the grid and costs at most
+//as much as a kernel of this width over the largest grid
+const CONTOUR_MAX_KERNEL_WIDTH = 129
+
+var CONTOUR_DEFAULT_SIGMAS = []float64{3, 5, 10, 20, 50}
+
+type contourOptions struct {
+	scale      string    //linear, log or sigma
+	levels     []float64 //explicit levels, in units of the background noise for the sigma scale
+	n          int       //the number of levels generated between lo and hi
+	lo, hi     float64   //NaN picks a default from the image statistics
+	downsample int       //<= 0 chooses automatically
+	smooth     float64   //the Gaussian sigma in downsampled pixels, 0 disables
+}
+
+type ContourGeometry struct {
+	Type        string         `json:"type"`
+	Coordinates [][][2]float64 `json:"coordinates"`
+}
+
+type ContourProperties struct {
+	Level float64  `json:"level"`
+	Sigma *float64 `json:"sigma,omitempty"` //the level in units of the background noise
+	Lines int      `json:"lines"`
+}
+
+type ContourFeature struct {
+	Type       string            `json:"type"`
+	Geometry   ContourGeometry   `json:"geometry"`      //FITS pixel coordinates
+	Sky        *ContourGeometry  `json:"sky,omitempty"` //RA, Dec [deg]
+	Properties ContourProperties `json:"properties"`
+}
+
+type ContourCollection struct {
+	Type       string           `json:"type"`
+	DataId     string           `json:"dataId"`
+	Scale      string           `json:"scale"`
+	Downsample int              `json:"downsample"`
+	Smooth     float64          `json:"smooth"`
+	Features   []ContourFeature `json:"features"`
+}
+
+//contourGrid is the (downsampled) image being contoured, grid point (i, j) lies at the FITS pixel
+//((i+0.5)*sx + 0.5, (j+0.5)*sy + 0.5)
+type contourGrid struct {
+	width, height int
+	values        []float32
+	sx, sy        float64
+}
+
+//contour_grid_size returns the downsampling and the size of the grid, the requested downsampling
+//is only taken when the grid stays within CONTOUR_MAX_GRID
+func contour_grid_size(fits *FITS, downsample int) (int, int, int) {
+	longer := max_int(fits.width, fits.height)
+	coarsest := max_int(1, (longer+CONTOUR_MAX_GRID-1)/CONTOUR_MAX_GRID)
+
+	if downsample < coarsest {
+		downsample = coarsest
+	}
+
+	return downsample, max_int(1, fits.width/downsample), max_int(1, fits.height/downsample)
+}
+
+//max_contour_smooth is the widest Gaussian sigma allowed on a grid
+func max_contour_smooth(width, height int) float64 {
+	affordable := CONTOUR_MAX_KERNEL_WIDTH * CONTOUR_MAX_GRID * CONTOUR_MAX_GRID / (width * height)
+
+	return math.Min(float64(min_int(width, height)), float64(affordable-1)) / 6
+}
+
+func make_contour_grid(fits *FITS, downsample int) contourGrid {
+	downsample, width, height := contour_grid_size(fits, downsample)
+
+	grid := contourGrid{width: width, height: height}
+	grid.sx = float64(fits.width) / float64(width)
+	grid.sy = float64(fits.height) / float64(height)
+
+	if downsample == 1 {
+		grid.values = make([]float32, len(fits.data))
+
+		for i, value := range fits.data {
+			if is_valid_pixel(fits, value) {
+				grid.values[i] = value
+			} else {
+				grid.values[i] = float32(math.NaN())
+			}
+		}
+	} else {
+		grid.values = downsample_region(fits, 0, 0, fits.width, fits.height, width, height)
+	}
+
+	return grid
+}
+
+//smooth_grid applies a separable Gaussian, NaNs are excluded and the weights renormalised
+func smooth_grid(grid *contourGrid, sigma float64) {
+	if sigma <= 0 {
+		return
+	}
+
+	half := int(math.Ceil(3 * sigma))
+	kernel := make([]float64, 2*half+1)
+
+	for k := -half; k <= half; k++ {
+		kernel[k+half] = math.Exp(-0.5 * float64(k*k) / (sigma * sigma))
+	}
+
+	pass := func(src []float32, dx, dy int) []float32 {
+		dst := make([]float32, len(src))
+
+		for j := 0; j < grid.height; j++ {
+			for i := 0; i < grid.width; i++ {
+				if math.IsNaN(float64(src[j*grid.width+i])) {
+					dst[j*grid.width+i] = src[j*grid.width+i]
+					continue
+				}
+
+				var sum, weight float64
+
+				for k := -half; k <= half; k++ {
+					x, y := i+k*dx, j+k*dy
+
+					if x < 0 || y < 0 || x >= grid.width || y >= grid.height {
+						continue
+					}
+
+					value := float64(src[y*grid.width+x])
+
+					if math.IsNaN(value) {
+						continue
+					}
+
+					sum += kernel[k+half] * value
+					weight += kernel[k+half]
+				}
+
+				dst[j*grid.width+i] = float32(sum / weight)
+			}
+		}
+
+		return dst
+	}
+
+	grid.values = pass(pass(grid.values, 1, 0), 0, 1)
+}
+
+//the cell edges crossed by a contour, as pairs of (bottom, right, top, left) indices
+//saddles (5 and 10) are resolved by the mean of the four corners
+var marching_squares_edges = [16][][2]int{
+	{}, {{3, 0}}, {{0, 1}}, {{3, 1}},
+	{{1, 2}}, nil, {{0, 2}}, {{3, 2}},
+	{{2, 3}}, {{0, 2}}, nil, {{1, 2}},
+	{{1, 3}}, {{0, 1}}, {{3, 0}}, {},
+}
+
+//trace_contour returns the polylines at a level in grid coordinates, closed rings repeat their first point
+func trace_contour(grid *contourGrid, level float32) [][][2]float64 {
+	w := grid.width
+	v := grid.values
+
+	//edge ids: 2*(j*w+i) for the horizontal edge right of grid point (i, j), +1 for the vertical edge above it
+	points := make(map[int][2]float64)
+	var segments [][2]int
+
+	crossing := func(id int, x0, y0, x1, y1 int) {
+		if _, ok := points[id]; ok {
+			return
+		}
+
+		a := v[y0*w+x0]
+		b := v[y1*w+x1]
+		t := float64((level - a) / (b - a))
+
+		points[id] = [2]float64{float64(x0) + t*float64(x1-x0), float64(y0) + t*float64(y1-y0)}
+	}
+
+	for j := 0; j+1 < grid.height; j++ {
+		for i := 0; i+1 < w; i++ {
+			a, b, c, d := v[j*w+i], v[j*w+i+1], v[(j+1)*w+i+1], v[(j+1)*w+i]
+
+			if math.IsNaN(float64(a)) || math.IsNaN(float64(b)) || math.IsNaN(float64(c)) || math.IsNaN(float64(d)) {
+				continue
+			}
+
+			index := 0
+
+			if a >= level {
+				index |= 1
+			}
+
+			if b >= level {
+				index |= 2
+			}
+
+			if c >= level {
+				index |= 4
+			}
+
+			if d >= level {
+				index |= 8
+			}
+
+			pairs := marching_squares_edges[index]
+
+			if index == 5 || index == 10 {
+				centre_above := (a+b+c+d)/4 >= level
+
+				if (index == 5) == centre_above {
+					pairs = [][2]int{{0, 1}, {2, 3}}
+				} else {
+					pairs = [][2]int{{3, 0}, {1, 2}}
+				}
+			}
+
+			if len(pairs) == 0 {
+				continue
+			}
+
+			edges := [4]int{2 * (j*w + i), 2*(j*w+i+1) + 1, 2 * ((j+1)*w + i), 2*(j*w+i) + 1}
+
+			crossing(edges[0], i, j, i+1, j)
+			crossing(edges[1], i+1, j, i+1, j+1)
+			crossing(edges[2], i, j+1, i+1, j+1)
+			crossing(edges[3], i, j, i, j+1)
+
+			for _, pair := range pairs {
+				segments = append(segments, [2]int{edges[pair[0]], edges[pair[1]]})
+			}
+		}
+	}
+
+	//every crossed edge is shared by at most two segments, chain them into polylines
+	at := make(map[int][]int)
+
+	for s, seg := range segments {
+		at[seg[0]] = append(at[seg[0]], s)
+		at[seg[1]] = append(at[seg[1]], s)
+	}
+
+	used := make([]bool, len(segments))
+
+	follow := func(edge int) []int {
+		var chain []int
+
+		for {
+			next := -1
+
+			for _, s := range at[edge] {
+				if !used[s] {
+					next = s
+					break
+				}
+			}
+
+			if next < 0 {
+				return chain
+			}
+
+			used[next] = true
+
+			if segments[next][0] == edge {
+				edge = segments[next][1]
+			} else {
+				edge = segments[next][0]
+			}
+
+			chain = append(chain, edge)
+		}
+	}
+
+	var lines [][][2]float64
+
+	for s, seg := range segments {
+		if used[s] {
+			continue
+		}
+
+		used[s] = true
+
+		forward := follow(seg[1])
+		backward := follow(seg[0])
+
+		line := make([][2]float64, 0, len(forward)+len(backward)+2)
+
+		for k := len(backward) - 1; k >= 0; k-- {
+			line = append(line, points[backward[k]])
+		}
+
+		line = append(line, points[seg[0]], points[seg[1]])
+
+		for _, edge := range forward {
+			line = append(line, points[edge])
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+//contour_levels picks the image to contour and the levels according to the scale
+//for the sigma scale the background-subtracted image is contoured and the multiples of the noise are returned too
+func contour_levels(subaru *SubaruDataset, opt contourOptions) (*FITS, []float64, []float64, error) {
+	fits := &subaru.fits
+
+	switch opt.scale {
+	case "sigma":
+		subtracted, err := display_layer(subaru, DISPLAY_SUBTRACTED)
+
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		rms, err := display_layer(subaru, DISPLAY_RMS)
+
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if !(rms.median > 0) {
+			return nil, nil, nil, errors.New("the background noise could not be estimated")
+		}
+
+		sigmas := opt.levels
+
+		if len(sigmas) == 0 {
+			sigmas = CONTOUR_DEFAULT_SIGMAS
+		}
+
+		levels := make([]float64, len(sigmas))
+
+		for i, s := range sigmas {
+			levels[i] = s * float64(rms.median)
+		}
+
+		return subtracted, levels, sigmas, nil
+
+	case "linear", "log":
+		if len(opt.levels) > 0 {
+			return fits, opt.levels, nil, nil
+		}
+
+		lo, hi := opt.lo, opt.hi
+
+		if math.IsNaN(lo) {
+			lo = float64(fits.median) + 3*1.4826*float64(fits.mad)
+		}
+
+		if math.IsNaN(hi) {
+			hi = float64(fits.max)
+		}
+
+		n := opt.n
+
+		if n <= 0 {
+			n = 5
+		}
+
+		if !(hi > lo) {
+			return nil, nil, nil, fmt.Errorf("empty level range [%g, %g]", lo, hi)
+		}
+
+		if opt.scale == "log" && lo <= 0 {
+			return nil, nil, nil, errors.New("logarithmic levels need a positive lower bound")
+		}
+
+		levels := make([]float64, n)
+
+		for k := 0; k < n; k++ {
+			t := 0.0
+
+			if n > 1 {
+				t = float64(k) / float64(n-1)
+			}
+
+			if opt.scale == "log" {
+				levels[k] = lo * math.Pow(hi/lo, t)
+			} else {
+				levels[k] = lo + t*(hi-lo)
+			}
+		}
+
+		return fits, levels, nil, nil
+
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown contour scale '%s'", opt.scale)
+	}
+}
+
+//validate_contour_options bounds the options that size allocations before any level is built
+func validate_contour_options(opt contourOptions) error {
+	if opt.n > CONTOUR_MAX_LEVELS || len(opt.levels) > CONTOUR_MAX_LEVELS {
+		return fmt.Errorf("at most %d contour levels are allowed", CONTOUR_MAX_LEVELS)
+	}
+
+	if math.IsNaN(opt.smooth) {
+		return errors.New("invalid smoothing")
+	}
+
+	return nil
+}
+
+func make_contours(subaru *SubaruDataset, opt contourOptions) (ContourCollection, error) {
+	if err := validate_contour_options(opt); err != nil {
+		return ContourCollection{}, err
+	}
+
+	fits, levels, sigmas, err := contour_levels(subaru, opt)
+
+	if err != nil {
+		return ContourCollection{}, err
+	}
+
+	//the kernel is bounded by the grid it runs over
+	if _, width, height := contour_grid_size(fits, opt.downsample); opt.smooth > max_contour_smooth(width, height) {
+		return ContourCollection{}, fmt.Errorf("the smoothing must not exceed %.1f pixels of the %d x %d grid", max_contour_smooth(width, height), width, height)
+	}
+
+	grid := make_contour_grid(fits, opt.downsample)
+	smooth_grid(&grid, opt.smooth)
+
+	collection := ContourCollection{Type: "FeatureCollection", DataId: subaru.dataId, Scale: opt.scale, Downsample: int(math.Round(grid.sx)), Smooth: opt.smooth}
+	collection.Features = make([]ContourFeature, 0, len(levels))
+
+	for k, level := range levels {
+		lines := trace_contour(&grid, float32(level))
+
+		feature := ContourFeature{Type: "Feature"}
+		feature.Geometry = ContourGeometry{Type: "MultiLineString", Coordinates: make([][][2]float64, 0, len(lines))}
+		feature.Properties = ContourProperties{Level: level, Lines: len(lines)}
+
+		if sigmas != nil {
+			feature.Properties.Sigma = &sigmas[k]
+		}
+
+		if fits.wcs != nil {
+			feature.Sky = &ContourGeometry{Type: "MultiLineString", Coordinates: make([][][2]float64, 0, len(lines))}
+		}
+
+		for _, line := range lines {
+			pixels := make([][2]float64, len(line))
+
+			for i, p := range line {
+				pixels[i] = [2]float64{(p[0]+0.5)*grid.sx + 0.5, (p[1]+0.5)*grid.sy + 0.5}
+			}
+
+			feature.Geometry.Coordinates = append(feature.Geometry.Coordinates, pixels)
+
+			if feature.Sky == nil {
+				continue
+			}
+
+			//vertices without a valid projection are dropped
+			sky := make([][2]float64, 0, len(pixels))
+
+			for _, p := range pixels {
+				if ra, dec, err := fits.wcs.PixelToSky(p[0], p[1]); err == nil {
+					sky = append(sky, [2]float64{ra, dec})
+				}
+			}
+
+			feature.Sky.Coordinates = append(feature.Sky.Coordinates, sky)
+		}
+
+		collection.Features = append(collection.Features, feature)
+	}
+
+	return collection, nil
+}
+
+//GET /subaruwebql/contours?dataId=...&scale=linear|log|sigma[&levels=l1,l2,...][&n=...&min=...&max=...]
+//[&downsample=...][&smooth=...]
+func contours_handler(ctx iris.Context) {
+	subaru, ok := loaded_dataset_or_fail(ctx)
+
+	if !ok {
+		return
+	}
+
+	opt := contourOptions{scale: strings.ToLower(ctx.FormValue("scale")), lo: math.NaN(), hi: math.NaN()}
+
+	if opt.scale == "" {
+		opt.scale = "linear"
+	}
+
+	opt.levels = form_float_list(ctx, "levels")
+	opt.n = form_int(ctx, "n", 0)
+	opt.downsample = form_int(ctx, "downsample", 0)
+	opt.smooth, _ = form_float(ctx, "smooth")
+
+	if lo, ok := form_float(ctx, "min"); ok {
+		opt.lo = lo
+	}
+
+	if hi, ok := form_float(ctx, "max"); ok {
+		opt.hi = hi
+	}
+
+	collection, err := make_contours(subaru, opt)
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	ctx.JSON(collection)
+}
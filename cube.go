@@ -0,0 +1,469 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/kataras/iris"
+)
+
+//the keywords of the third and higher axes, dropped from the headers of extracted planes and cutouts:
+//the WCS and IRAF (LTV, LTM) cards, projection parameters PVi_m by their axis only, and WCSAXES
+var cube_axis_keyword = regexp.MustCompile(`^(NAXIS|CTYPE|CRVAL|CDELT|CRPIX|CUNIT|CROTA|CNAME|CRDER|CSYER|LTV)[3-9]$|^(PC|CD|LTM)([3-9]_\d|\d_[3-9])$|^(PV|PS)[3-9]_\d+$|^WCSAXES$`)
+
+//spectralAxis is the linear WCS of the third axis, planes are numbered from 1 as in FITS
+type spectralAxis struct {
+	ctype string
+	cunit string
+	crval float64
+	cdelt float64
+	crpix float64
+}
+
+func make_spectral_axis(fits *FITS) spectralAxis {
+	axis := spectralAxis{ctype: "PLANE", crval: 1, cdelt: 1, crpix: 1}
+
+	if value, ok := FITS_header_value(fits, "CTYPE3"); ok {
+		axis.ctype = value
+	}
+
+	axis.cunit, _ = FITS_header_value(fits, "CUNIT3")
+
+	if value, ok := FITS_header_float(fits, "CRVAL3"); ok {
+		axis.crval = value
+	}
+
+	if value, ok := FITS_header_float(fits, "CDELT3"); ok && value != 0 {
+		axis.cdelt = value
+	} else if value, ok := FITS_header_float(fits, "CD3_3"); ok && value != 0 {
+		axis.cdelt = value
+	}
+
+	if value, ok := FITS_header_float(fits, "CRPIX3"); ok {
+		axis.crpix = value
+	}
+
+	return axis
+}
+
+//value of the zero-based plane k
+func (axis spectralAxis) value(k int) float64 {
+	return axis.crval + axis.cdelt*(float64(k+1)-axis.crpix)
+}
+
+//plane returns the zero-based plane nearest to a spectral value
+func (axis spectralAxis) plane(value float64) int {
+	return int(math.Floor((value-axis.crval)/axis.cdelt + axis.crpix - 0.5))
+}
+
+func is_cube(fits *FITS) bool {
+	return fits.cube != nil && fits.depth > 1
+}
+
+//cube_plane returns the zero-based plane k of a cube without copying
+func cube_plane(fits *FITS, k int) []float32 {
+	size := fits.width * fits.height
+
+	return fits.cube[k*size : (k+1)*size]
+}
+
+//cube_mean_plane averages the valid pixels along the spectral axis, a cube is displayed through it
+func cube_mean_plane(fits *FITS) []float32 {
+	size := fits.width * fits.height
+	plane := make([]float32, size)
+
+	parallel_for(size, PARALLEL_GRAIN/fits.depth, func(chunk, start, end int) {
+		for index := start; index < end; index++ {
+			var sum float64
+			count := 0
+
+			for k := 0; k < fits.depth; k++ {
+				if value := fits.cube[k*size+index]; is_valid_pixel(fits, value) {
+					sum += float64(value)
+					count++
+				}
+			}
+
+			if count > 0 {
+				plane[index] = float32(sum / float64(count))
+			} else {
+				plane[index] = float32(math.NaN())
+			}
+		}
+	})
+
+	return plane
+}
+
+//cube_moment computes the moment maps over the planes [k0, k1]: 0 the integrated intensity,
+//1 the intensity-weighted spectral coordinate and 2 the dispersion about it;
+//only the pixels above threshold take part
+func cube_moment(fits *FITS, order, k0, k1 int, threshold float64) ([]float32, error) {
+	if order < 0 || order > 2 {
+		return nil, fmt.Errorf("unsupported moment %d", order)
+	}
+
+	axis := make_spectral_axis(fits)
+	size := fits.width * fits.height
+	moment := make([]float32, size)
+	dv := math.Abs(axis.cdelt)
+
+	for index := 0; index < size; index++ {
+		var m0, m1, m2 float64
+
+		//the dispersion needs a second pass about the mean
+		passes := 1
+
+		if order == 2 {
+			passes = 2
+		}
+
+		for pass := 0; pass < passes; pass++ {
+			for k := k0; k <= k1; k++ {
+				value := fits.cube[k*size+index]
+
+				if !is_valid_pixel(fits, value) || float64(value) <= threshold {
+					continue
+				}
+
+				v := axis.value(k)
+
+				if pass == 0 {
+					m0 += float64(value)
+					m1 += float64(value) * v
+				} else {
+					m2 += float64(value) * (v - m1) * (v - m1)
+				}
+			}
+
+			if pass == 0 && order > 0 {
+				m1 /= m0
+			}
+		}
+
+		switch {
+		case order == 0:
+			moment[index] = float32(m0 * dv)
+		case m0 <= 0:
+			moment[index] = float32(math.NaN())
+		case order == 1:
+			moment[index] = float32(m1)
+		default:
+			moment[index] = float32(math.Sqrt(m2 / m0))
+		}
+	}
+
+	return moment, nil
+}
+
+type SpectrumSample struct {
+	Plane int      `json:"plane"`
+	Value float64  `json:"value"` //the spectral coordinate
+	Flux  *float64 `json:"flux"`
+}
+
+type Spectrum struct {
+	DataId  string           `json:"dataId"`
+	Shape   string           `json:"shape"` //pixel or the region shape
+	Mode    string           `json:"mode"`  //sum or mean over the region
+	Ctype   string           `json:"ctype"`
+	Unit    string           `json:"unit"`
+	Pixels  int              `json:"pixels"`
+	Samples []SpectrumSample `json:"samples"`
+}
+
+//cube_spectrum sums (or averages) the valid pixels visited by visit in every plane between k0 and k1
+func cube_spectrum(fits *FITS, k0, k1 int, mean bool, visit func(func(index, x, y int))) Spectrum {
+	axis := make_spectral_axis(fits)
+	size := fits.width * fits.height
+
+	var pixels []int
+
+	visit(func(index, x, y int) {
+		pixels = append(pixels, index)
+	})
+
+	spectrum := Spectrum{Ctype: axis.ctype, Unit: axis.cunit, Pixels: len(pixels), Samples: []SpectrumSample{}}
+
+	for k := k0; k <= k1; k++ {
+		var sum float64
+		count := 0
+
+		for _, index := range pixels {
+			if value := fits.cube[k*size+index]; is_valid_pixel(fits, value) {
+				sum += float64(value)
+				count++
+			}
+		}
+
+		flux := math.NaN()
+
+		if count > 0 {
+			flux = sum
+
+			if mean {
+				flux /= float64(count)
+			}
+		}
+
+		spectrum.Samples = append(spectrum.Samples, SpectrumSample{Plane: k + 1, Value: axis.value(k), Flux: float_ptr(flux)})
+	}
+
+	return spectrum
+}
+
+func spectrum_votable(spectrum Spectrum) *VOTable {
+	t := &VOTable{Resource: spectrum.DataId, Name: "spectrum"}
+
+	t.Params = []VOParam{
+		{Name: "shape", Datatype: "char", Value: spectrum.Shape},
+		{Name: "mode", Datatype: "char", Value: spectrum.Mode},
+		{Name: "pixels", Datatype: "int", Unit: "pix", Value: fmt.Sprintf("%d", spectrum.Pixels)},
+	}
+
+	t.Fields = []VOField{
+		{Name: "plane", Datatype: "int", UCD: "meta.id"},
+		{Name: strings.ToLower(spectrum.Ctype), Datatype: "double", Unit: spectrum.Unit, UCD: "spect"},
+		{Name: "flux", Datatype: "double", UCD: "phot.flux"},
+	}
+
+	for _, s := range spectrum.Samples {
+		t.Rows = append(t.Rows, []interface{}{s.Plane, s.Value, s.Flux})
+	}
+
+	return t
+}
+
+//make_plane_FITS wraps a plane computed from a cube with its two-dimensional header
+func make_plane_FITS(fits *FITS, data []float32, cards ...string) FITS {
+	plane := FITS{BITPIX: -32, NAXIS: 2, width: fits.width, height: fits.height, depth: 1, data: data, IGNRVAL: fits.IGNRVAL, wcs: fits.wcs}
+
+	for _, card := range fits.header {
+		if key, _, ok := parse_FITS_card(card); ok && (FITS_STRUCTURAL_KEYWORDS[key] || cube_axis_keyword.MatchString(key)) {
+			continue
+		}
+
+		plane.header = append(plane.header, card)
+	}
+
+	plane.header = append(plane.header, cards...)
+
+	return plane
+}
+
+//cube_plane_from_form reads a one-based plane, or the spectral value nearest to one
+func cube_plane_from_form(ctx iris.Context, fits *FITS, name, value_name string, def int) (int, error) {
+	k := def
+
+	if value, ok := form_float(ctx, value_name); ok {
+		k = make_spectral_axis(fits).plane(value)
+	} else if _, ok := form_float(ctx, name); ok {
+		k = form_int(ctx, name, def+1) - 1
+	}
+
+	if k < 0 || k >= fits.depth {
+		return 0, fmt.Errorf("the plane lies outside 1..%d", fits.depth)
+	}
+
+	return k, nil
+}
+
+//cube_range_from_form reads the planes from..to (or the spectral values vfrom..vto), the whole cube by default
+func cube_range_from_form(ctx iris.Context, fits *FITS) (int, int, error) {
+	k0, err := cube_plane_from_form(ctx, fits, "from", "vfrom", 0)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	k1, err := cube_plane_from_form(ctx, fits, "to", "vto", fits.depth-1)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if k0 > k1 {
+		k0, k1 = k1, k0
+	}
+
+	return k0, k1, nil
+}
+
+func loaded_cube_or_fail(ctx iris.Context) (*SubaruDataset, bool) {
+	subaru, ok := loaded_dataset_or_fail(ctx)
+
+	if ok && !is_cube(&subaru.fits) {
+		http_error(ctx, iris.StatusBadRequest, errors.New(subaru.dataId+" is not a data cube"))
+		return nil, false
+	}
+
+	return subaru, ok
+}
+
+//GET /subaruwebql/cube/plane?dataId=...&(plane=1..NAXIS3 | value=...)
+//the plane becomes a virtual dataset
+func cube_plane_handler(ctx iris.Context) {
+	subaru, ok := loaded_cube_or_fail(ctx)
+
+	if !ok {
+		return
+	}
+
+	fits := &subaru.fits
+	k, err := cube_plane_from_form(ctx, fits, "plane", "value", fits.depth/2)
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	axis := make_spectral_axis(fits)
+	dataId := virtual_dataId("plane", subaru.dataId, k)
+	title := fmt.Sprintf("plane %d of %s", k+1, subaru.dataId)
+
+	plane, err := make_virtual_dataset(dataId, title, []*SubaruDataset{subaru}, func() (FITS, error) {
+		data := append([]float32{}, cube_plane(fits, k)...)
+
+		return make_plane_FITS(fits, data,
+			make_FITS_card("PLANE", fmt.Sprintf("%d", k+1), "the plane of "+subaru.dataId),
+			make_FITS_card("SPECVAL", fits_float_value(axis.value(k)), strings.TrimSpace(axis.ctype+" "+axis.cunit))), nil
+	})
+
+	if err != nil {
+		http_error(ctx, iris.StatusServiceUnavailable, err)
+		return
+	}
+
+	ctx.JSON(VirtualDatasetInfo{DataId: plane.dataId, Title: plane.title, URL: "/subaruwebql/SubaruWebQL.html?dataId=" + plane.dataId})
+}
+
+//GET /subaruwebql/cube/moment?dataId=...[&order=0|1|2][&from=..&to=.. | &vfrom=..&vto=..][&threshold=...]
+//the moment map becomes a virtual dataset
+func cube_moment_handler(ctx iris.Context) {
+	subaru, ok := loaded_cube_or_fail(ctx)
+
+	if !ok {
+		return
+	}
+
+	fits := &subaru.fits
+	order := form_int(ctx, "order", 0)
+
+	if order < 0 || order > 2 {
+		http_error(ctx, iris.StatusBadRequest, fmt.Errorf("unsupported moment %d", order))
+		return
+	}
+
+	k0, k1, err := cube_range_from_form(ctx, fits)
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	threshold, ok := form_float(ctx, "threshold")
+
+	if !ok {
+		threshold = math.Inf(-1)
+	}
+
+	dataId := virtual_dataId("moment", subaru.dataId, order, k0, k1, threshold)
+	title := fmt.Sprintf("moment %d of %s (planes %d-%d)", order, subaru.dataId, k0+1, k1+1)
+
+	moment, err := make_virtual_dataset(dataId, title, []*SubaruDataset{subaru}, func() (FITS, error) {
+		data, err := cube_moment(fits, order, k0, k1, threshold)
+
+		if err != nil {
+			return FITS{}, err
+		}
+
+		return make_plane_FITS(fits, data, make_FITS_card("MOMENT", fmt.Sprintf("%d", order), "the moment of "+subaru.dataId)), nil
+	})
+
+	if err != nil {
+		http_error(ctx, iris.StatusServiceUnavailable, err)
+		return
+	}
+
+	ctx.JSON(VirtualDatasetInfo{DataId: moment.dataId, Title: moment.title, URL: "/subaruwebql/SubaruWebQL.html?dataId=" + moment.dataId})
+}
+
+//GET /subaruwebql/cube/spectrum?dataId=...&(x=...&y=... | shape=...&<region parameters>)[&frame=sky]
+//[&mode=sum|mean][&from=..&to=..][&format=votable]
+func cube_spectrum_handler(ctx iris.Context) {
+	subaru, ok := loaded_cube_or_fail(ctx)
+
+	if !ok {
+		return
+	}
+
+	fits := &subaru.fits
+
+	k0, k1, err := cube_range_from_form(ctx, fits)
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	mode := strings.ToLower(ctx.FormValue("mode"))
+
+	if mode == "" {
+		mode = "sum"
+	}
+
+	if mode != "sum" && mode != "mean" {
+		http_error(ctx, iris.StatusBadRequest, fmt.Errorf("unknown mode '%s'", mode))
+		return
+	}
+
+	var spectrum Spectrum
+
+	if ctx.FormValue("shape") != "" {
+		spec, err := region_spec_from_form(ctx)
+
+		if err != nil {
+			http_error(ctx, iris.StatusBadRequest, err)
+			return
+		}
+
+		r, err := resolve_region(fits, spec)
+
+		if err != nil {
+			http_error(ctx, iris.StatusBadRequest, err)
+			return
+		}
+
+		spectrum = cube_spectrum(fits, k0, k1, mode == "mean", func(f func(index, x, y int)) {
+			region_pixels(fits, r, f)
+		})
+		spectrum.Shape = r.shape
+	} else {
+		x, y, err := form_position(ctx, fits, "x", "y")
+
+		if err != nil {
+			http_error(ctx, iris.StatusBadRequest, err)
+			return
+		}
+
+		i, j := int(math.Floor(x+0.5))-1, int(math.Floor(y+0.5))-1
+
+		if i < 0 || i >= fits.width || j < 0 || j >= fits.height {
+			http_error(ctx, iris.StatusBadRequest, errors.New("the position lies outside the image"))
+			return
+		}
+
+		spectrum = cube_spectrum(fits, k0, k1, false, func(f func(index, x, y int)) {
+			f(j*fits.width+i, i, j)
+		})
+		spectrum.Shape = "pixel"
+	}
+
+	spectrum.DataId = subaru.dataId
+	spectrum.Mode = mode
+
+	send_table(ctx, spectrum, func() *VOTable { return spectrum_votable(spectrum) })
+}
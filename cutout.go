@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/kataras/iris"
+)
+
+//keywords that are always rewritten in a cutout header, the checksums of the original data are dropped
+var FITS_STRUCTURAL_KEYWORDS = map[string]bool{
+	"SIMPLE": true, "BITPIX": true, "NAXIS": true, "NAXIS1": true, "NAXIS2": true, "NAXIS3": true,
+	"EXTEND": true, "BSCALE": true, "BZERO": true, "BLANK": true, "DATAMIN": true, "DATAMAX": true,
+	"CHECKSUM": true, "DATASUM": true,
+}
+
+//make_FITS_card formats a fixed-format header card, value is inserted verbatim (strings must already be quoted)
+func make_FITS_card(key, value, comment string) string {
+	card := fmt.Sprintf("%-8s= %20s", key, value)
+
+	if comment != "" {
+		card += " / " + comment
+	}
+
+	if len(card) > FITS_LINE_LENGTH {
+		card = card[:FITS_LINE_LENGTH]
+	}
+
+	return fmt.Sprintf("%-80s", card)
+}
+
+func fits_float_value(f float64) string {
+	return strings.ToUpper(fmt.Sprintf("%.15G", f))
+}
+
+//pad_FITS_block pads to a multiple of 2880 bytes with the given byte (spaces for headers, zeroes for data)
+func pad_FITS_block(buf *bytes.Buffer, pad byte) {
+	if rem := buf.Len() % FITS_HEADER_LENGTH; rem > 0 {
+		buf.Write(bytes.Repeat([]byte{pad}, FITS_HEADER_LENGTH-rem))
+	}
+}
+
+//copy_FITS_header copies the non-structural cards of the first two axes, shifting CRPIX and LTV by the cutout origin (zero-based)
+func copy_FITS_header(fits *FITS, x0, y0 int) []string {
+	cards := make([]string, 0, len(fits.header))
+
+	for _, card := range fits.header {
+		key, value, ok := parse_FITS_card(card)
+
+		if !ok {
+			//COMMENT, HISTORY and blank cards
+			cards = append(cards, card)
+			continue
+		}
+
+		if FITS_STRUCTURAL_KEYWORDS[key] {
+			continue
+		}
+
+		//a cutout is a single plane, the cards of a spectral axis would describe an axis it no longer has
+		if cube_axis_keyword.MatchString(key) {
+			continue
+		}
+
+		//both the WCS reference pixel and the IRAF image-to-physical offset move with the origin
+		if key == "CRPIX1" || key == "CRPIX2" || key == "LTV1" || key == "LTV2" {
+			var pos float64
+
+			if _, err := fmt.Sscanf(value, "%g", &pos); err == nil {
+				if strings.HasSuffix(key, "1") {
+					pos -= float64(x0)
+				} else {
+					pos -= float64(y0)
+				}
+
+				comment := "reference pixel (cutout)"
+
+				if strings.HasPrefix(key, "LTV") {
+					comment = "image to physical offset (cutout)"
+				}
+
+				card = make_FITS_card(key, fits_float_value(pos), comment)
+			}
+		}
+
+		cards = append(cards, card)
+	}
+
+	return cards
+}
+
+//make_FITS_cutout extracts the zero-based pixel box [x0, x0+width) x [y0, y0+height) as a complete FITS file
+//bitpix is one of -32, -64, 8, 16 or 32; integer types are scaled with BSCALE/BZERO and invalid pixels set to BLANK
+func make_FITS_cutout(fits *FITS, x0, y0, width, height, bitpix int) ([]byte, error) {
+	if x0 < 0 || y0 < 0 || width <= 0 || height <= 0 || x0+width > fits.width || y0+height > fits.height {
+		return nil, errors.New("the cutout lies outside the image")
+	}
+
+	switch bitpix {
+	case -32, -64, 8, 16, 32:
+	default:
+		return nil, fmt.Errorf("unsupported BITPIX %d", bitpix)
+	}
+
+	//the valid data range sets the integer scaling
+	dmin := math.Inf(1)
+	dmax := math.Inf(-1)
+
+	for y := y0; y < y0+height; y++ {
+		for _, value := range fits.data[y*fits.width+x0 : y*fits.width+x0+width] {
+			if is_valid_pixel(fits, value) {
+				dmin = math.Min(dmin, float64(value))
+				dmax = math.Max(dmax, float64(value))
+			}
+		}
+	}
+
+	var bscale, bzero float64 = 1, 0
+	var blank int64
+
+	if bitpix > 0 {
+		if math.IsInf(dmin, 0) {
+			dmin, dmax = 0, 0
+		}
+
+		//the highest integer is reserved for BLANK (the lowest for signed types)
+		switch bitpix {
+		case 8:
+			blank = 255
+			bzero = dmin
+			bscale = (dmax - dmin) / 254.0
+		case 16:
+			blank = math.MinInt16
+			bzero = 0.5 * (dmax + dmin)
+			bscale = (dmax - dmin) / 65534.0
+		case 32:
+			blank = math.MinInt32
+			bzero = 0.5 * (dmax + dmin)
+			bscale = (dmax - dmin) / 4294967294.0
+		}
+
+		if bscale == 0 {
+			bscale = 1
+		}
+	}
+
+	var buf bytes.Buffer
+
+	buf.WriteString(make_FITS_card("SIMPLE", "T", "conforms to FITS standard"))
+	buf.WriteString(make_FITS_card("BITPIX", fmt.Sprintf("%d", bitpix), "array data type"))
+	buf.WriteString(make_FITS_card("NAXIS", "2", "number of array dimensions"))
+	buf.WriteString(make_FITS_card("NAXIS1", fmt.Sprintf("%d", width), ""))
+	buf.WriteString(make_FITS_card("NAXIS2", fmt.Sprintf("%d", height), ""))
+
+	if bitpix > 0 {
+		buf.WriteString(make_FITS_card("BSCALE", fits_float_value(bscale), ""))
+		buf.WriteString(make_FITS_card("BZERO", fits_float_value(bzero), ""))
+		buf.WriteString(make_FITS_card("BLANK", fmt.Sprintf("%d", blank), ""))
+	}
+
+	for _, card := range copy_FITS_header(fits, x0, y0) {
+		buf.WriteString(card)
+	}
+
+	buf.WriteString(fmt.Sprintf("%-80s", fmt.Sprintf("HISTORY %s cutout [%d:%d,%d:%d]", SERVER_STRING, x0+1, x0+width, y0+1, y0+height)))
+	buf.WriteString(fmt.Sprintf("%-80s", "END"))
+	pad_FITS_block(&buf, ' ')
+
+	//big-endian data
+	word := make([]byte, 8)
+
+	for y := y0; y < y0+height; y++ {
+		for _, value := range fits.data[y*fits.width+x0 : y*fits.width+x0+width] {
+			valid := is_valid_pixel(fits, value)
+
+			switch bitpix {
+			case -32:
+				if !valid {
+					value = float32(math.NaN())
+				}
+				binary.BigEndian.PutUint32(word, math.Float32bits(value))
+				buf.Write(word[:4])
+			case -64:
+				v := float64(value)
+				if !valid {
+					v = math.NaN()
+				}
+				binary.BigEndian.PutUint64(word, math.Float64bits(v))
+				buf.Write(word[:8])
+			default:
+				q := blank
+
+				if valid {
+					q = int64(math.Floor((float64(value)-bzero)/bscale + 0.5))
+				}
+
+				switch bitpix {
+				case 8:
+					if valid && q > 254 {
+						q = 254
+					}
+					buf.WriteByte(byte(q))
+				case 16:
+					if valid && q < math.MinInt16+1 {
+						q = math.MinInt16 + 1
+					}
+					binary.BigEndian.PutUint16(word, uint16(int16(q)))
+					buf.Write(word[:2])
+				case 32:
+					if valid && q < math.MinInt32+1 {
+						q = math.MinInt32 + 1
+					}
+					binary.BigEndian.PutUint32(word, uint32(int32(q)))
+					buf.Write(word[:4])
+				}
+			}
+		}
+	}
+
+	pad_FITS_block(&buf, 0)
+
+	return buf.Bytes(), nil
+}
+
+//cutout_box_from_form accepts either a pixel box (x1,y1,x2,y2; inclusive FITS pixel coordinates) or
+//a sky box (ra, dec [deg], width, height [arcsec]) and returns the zero-based origin and size
+func cutout_box_from_form(ctx iris.Context, fits *FITS) (int, int, int, int, error) {
+	x1, has_x1 := form_float(ctx, "x1")
+	y1, has_y1 := form_float(ctx, "y1")
+	x2, has_x2 := form_float(ctx, "x2")
+	y2, has_y2 := form_float(ctx, "y2")
+
+	if !(has_x1 && has_y1 && has_x2 && has_y2) {
+		ra, has_ra := form_float(ctx, "ra")
+		dec, has_dec := form_float(ctx, "dec")
+		width, has_width := form_float(ctx, "width")
+		height, has_height := form_float(ctx, "height")
+
+		if !(has_ra && has_dec && has_width) {
+			return 0, 0, 0, 0, errors.New("either x1,y1,x2,y2 or ra,dec,width[,height] are required")
+		}
+
+		if !has_height {
+			height = width
+		}
+
+		var err error
+
+		if x1, y1, x2, y2, err = cutout_sky_box(fits, ra, dec, width, height); err != nil {
+			return 0, 0, 0, 0, err
+		}
+	}
+
+	return cutout_pixel_box(fits, x1, y1, x2, y2)
+}
+
+//cutout_sky_box converts a sky box (ra, dec [deg], width, height [arcsec]) into FITS pixel coordinates
+func cutout_sky_box(fits *FITS, ra, dec, width, height float64) (float64, float64, float64, float64, error) {
+	x, y, err := sky_to_pixel(fits, ra, dec)
+
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+
+	scale := fits.wcs.PixelScale()
+
+	return x - 0.5*width/scale, y - 0.5*height/scale, x + 0.5*width/scale, y + 0.5*height/scale, nil
+}
+
+//cutout_pixel_box clips the inclusive FITS pixel box (x1,y1)-(x2,y2) to the image
+//and returns the zero-based origin and size
+func cutout_pixel_box(fits *FITS, x1, y1, x2, y2 float64) (int, int, int, int, error) {
+	if x2 < x1 {
+		x1, x2 = x2, x1
+	}
+
+	if y2 < y1 {
+		y1, y2 = y2, y1
+	}
+
+	//FITS pixel coordinates -> zero-based indices, clipped to the image
+	ix1 := int(math.Max(0, math.Floor(x1+0.5)-1))
+	iy1 := int(math.Max(0, math.Floor(y1+0.5)-1))
+	ix2 := int(math.Min(float64(fits.width-1), math.Floor(x2+0.5)-1))
+	iy2 := int(math.Min(float64(fits.height-1), math.Floor(y2+0.5)-1))
+
+	if ix2 < ix1 || iy2 < iy1 {
+		return 0, 0, 0, 0, errors.New("the cutout lies outside the image")
+	}
+
+	return ix1, iy1, ix2 - ix1 + 1, iy2 - iy1 + 1, nil
+}
+
+//GET /subaruwebql/cutout?dataId=...&x1=...&y1=...&x2=...&y2=...[&bitpix=-32][&gzip=true]
+func cutout_handler(ctx iris.Context) {
+	subaru, ok := loaded_dataset_or_fail(ctx)
+
+	if !ok {
+		return
+	}
+
+	x0, y0, width, height, err := cutout_box_from_form(ctx, &subaru.fits)
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	cutout, err := make_FITS_cutout(&subaru.fits, x0, y0, width, height, form_int(ctx, "bitpix", -32))
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	filename := fmt.Sprintf("%s_%d_%d_%dx%d.fits", subaru.dataId, x0+1, y0+1, width, height)
+
+	if ctx.FormValue("gzip") == "true" || ctx.FormValue("gzip") == "1" {
+		var gz bytes.Buffer
+
+		zw := gzip.NewWriter(&gz)
+		zw.Write(cutout)
+		zw.Close()
+
+		cutout = gz.Bytes()
+		filename += ".gz"
+		ctx.ContentType("application/gzip")
+	} else {
+		ctx.ContentType("application/fits")
+	}
+
+	ctx.Header("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	ctx.Write(cutout)
+}
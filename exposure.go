@@ -0,0 +1,789 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kataras/iris"
+)
+
+//the frame ids of the CCDs of an exposure: prefix followed by 8 digits, exposure*stride + ccd
+//HSC numbers its exposures in steps of two so CCDs 100-111 carry the next (odd) exposure number
+type exposureInstrument struct {
+	prefix string
+	chips  int
+	stride int
+}
+
+var EXPOSURE_INSTRUMENTS = []exposureInstrument{
+	{prefix: "SUPA", chips: 10, stride: 10},
+	{prefix: "HSCA", chips: 112, stride: 100},
+}
+
+//concurrent CCD downloads per exposure
+const EXPOSURE_DOWNLOADS = 8
+const EXPOSURE_TIMEOUT = 600 //[s]
+
+type ExposureChip struct {
+	DataId string `json:"dataId"`
+	URL    string `json:"url"`
+	Loaded bool   `json:"loaded"`
+	Error  string `json:"error,omitempty"`
+}
+
+//Exposure groups the per-CCD files of one exposure, assembled into a single focal-plane dataset
+type Exposure struct {
+	sync.Mutex
+	id       string //the dataId, with the layout suffix
+	exposure string //the exposure id the CCDs are looked up by
+	layout   string //wcs or detsec
+	chips    []ExposureChip
+}
+
+type ExposureInfo struct {
+	VirtualDatasetInfo
+	Layout string         `json:"layout"`
+	Chips  []ExposureChip `json:"chips"`
+}
+
+//exposure_frame_ids expands an exposure id (e.g. SUPA0123456 or HSCA012346) or any of its frame ids
+func exposure_frame_ids(exposureId string) ([]string, error) {
+	for _, instrument := range EXPOSURE_INSTRUMENTS {
+		if !strings.HasPrefix(exposureId, instrument.prefix) {
+			continue
+		}
+
+		digits := strings.TrimPrefix(exposureId, instrument.prefix)
+		n, err := strconv.Atoi(digits)
+
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid exposure id '%s'", exposureId)
+		}
+
+		//a frame id rather than an exposure id
+		if len(digits) == 8 {
+			n /= instrument.stride
+		}
+
+		ids := make([]string, instrument.chips)
+
+		for ccd := range ids {
+			ids[ccd] = fmt.Sprintf("%s%08d", instrument.prefix, n*instrument.stride+ccd)
+		}
+
+		return ids, nil
+	}
+
+	return nil, fmt.Errorf("'%s' is neither a Suprime-Cam nor an HSC exposure", exposureId)
+}
+
+//votable_chips reads the DATA_ID and ACCESS_REF columns of a VOTable, one row per CCD
+func votable_chips(filename string) ([]ExposureChip, error) {
+	file, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	table, err := read_VOTable_catalogue(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	id_col := table.find_column(nil, []string{"DATA_ID"})
+	url_col := table.find_column(nil, []string{"ACCESS_REF"})
+
+	if id_col < 0 || url_col < 0 {
+		return nil, errors.New("the VOTable has no DATA_ID or ACCESS_REF column")
+	}
+
+	var chips []ExposureChip
+
+	for _, row := range table.rows {
+		if id_col < len(row) && url_col < len(row) && strings.TrimSpace(row[url_col]) != "" {
+			chips = append(chips, ExposureChip{DataId: strings.TrimSpace(row[id_col]), URL: strings.TrimSpace(row[url_col])})
+		}
+	}
+
+	return chips, nil
+}
+
+//find_exposure_chips lists the CCDs through the given VOTable or, without one, queries the archive
+//for every frame id of the exposure; CCDs missing from the archive are left out
+func find_exposure_chips(exposureId, votable string) ([]ExposureChip, error) {
+	//the id names a cache file
+	if !safe_name.MatchString(exposureId) {
+		return nil, fmt.Errorf("invalid exposure id '%s'", exposureId)
+	}
+
+	if strings.TrimSpace(votable) != "" {
+		filename := VOTABLECACHE + "/exposure-" + exposureId + ".xml"
+
+		_, err := os.Stat(filename)
+		count_cache("votable", err == nil)
+
+		if err != nil {
+			if err := fetch_to_file(votable, filename, CATALOGUE_TIMEOUT); err != nil {
+				return nil, err
+			}
+		}
+
+		return votable_chips(filename)
+	}
+
+	ids, err := exposure_frame_ids(exposureId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([][]ExposureChip, len(ids))
+	sem := make(chan struct{}, EXPOSURE_DOWNLOADS)
+
+	var wg sync.WaitGroup
+
+	for k, dataId := range ids {
+		wg.Add(1)
+
+		go func(k int, dataId string) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			filename := VOTABLECACHE + "/" + dataId + ".xml"
+
+			_, err := os.Stat(filename)
+			count_cache("votable", err == nil)
+
+			if err != nil {
+				if err := fetch_to_file(default_votable_url(dataId), filename, CATALOGUE_TIMEOUT); err != nil {
+					return
+				}
+			}
+
+			found[k], _ = votable_chips(filename)
+		}(k, dataId)
+	}
+
+	wg.Wait()
+
+	var chips []ExposureChip
+
+	for _, f := range found {
+		chips = append(chips, f...)
+	}
+
+	return chips, nil
+}
+
+//fetch_chip downloads a CCD into FITSCACHE unless it is there already, returning the file name
+func fetch_chip(chip ExposureChip) (string, error) {
+	filename := FITSCACHE + "/" + chip.dataId() + ".fits"
+
+	_, err := os.Stat(filename)
+	count_cache("fits", err == nil)
+
+	if err == nil {
+		return filename, nil
+	}
+
+	//the CCDs are shared by the layouts of an exposure, which may be built at the same time
+	err = share_fetch(filename, func() error {
+		download := filename + ".download"
+
+		if err := fetch_to_file(chip.URL, download, EXPOSURE_TIMEOUT); err != nil {
+			return err
+		}
+
+		buf, err := ioutil.ReadFile(download)
+		os.Remove(download)
+
+		if err != nil {
+			return err
+		}
+
+		if len(buf) > 2 && buf[0] == 0x1f && buf[1] == 0x8b {
+			gr, err := gzip.NewReader(bytes.NewReader(buf))
+
+			if err != nil {
+				return err
+			}
+
+			buf, err = ioutil.ReadAll(gr)
+			gr.Close()
+
+			if err != nil {
+				return err
+			}
+		}
+
+		//a reader never sees a partly written CCD
+		return write_file_atomic(filename, func(fp *os.File) error {
+			_, err := fp.Write(buf)
+			return err
+		})
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return filename, nil
+}
+
+//read_chip_header reads only the geometry of a CCD: its size, WCS and sections
+func read_chip_header(filename string) (*FITS, error) {
+	fp, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer fp.Close()
+
+	header, err := read_header_blocks(fp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var fits FITS
+	read_FITS_header(&fits, header)
+	fits.wcs = make_FITS_wcs(fits.header)
+
+	return &fits, nil
+}
+
+//read_chip reads the pixels of a downloaded CCD, release_chip gives them up again
+func read_chip(chip ExposureChip, filename string) (fits *FITS, err error) {
+	//the reader panics on malformed files
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s: %v", chip.DataId, r)
+		}
+	}()
+
+	fp, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer fp.Close()
+
+	//a chip decoded before is mapped from its pixel cache
+	subaru := &SubaruDataset{dataId: chip.dataId()}
+	read_FITS_from_file(subaru, fp)
+
+	return &subaru.fits, nil
+}
+
+func release_chip(fits *FITS) {
+	if fits.mapping != nil {
+		if err := munmap_file(fits.mapping); err != nil {
+			logger.Warn("CCD pixels not unmapped", "error", err)
+		}
+	}
+
+	fits.data, fits.cube, fits.mapping = nil, nil, nil
+}
+
+//dataId keeps the cache file names within FITSCACHE
+func (chip ExposureChip) dataId() string {
+	return strings.NewReplacer("/", "_", "\\", "_", "..", "_").Replace(chip.DataId)
+}
+
+//parse_FITS_section reads a section such as '[1:2048,1:4096]', the first index may exceed the second
+func parse_FITS_section(s string) ([4]int, error) {
+	var v [4]int
+
+	if _, err := fmt.Sscanf(strings.Replace(strings.TrimSpace(s), " ", "", -1), "[%d:%d,%d:%d]", &v[0], &v[1], &v[2], &v[3]); err != nil {
+		return v, fmt.Errorf("invalid section '%s'", s)
+	}
+
+	return v, nil
+}
+
+func section_step(a, b int) int {
+	if b < a {
+		return -1
+	}
+
+	return 1
+}
+
+//exposureAssembly places the CCDs on the focal plane one at a time, so that only the CCDs
+//being read are held in memory; the layout is set up from their headers beforehand
+type exposureAssembly interface {
+	add(k int, fits *FITS) error
+	finish() FITS
+}
+
+type detsecPlacement struct {
+	width, height int
+	det, dat      [4]int
+}
+
+//detsecAssembly places the DATASEC of every chip at its DETSEC on the focal plane,
+//binning until the plane fits into REPROJECT_MAX_PIXELS
+type detsecAssembly struct {
+	sync.Mutex
+	placements                []*detsecPlacement
+	xmin, ymin, width, height int
+	bin                       int
+	sum                       []float32
+	count                     []int32
+}
+
+//make_detsec_assembly lays out the chips with a header, the others are skipped
+func make_detsec_assembly(headers []*FITS) (*detsecAssembly, error) {
+	placements := make([]*detsecPlacement, len(headers))
+	xmin, xmax, ymin, ymax := math.MaxInt32, math.MinInt32, math.MaxInt32, math.MinInt32
+
+	for k, fits := range headers {
+		if fits == nil {
+			continue
+		}
+
+		value, ok := FITS_header_value(fits, "DETSEC")
+
+		if !ok {
+			return nil, errors.New("a CCD has no DETSEC")
+		}
+
+		det, err := parse_FITS_section(value)
+
+		if err != nil {
+			return nil, err
+		}
+
+		dat := [4]int{1, fits.width, 1, fits.height}
+
+		if value, ok := FITS_header_value(fits, "DATASEC"); ok {
+			if dat, err = parse_FITS_section(value); err != nil {
+				return nil, err
+			}
+		}
+
+		if abs_int(det[1]-det[0]) != abs_int(dat[1]-dat[0]) || abs_int(det[3]-det[2]) != abs_int(dat[3]-dat[2]) {
+			return nil, errors.New("the DETSEC and DATASEC of a CCD differ in size")
+		}
+
+		if dat[0] < 1 || dat[1] < 1 || dat[2] < 1 || dat[3] < 1 || dat[0] > fits.width || dat[1] > fits.width || dat[2] > fits.height || dat[3] > fits.height {
+			return nil, errors.New("the DATASEC of a CCD lies outside the image")
+		}
+
+		xmin, xmax = min_int(xmin, min_int(det[0], det[1])), max_int(xmax, max_int(det[0], det[1]))
+		ymin, ymax = min_int(ymin, min_int(det[2], det[3])), max_int(ymax, max_int(det[2], det[3]))
+
+		placements[k] = &detsecPlacement{width: fits.width, height: fits.height, det: det, dat: dat}
+	}
+
+	if xmin > xmax || ymin > ymax {
+		return nil, errors.New("no CCD to place")
+	}
+
+	area := float64(xmax-xmin+1) * float64(ymax-ymin+1)
+	bin := int(math.Ceil(math.Sqrt(area / REPROJECT_MAX_PIXELS)))
+
+	if bin < 1 {
+		bin = 1
+	}
+
+	width := (xmax-xmin)/bin + 1
+	height := (ymax-ymin)/bin + 1
+
+	return &detsecAssembly{placements: placements, xmin: xmin, ymin: ymin, width: width, height: height, bin: bin,
+		sum: make([]float32, width*height), count: make([]int32, width*height)}, nil
+}
+
+func (a *detsecAssembly) add(k int, fits *FITS) error {
+	p := a.placements[k]
+
+	if p == nil {
+		return errors.New("the CCD has no placement")
+	}
+
+	if fits.width != p.width || fits.height != p.height || len(fits.data) < fits.width*fits.height {
+		return errors.New("the CCD no longer matches its header")
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	sx, sy := section_step(p.det[0], p.det[1]), section_step(p.det[2], p.det[3])
+	ix, iy := section_step(p.dat[0], p.dat[1]), section_step(p.dat[2], p.dat[3])
+
+	for v := 0; v <= abs_int(p.dat[3]-p.dat[2]); v++ {
+		j := p.dat[2] + v*iy - 1
+		y := (p.det[2] + v*sy - a.ymin) / a.bin
+
+		for u := 0; u <= abs_int(p.dat[1]-p.dat[0]); u++ {
+			i := p.dat[0] + u*ix - 1
+			value := fits.data[j*fits.width+i]
+
+			if !is_valid_pixel(fits, value) {
+				continue
+			}
+
+			index := y*a.width + (p.det[0]+u*sx-a.xmin)/a.bin
+			a.sum[index] += value
+			a.count[index]++
+		}
+	}
+
+	return nil
+}
+
+func (a *detsecAssembly) finish() FITS {
+	for index := range a.sum {
+		if a.count[index] > 0 {
+			a.sum[index] /= float32(a.count[index])
+		} else {
+			a.sum[index] = float32(math.NaN())
+		}
+	}
+
+	fits := FITS{BITPIX: -32, NAXIS: 2, width: a.width, height: a.height, depth: 1, data: a.sum, IGNRVAL: -math.MaxFloat32}
+	fits.header = []string{make_FITS_card("DETBIN", fmt.Sprintf("%d", a.bin), "the focal plane binning")}
+
+	return fits
+}
+
+func abs_int(a int) int {
+	if a < 0 {
+		return -a
+	}
+
+	return a
+}
+
+func min_int(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func max_int(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+//wcsAssembly resamples the chips onto a north-up grid centred on the exposure, halving the resolution
+//until the grid fits into REPROJECT_MAX_PIXELS
+type wcsAssembly struct {
+	sync.Mutex
+	grid   reprojectGrid
+	cards  []string
+	method int
+	sum    *mosaicSum
+}
+
+//make_wcs_assembly sets the grid up from the chips with a header, the others are skipped
+func make_wcs_assembly(headers []*FITS, method int) (*wcsAssembly, error) {
+	var chips []*FITS
+	var v [3]float64
+
+	for _, fits := range headers {
+		if fits == nil {
+			continue
+		}
+
+		ra, dec, err := fits.wcs.PixelToSky(0.5*float64(fits.width+1), 0.5*float64(fits.height+1))
+
+		if err != nil {
+			return nil, err
+		}
+
+		ra, dec = ra*math.Pi/180, dec*math.Pi/180
+		v[0] += math.Cos(dec) * math.Cos(ra)
+		v[1] += math.Cos(dec) * math.Sin(ra)
+		v[2] += math.Sin(dec)
+
+		chips = append(chips, fits)
+	}
+
+	if len(chips) == 0 {
+		return nil, errors.New("no CCD to place")
+	}
+
+	ra := math.Atan2(v[1], v[0]) * 180 / math.Pi
+	dec := math.Atan2(v[2], math.Hypot(v[0], v[1])) * 180 / math.Pi
+
+	if ra < 0 {
+		ra += 360
+	}
+
+	scale := math.Inf(1)
+
+	for _, fits := range chips {
+		scale = math.Min(scale, fits.wcs.PixelScale())
+	}
+
+	for bin := 1; ; bin *= 2 {
+		grid, cards, err := target_grid(chips, "TAN", ra, dec, scale*float64(bin), 0, 0)
+
+		if err != nil && bin < 64 && strings.Contains(err.Error(), "too large") {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &wcsAssembly{grid: grid, cards: cards, method: method, sum: make_mosaic_sum(&grid)}, nil
+	}
+}
+
+func (a *wcsAssembly) add(k int, fits *FITS) error {
+	plane, err := reproject(fits, &a.grid, a.method)
+
+	if err != nil {
+		return err
+	}
+
+	a.Lock()
+	a.sum.add(plane, 1)
+	a.Unlock()
+
+	return nil
+}
+
+func (a *wcsAssembly) finish() FITS {
+	return make_virtual_FITS(&a.grid, a.cards, a.sum.mean())
+}
+
+//build downloads the CCDs concurrently and reads their headers to lay the exposure out,
+//then reads, places and releases the CCDs a few at a time
+func (exposure *Exposure) build(votable string, method int) (FITS, error) {
+	chips, err := find_exposure_chips(exposure.exposure, votable)
+
+	if err != nil {
+		return FITS{}, err
+	}
+
+	if len(chips) == 0 {
+		return FITS{}, fmt.Errorf("no CCDs of %s were found", exposure.id)
+	}
+
+	exposure.Lock()
+	exposure.chips = chips
+	exposure.Unlock()
+
+	filenames := make([]string, len(chips))
+	headers := make([]*FITS, len(chips))
+	done := 0
+
+	//both passes report their progress
+	progress := func(k int, err error) {
+		exposure.Lock()
+		defer exposure.Unlock()
+
+		if err != nil {
+			exposure.chips[k].Error = err.Error()
+		}
+
+		done++
+		send_progress_notification(exposure.id, int64(done), int(round(100.0*float64(done)/float64(2*len(chips)))))
+	}
+
+	for_each_chip(len(chips), func(k int) {
+		filename, err := fetch_chip(chips[k])
+
+		if err == nil {
+			headers[k], err = read_chip_header(filename)
+			filenames[k] = filename
+		}
+
+		progress(k, err)
+	})
+
+	loaded := 0
+	has_wcs := true
+
+	for _, fits := range headers {
+		if fits != nil {
+			loaded++
+			has_wcs = has_wcs && fits.wcs != nil
+		}
+	}
+
+	if loaded == 0 {
+		return FITS{}, fmt.Errorf("none of the CCDs of %s could be read", exposure.id)
+	}
+
+	exposure.Lock()
+
+	if exposure.layout == "" {
+		exposure.layout = "detsec"
+
+		if has_wcs {
+			exposure.layout = "wcs"
+		}
+	}
+
+	layout := exposure.layout
+	exposure.Unlock()
+
+	var assembly exposureAssembly
+
+	if layout == "wcs" {
+		if !has_wcs {
+			return FITS{}, errors.New("every CCD needs a usable WCS")
+		}
+
+		assembly, err = make_wcs_assembly(headers, method)
+	} else {
+		assembly, err = make_detsec_assembly(headers)
+	}
+
+	if err != nil {
+		return FITS{}, err
+	}
+
+	assembled := 0
+
+	for_each_chip(len(chips), func(k int) {
+		if headers[k] == nil {
+			progress(k, nil)
+			return
+		}
+
+		fits, err := read_chip(chips[k], filenames[k])
+
+		if err == nil {
+			err = assembly.add(k, fits)
+			release_chip(fits)
+		}
+
+		if err == nil {
+			exposure.Lock()
+			exposure.chips[k].Loaded = true
+			assembled++
+			exposure.Unlock()
+		}
+
+		progress(k, err)
+	})
+
+	if assembled == 0 {
+		return FITS{}, fmt.Errorf("none of the CCDs of %s could be read", exposure.id)
+	}
+
+	fits := assembly.finish()
+	fits.header = append(fits.header, make_FITS_card("NCHIPS", fmt.Sprintf("%d", assembled), "the CCDs assembled"))
+
+	return fits, nil
+}
+
+//for_each_chip runs f for every CCD, EXPOSURE_DOWNLOADS at a time
+func for_each_chip(n int, f func(k int)) {
+	sem := make(chan struct{}, EXPOSURE_DOWNLOADS)
+
+	var wg sync.WaitGroup
+
+	for k := 0; k < n; k++ {
+		wg.Add(1)
+
+		go func(k int) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			f(k)
+		}(k)
+	}
+
+	wg.Wait()
+}
+
+//GET /subaruwebql/exposure?exposureId=SUPA0123456|HSCA012346[&votable=...][&layout=wcs|detsec][&interpolation=...]
+//the CCDs are listed through the VOTable or the frame id convention of the instrument;
+//repeating the request reports the state of every CCD
+func exposure_handler(ctx iris.Context) {
+	exposureId := strings.TrimSpace(ctx.FormValue("exposureId"))
+
+	if exposureId == "" {
+		http_error(ctx, iris.StatusBadRequest, errors.New("no exposureId given"))
+		return
+	}
+
+	if !safe_name.MatchString(exposureId) {
+		http_error(ctx, iris.StatusBadRequest, fmt.Errorf("invalid exposureId '%s'", exposureId))
+		return
+	}
+
+	layout := strings.ToLower(ctx.FormValue("layout"))
+	votable := ctx.FormValue("votable")
+
+	if layout != "" && layout != "wcs" && layout != "detsec" {
+		http_error(ctx, iris.StatusBadRequest, fmt.Errorf("unknown layout '%s'", layout))
+		return
+	}
+
+	if votable == "" {
+		if _, err := exposure_frame_ids(exposureId); err != nil {
+			http_error(ctx, iris.StatusBadRequest, err)
+			return
+		}
+	}
+
+	method, err := parse_reprojection(ctx.FormValue("interpolation"))
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	dataId := exposureId
+
+	if layout != "" {
+		dataId += "-" + layout
+	}
+
+	exposure := &Exposure{id: dataId, exposure: exposureId, layout: layout}
+
+	subaru, err := make_virtual_dataset(dataId, "exposure "+exposureId, nil, func() (FITS, error) {
+		return exposure.build(votable, method)
+	})
+
+	if err != nil {
+		http_error(ctx, iris.StatusServiceUnavailable, err)
+		return
+	}
+
+	subaru.Lock()
+
+	if subaru.exposure == nil {
+		subaru.exposure = exposure
+	}
+
+	exposure = subaru.exposure
+	subaru.Unlock()
+
+	exposure.Lock()
+	info := ExposureInfo{Layout: exposure.layout, Chips: append([]ExposureChip{}, exposure.chips...)}
+	exposure.Unlock()
+
+	info.VirtualDatasetInfo = VirtualDatasetInfo{DataId: subaru.dataId, Title: subaru.title, URL: "/subaruwebql/SubaruWebQL.html?dataId=" + subaru.dataId}
+
+	ctx.JSON(info)
+}
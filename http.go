@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kataras/iris"
+)
+
+//helpers shared by the HTTP query endpoints
+
+//names taken from a query that end up in dataIds or file names
+var safe_name = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+//dataIds name cache files and are pasted into archive queries, virtual ones carry a prefix
+var safe_dataId = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+var errInvalidDataId = errors.New("invalid dataId")
+
+func form_float(ctx iris.Context, name string) (float64, bool) {
+	value := strings.TrimSpace(ctx.FormValue(name))
+
+	if value == "" {
+		return 0, false
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+
+	if err != nil {
+		return 0, false
+	}
+
+	return f, true
+}
+
+func form_int(ctx iris.Context, name string, def int) int {
+	value := strings.TrimSpace(ctx.FormValue(name))
+
+	if value == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(value)
+
+	if err != nil {
+		return def
+	}
+
+	return i
+}
+
+//form_float_list parses a comma-separated list, an empty or malformed value yields nil
+func form_float_list(ctx iris.Context, name string) []float64 {
+	value := strings.TrimSpace(ctx.FormValue(name))
+
+	if value == "" {
+		return nil
+	}
+
+	var list []float64
+
+	for _, item := range strings.Split(value, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+
+		if err != nil {
+			return nil
+		}
+
+		list = append(list, f)
+	}
+
+	return list
+}
+
+//http_error replies with status, or 503 when the request was refused because of a shutdown
+func http_error(ctx iris.Context, status int, err error) {
+	if errors.Is(err, errShuttingDown) {
+		status = iris.StatusServiceUnavailable
+		ctx.Header("Connection", "close")
+	}
+
+	ctx.StatusCode(status)
+	ctx.Writef("SubaruWebQL: %s", err.Error())
+}
+
+//the release functions of the datasets held by a request
+const HELD_DATASETS = "held_datasets"
+
+//hold_for_request keeps the pixels of a dataset mapped until the request completes
+func hold_for_request(ctx iris.Context, subaru *SubaruDataset) {
+	held, _ := ctx.Values().Get(HELD_DATASETS).([]func())
+	ctx.Values().Set(HELD_DATASETS, append(held, hold_dataset(subaru)))
+}
+
+//release_held_datasets releases the datasets held by the handlers once they are done
+func release_held_datasets(ctx iris.Context) {
+	defer func() {
+		held, _ := ctx.Values().Get(HELD_DATASETS).([]func())
+
+		for _, release := range held {
+			release()
+		}
+	}()
+
+	ctx.Next()
+}
+
+//loaded_dataset_or_fail replies with 404/503 when the dataId is unknown or still loading
+func loaded_dataset_or_fail(ctx iris.Context) (*SubaruDataset, bool) {
+	dataId := ctx.FormValue("dataId")
+
+	subaru, ok := get_dataset(dataId)
+
+	if !ok {
+		ctx.StatusCode(iris.StatusNotFound)
+		ctx.Writef("SubaruWebQL: unknown dataId %s", dataId)
+		return nil, false
+	}
+
+	hold_for_request(ctx, subaru)
+
+	subaru.RLock()
+	has_fits := subaru.has_fits
+	subaru.RUnlock()
+
+	if !has_fits {
+		ctx.StatusCode(iris.StatusServiceUnavailable)
+		ctx.Writef("SubaruWebQL: %s is still loading", dataId)
+		return nil, false
+	}
+
+	return subaru, true
+}
+
+//launched_datasets_or_wait launches the datasets that are not known yet and replies 503 (with Retry-After)
+//until all of them have been loaded
+func launched_datasets_or_wait(ctx iris.Context, ids []string) ([]*SubaruDataset, bool) {
+	subarus := make([]*SubaruDataset, len(ids))
+	loading := false
+
+	for _, dataId := range ids {
+		if !safe_dataId.MatchString(dataId) {
+			http_error(ctx, iris.StatusBadRequest, fmt.Errorf("%w '%s'", errInvalidDataId, dataId))
+			return nil, false
+		}
+	}
+
+	for i, dataId := range ids {
+		subaru, err := launch_subaru(dataId, "")
+
+		if err != nil {
+			http_error(ctx, iris.StatusServiceUnavailable, err)
+			return nil, false
+		}
+
+		subarus[i] = subaru
+		hold_for_request(ctx, subaru)
+
+		subarus[i].RLock()
+		has_fits := subarus[i].has_fits
+		subarus[i].RUnlock()
+
+		if !has_fits {
+			loading = true
+		}
+	}
+
+	if loading {
+		ctx.Header("Retry-After", "5")
+		http_error(ctx, iris.StatusServiceUnavailable, errors.New("the datasets are still loading"))
+		return nil, false
+	}
+
+	return subarus, true
+}
+
+//form_list splits a comma-separated list of names, dropping empty entries
+func form_list(ctx iris.Context, name string) []string {
+	var list []string
+
+	for _, item := range strings.Split(ctx.FormValue(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
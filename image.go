@@ -0,0 +1,333 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+//the number of pixels sampled when estimating the median and MAD
+const STATS_SAMPLES = 1024 * 1024
+
+//the default (linear) tone mapping clips at median - BLACK_MADS*mad and median + WHITE_MADS*mad
+const BLACK_MADS = 2.0
+const WHITE_MADS = 20.0
+
+func is_valid_pixel(fits *FITS, value float32) bool {
+	if math.IsNaN(float64(value)) || math.IsInf(float64(value), 0) {
+		return false
+	}
+
+	return value != fits.IGNRVAL
+}
+
+//make_image_statistics fills in min, max, hist, median, mad, black and sensitivity
+//the passes run in parallel chunks, the per-chunk results are merged in chunk order so the outcome does not depend on scheduling
+func make_image_statistics(fits *FITS) {
+	n := len(fits.data)
+	chunks := parallel_chunks(n, PARALLEL_GRAIN)
+
+	pmins := make([]float32, chunks)
+	pmaxs := make([]float32, chunks)
+	counts := make([]int, chunks)
+
+	parallel_for(n, PARALLEL_GRAIN, func(chunk, start, end int) {
+		pmin := float32(math.MaxFloat32)
+		pmax := -float32(math.MaxFloat32)
+		count := 0
+
+		for _, value := range fits.data[start:end] {
+			if !is_valid_pixel(fits, value) {
+				continue
+			}
+
+			count++
+
+			if value < pmin {
+				pmin = value
+			}
+
+			if value > pmax {
+				pmax = value
+			}
+		}
+
+		pmins[chunk], pmaxs[chunk], counts[chunk] = pmin, pmax, count
+	})
+
+	pmin := float32(math.MaxFloat32)
+	pmax := -float32(math.MaxFloat32)
+	count := 0
+
+	for c := 0; c < chunks; c++ {
+		count += counts[c]
+
+		if counts[c] == 0 {
+			continue
+		}
+
+		if pmins[c] < pmin {
+			pmin = pmins[c]
+		}
+
+		if pmaxs[c] > pmax {
+			pmax = pmaxs[c]
+		}
+	}
+
+	if count == 0 {
+		fits.min = 0
+		fits.max = 0
+		fits.median = 0
+		fits.mad = 0
+		fits.black = 0
+		fits.sensitivity = 0
+		return
+	}
+
+	fits.min = pmin
+	fits.max = pmax
+
+	for i := range fits.hist {
+		fits.hist[i] = 0
+	}
+
+	//a histogram and a sub-sampled copy of valid pixels for the median,
+	//every stride-th valid pixel counting from the first valid pixel of the image
+	stride := 1 + count/STATS_SAMPLES
+	hists := make([][NBINS]int, chunks)
+	chunk_samples := make([][]float32, chunks)
+
+	parallel_for(n, PARALLEL_GRAIN, func(chunk, start, end int) {
+		valid := 0
+
+		for c := 0; c < chunk; c++ {
+			valid += counts[c]
+		}
+
+		hist := &hists[chunk]
+		samples := make([]float32, 0, counts[chunk]/stride+1)
+
+		for _, value := range fits.data[start:end] {
+			if !is_valid_pixel(fits, value) {
+				continue
+			}
+
+			hist[histogram_bin(fits, value)]++
+
+			if valid%stride == 0 {
+				samples = append(samples, value)
+			}
+
+			valid++
+		}
+
+		chunk_samples[chunk] = samples
+	})
+
+	samples := make([]float32, 0, count/stride+1)
+
+	for c := 0; c < chunks; c++ {
+		for i, v := range hists[c] {
+			fits.hist[i] += v
+		}
+
+		samples = append(samples, chunk_samples[c]...)
+	}
+
+	fits.median = median_float32(samples)
+
+	for i, value := range samples {
+		samples[i] = float32(math.Abs(float64(value - fits.median)))
+	}
+
+	fits.mad = median_float32(samples)
+
+	black := fits.median - BLACK_MADS*fits.mad
+	white := fits.median + WHITE_MADS*fits.mad
+
+	if black < fits.min {
+		black = fits.min
+	}
+
+	if white > fits.max {
+		white = fits.max
+	}
+
+	fits.black = black
+
+	if white > black {
+		fits.sensitivity = 1.0 / (white - black)
+	} else {
+		fits.sensitivity = 0
+	}
+}
+
+func histogram_bin(fits *FITS, value float32) int {
+	if fits.max <= fits.min {
+		return 0
+	}
+
+	bin := int(float32(NBINS) * (value - fits.min) / (fits.max - fits.min))
+
+	if bin < 0 {
+		return 0
+	}
+
+	if bin > NBINS-1 {
+		return NBINS - 1
+	}
+
+	return bin
+}
+
+//median_float32 sorts the slice in place
+func median_float32(values []float32) float32 {
+	n := len(values)
+
+	if n == 0 {
+		return float32(math.NaN())
+	}
+
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	if n%2 == 1 {
+		return values[n/2]
+	}
+
+	return 0.5 * (values[n/2-1] + values[n/2])
+}
+
+//tone_map_pixel maps a pixel onto 0..255 with a linear stretch between black and black + 1/sensitivity
+//invalid pixels become 0
+func tone_map_pixel(fits *FITS, value float32) byte {
+	if !is_valid_pixel(fits, value) {
+		return 0
+	}
+
+	v := 255.0 * (value - fits.black) * fits.sensitivity
+
+	if v <= 0 {
+		return 0
+	}
+
+	if v >= 255 {
+		return 255
+	}
+
+	return byte(v)
+}
+
+func tone_map(fits *FITS, pixels []float32) []byte {
+	dst := make([]byte, len(pixels))
+
+	parallel_for(len(pixels), PARALLEL_GRAIN, func(chunk, start, end int) {
+		for i := start; i < end; i++ {
+			dst[i] = tone_map_pixel(fits, pixels[i])
+		}
+	})
+
+	return dst
+}
+
+//downsample_region box-filters the region [x0, x0+width) x [y0, y0+height) onto dst_width x dst_height pixels
+//rows are kept in the FITS order (the first row is the bottom of the image), invalid pixels are skipped
+//and output pixels without any valid input become NaN
+//the region must lie within the image
+func downsample_region(fits *FITS, x0, y0, width, height, dst_width, dst_height int) []float32 {
+	dst := make([]float32, dst_width*dst_height)
+
+	//rows of the output in parallel, each worth about PARALLEL_GRAIN input pixels
+	rows := PARALLEL_GRAIN / (1 + width*height/dst_height)
+
+	parallel_for(dst_height, rows, func(chunk, start, end int) {
+		downsample_rows(fits, x0, y0, width, height, dst_width, dst_height, start, end, dst)
+	})
+
+	return dst
+}
+
+func downsample_rows(fits *FITS, x0, y0, width, height, dst_width, dst_height, row0, row1 int, dst []float32) {
+	for j := row0; j < row1; j++ {
+		ys := y0 + j*height/dst_height
+		ye := y0 + (j+1)*height/dst_height
+
+		if ye <= ys {
+			ye = ys + 1
+		}
+
+		for i := 0; i < dst_width; i++ {
+			xs := x0 + i*width/dst_width
+			xe := x0 + (i+1)*width/dst_width
+
+			if xe <= xs {
+				xe = xs + 1
+			}
+
+			var sum float64
+			count := 0
+
+			for y := ys; y < ye; y++ {
+				offset := y * fits.width
+
+				for x := xs; x < xe; x++ {
+					value := fits.data[offset+x]
+
+					if is_valid_pixel(fits, value) {
+						sum += float64(value)
+						count++
+					}
+				}
+			}
+
+			if count > 0 {
+				dst[j*dst_width+i] = float32(sum / float64(count))
+			} else {
+				dst[j*dst_width+i] = float32(math.NaN())
+			}
+		}
+	}
+}
+
+//sigma_clip iteratively rejects values further than nsigma standard deviations from the median
+//it returns the clipped median, standard deviation and the number of surviving values
+//values are reordered in place
+func sigma_clip(values []float32, nsigma float64, iterations int) (float64, float64, int) {
+	n := len(values)
+
+	if n == 0 {
+		return math.NaN(), math.NaN(), 0
+	}
+
+	var median, std float64
+
+	for it := 0; it < iterations; it++ {
+		median = float64(median_float32(values[:n]))
+
+		var sum2 float64
+
+		for _, value := range values[:n] {
+			d := float64(value) - median
+			sum2 += d * d
+		}
+
+		std = math.Sqrt(sum2 / float64(n))
+
+		//move the survivors to the front
+		m := 0
+
+		for _, value := range values[:n] {
+			if math.Abs(float64(value)-median) <= nsigma*std {
+				values[m] = value
+				m++
+			}
+		}
+
+		if m == n || m == 0 {
+			break
+		}
+
+		n = m
+	}
+
+	return median, std, n
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const INTERP_NEAREST = 0
+const INTERP_BILINEAR = 1
+const INTERP_BICUBIC = 2
+const INTERP_LANCZOS = 3
+
+//indexed by the INTERP_* constants
+var INTERPOLATION_NAMES = [...]string{"nearest", "bilinear", "bicubic", "lanczos"}
+
+//the Lanczos kernel support [pixel]
+const LANCZOS_A = 3
+
+func parse_interpolation(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "", "bilinear", "linear":
+		return INTERP_BILINEAR, nil
+	case "nearest":
+		return INTERP_NEAREST, nil
+	case "bicubic", "cubic":
+		return INTERP_BICUBIC, nil
+	case "lanczos", "lanczos3":
+		return INTERP_LANCZOS, nil
+	default:
+		return 0, fmt.Errorf("unknown interpolation '%s'", name)
+	}
+}
+
+//pixel_at returns NaN outside the image and for invalid pixels, (i, j) are zero-based
+func pixel_at(fits *FITS, i, j int) float64 {
+	if i < 0 || j < 0 || i >= fits.width || j >= fits.height {
+		return math.NaN()
+	}
+
+	value := fits.data[j*fits.width+i]
+
+	if !is_valid_pixel(fits, value) {
+		return math.NaN()
+	}
+
+	return float64(value)
+}
+
+//cubic_weight is the Keys cubic convolution kernel with a = -0.5
+func cubic_weight(t float64) float64 {
+	t = math.Abs(t)
+
+	if t <= 1 {
+		return (1.5*t-2.5)*t*t + 1
+	}
+
+	if t < 2 {
+		return ((-0.5*t+2.5)*t-4)*t + 2
+	}
+
+	return 0
+}
+
+func lanczos_weight(t float64) float64 {
+	if t == 0 {
+		return 1
+	}
+
+	if t <= -LANCZOS_A || t >= LANCZOS_A {
+		return 0
+	}
+
+	pt := math.Pi * t
+
+	return LANCZOS_A * math.Sin(pt) * math.Sin(pt/LANCZOS_A) / (pt * pt)
+}
+
+//interpolate samples the image at FITS pixel coordinates (x, y), NaN where undefined
+//bicubic and Lanczos fall back onto bilinear near invalid pixels and the image edges
+func interpolate(fits *FITS, x, y float64, method int) float64 {
+	//zero-based continuous coordinates, pixel centres at integers
+	px := x - 1
+	py := y - 1
+
+	if method == INTERP_NEAREST {
+		return pixel_at(fits, int(math.Floor(px+0.5)), int(math.Floor(py+0.5)))
+	}
+
+	i := int(math.Floor(px))
+	j := int(math.Floor(py))
+	fx := px - float64(i)
+	fy := py - float64(j)
+
+	if method == INTERP_BICUBIC {
+		var sum float64
+		valid := true
+
+		for n := -1; n <= 2 && valid; n++ {
+			wy := cubic_weight(fy - float64(n))
+
+			for m := -1; m <= 2; m++ {
+				v := pixel_at(fits, i+m, j+n)
+
+				if math.IsNaN(v) {
+					valid = false
+					break
+				}
+
+				sum += v * cubic_weight(fx-float64(m)) * wy
+			}
+		}
+
+		if valid {
+			return sum
+		}
+	}
+
+	if method == INTERP_LANCZOS {
+		var sum, weight float64
+		valid := true
+
+		for n := 1 - LANCZOS_A; n <= LANCZOS_A && valid; n++ {
+			wy := lanczos_weight(fy - float64(n))
+
+			for m := 1 - LANCZOS_A; m <= LANCZOS_A; m++ {
+				v := pixel_at(fits, i+m, j+n)
+
+				if math.IsNaN(v) {
+					valid = false
+					break
+				}
+
+				w := lanczos_weight(fx-float64(m)) * wy
+				sum += v * w
+				weight += w
+			}
+		}
+
+		//the weights do not quite sum to one
+		if valid && weight != 0 {
+			return sum / weight
+		}
+	}
+
+	v00 := pixel_at(fits, i, j)
+	v10 := pixel_at(fits, i+1, j)
+	v01 := pixel_at(fits, i, j+1)
+	v11 := pixel_at(fits, i+1, j+1)
+
+	//allow sampling on the last row/column, up to the rounding of a WCS round trip
+	if fx < 1e-6 {
+		v10, v11 = v00, v01
+	}
+
+	if fy < 1e-6 {
+		v01, v11 = v00, v10
+	}
+
+	return (1-fx)*(1-fy)*v00 + fx*(1-fy)*v10 + (1-fx)*fy*v01 + fx*fy*v11
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris"
+)
+
+//the logger is configured from the environment: SUBARUWEBQL_LOG_FORMAT text|json and SUBARUWEBQL_LOG_LEVEL debug|info|warn|error
+var LOG_FORMAT = "text"
+var LOG_LEVEL = "info"
+
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+func init_logging(w io.Writer, format, level string) error {
+	var lvl slog.Level
+
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level '%s'", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch strings.ToLower(format) {
+	case "text":
+		logger = slog.New(slog.NewTextHandler(w, opts))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(w, opts))
+	default:
+		return fmt.Errorf("invalid log format '%s'", format)
+	}
+
+	slog.SetDefault(logger)
+
+	return nil
+}
+
+func env_or_default(key, def string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+
+	return def
+}
+
+func dataset_logger(dataId string) *slog.Logger {
+	return logger.With("dataId", dataId)
+}
+
+func new_request_id() string {
+	id := make([]byte, 8)
+
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(id)
+}
+
+//request_logger carries the request id and dataId of an HTTP request
+func request_logger(ctx iris.Context) *slog.Logger {
+	if l, ok := ctx.Values().Get("logger").(*slog.Logger); ok {
+		return l
+	}
+
+	return logger
+}
+
+//access_log tags every request with an id (the client's X-Request-Id if given) and logs it once served
+func access_log(ctx iris.Context) {
+	id := ctx.GetHeader("X-Request-Id")
+
+	if id == "" || len(id) > 64 {
+		id = new_request_id()
+	}
+
+	ctx.Header("X-Request-Id", id)
+
+	l := logger.With("request", id)
+
+	if dataId := ctx.URLParam("dataId"); dataId != "" {
+		l = l.With("dataId", dataId)
+	}
+
+	ctx.Values().Set("logger", l)
+
+	start := time.Now()
+
+	ctx.Next()
+
+	l.Info("access", "method", ctx.Method(), "path", ctx.Path(), "status", ctx.GetStatusCode(),
+		"duration", time.Since(start), "remote", ctx.RemoteAddr())
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+//a minimal LZ4 block-format compressor, the output can be decoded in the browser with lz4.min.js (LZ4.decodeBlock)
+//there is no frame header, no checksums: the uncompressed length travels in our own websocket frame header
+
+const LZ4_MIN_MATCH = 4
+const LZ4_MF_LIMIT = 12     //the last match must start at least 12 bytes before the end of the block
+const LZ4_LAST_LITERALS = 5 //the last 5 bytes are always literals
+const LZ4_HASH_LOG = 16
+const LZ4_MAX_OFFSET = 65535
+
+func lz4_compress_bound(size int) int {
+	return size + size/255 + 16
+}
+
+func lz4_hash(v uint32) uint32 {
+	return (v * 2654435761) >> (32 - LZ4_HASH_LOG)
+}
+
+func lz4_append_length(dst []byte, length int) []byte {
+	for length >= 255 {
+		dst = append(dst, 255)
+		length -= 255
+	}
+
+	return append(dst, byte(length))
+}
+
+func lz4_append_literals(dst []byte, token *byte, literals []byte) []byte {
+	lit_len := len(literals)
+
+	if lit_len >= 15 {
+		*token = 15 << 4
+		dst = lz4_append_length(dst, lit_len-15)
+	} else {
+		*token = byte(lit_len) << 4
+	}
+
+	return append(dst, literals...)
+}
+
+func lz4_append_sequence(dst []byte, literals []byte, offset, match_len int) []byte {
+	token_pos := len(dst)
+	dst = append(dst, 0)
+
+	var token byte
+	dst = lz4_append_literals(dst, &token, literals)
+
+	//little-endian match offset
+	dst = append(dst, byte(offset), byte(offset>>8))
+
+	ml := match_len - LZ4_MIN_MATCH
+
+	if ml >= 15 {
+		token |= 15
+		dst = lz4_append_length(dst, ml-15)
+	} else {
+		token |= byte(ml)
+	}
+
+	dst[token_pos] = token
+
+	return dst
+}
+
+func lz4_compress_block(src []byte) []byte {
+	n := len(src)
+	dst := make([]byte, 0, lz4_compress_bound(n))
+
+	anchor := 0
+
+	if n > LZ4_MF_LIMIT {
+		//stores pos+1 so that zero means "empty"
+		table := make([]int32, 1<<LZ4_HASH_LOG)
+
+		match_limit := n - LZ4_MF_LIMIT
+		end_limit := n - LZ4_LAST_LITERALS
+		pos := 0
+
+		for pos < match_limit {
+			v := binary.LittleEndian.Uint32(src[pos:])
+			h := lz4_hash(v)
+			ref := int(table[h]) - 1
+			table[h] = int32(pos + 1)
+
+			if ref < 0 || pos-ref > LZ4_MAX_OFFSET || binary.LittleEndian.Uint32(src[ref:]) != v {
+				pos++
+				continue
+			}
+
+			//extend the match backwards into the pending literals
+			for pos > anchor && ref > 0 && src[pos-1] == src[ref-1] {
+				pos--
+				ref--
+			}
+
+			length := LZ4_MIN_MATCH
+
+			for pos+length < end_limit && src[pos+length] == src[ref+length] {
+				length++
+			}
+
+			dst = lz4_append_sequence(dst, src[anchor:pos], pos-ref, length)
+
+			pos += length
+			anchor = pos
+		}
+	}
+
+	//the remaining bytes go out as a literal-only sequence
+	token_pos := len(dst)
+	dst = append(dst, 0)
+
+	var token byte
+	dst = lz4_append_literals(dst, &token, src[anchor:])
+	dst[token_pos] = token
+
+	return dst
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+//lz4_decompress_block is a reference decoder of the block format, as LZ4.decodeBlock in the browser
+func lz4_decompress_block(src []byte, size int) ([]byte, error) {
+	dst := make([]byte, 0, size)
+	pos := 0
+
+	read_length := func(length int) (int, error) {
+		if length != 15 {
+			return length, nil
+		}
+
+		for {
+			if pos >= len(src) {
+				return 0, errors.New("truncated length")
+			}
+
+			b := src[pos]
+			pos++
+			length += int(b)
+
+			if b != 255 {
+				return length, nil
+			}
+		}
+	}
+
+	for pos < len(src) {
+		token := src[pos]
+		pos++
+
+		lit_len, err := read_length(int(token >> 4))
+
+		if err != nil {
+			return nil, err
+		}
+
+		if pos+lit_len > len(src) {
+			return nil, errors.New("truncated literals")
+		}
+
+		dst = append(dst, src[pos:pos+lit_len]...)
+		pos += lit_len
+
+		//the last sequence has no match
+		if pos == len(src) {
+			break
+		}
+
+		if pos+2 > len(src) {
+			return nil, errors.New("truncated offset")
+		}
+
+		offset := int(src[pos]) | int(src[pos+1])<<8
+		pos += 2
+
+		if offset == 0 || offset > len(dst) {
+			return nil, errors.New("invalid offset")
+		}
+
+		match_len, err := read_length(int(token & 15))
+
+		if err != nil {
+			return nil, err
+		}
+
+		//overlapping copies repeat the pattern
+		start := len(dst) - offset
+
+		for i := 0; i < match_len+LZ4_MIN_MATCH; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+
+	return dst, nil
+}
+
+func TestLZ4RoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	random := make([]byte, 100000)
+	rng.Read(random)
+
+	pixels := make([]byte, 4*4096)
+
+	for i := 0; i < 4096; i++ {
+		binary.LittleEndian.PutUint32(pixels[4*i:], math.Float32bits(float32(i%64)*0.5))
+	}
+
+	tests := []struct {
+		name string
+		src  []byte
+	}{
+		{"empty", nil},
+		{"one byte", []byte{42}},
+		{"below the match limit", []byte("abcdabcdabc")},
+		{"zeros", make([]byte, 70000)},
+		{"repeated text", bytes.Repeat([]byte("SubaruWebQL "), 5000)},
+		{"random", random},
+		{"float32 pixels", pixels},
+		{"long literals then a match", append(append([]byte{}, random[:1000]...), random[:1000]...)},
+	}
+
+	for _, test := range tests {
+		compressed := lz4_compress_block(test.src)
+
+		if len(compressed) > lz4_compress_bound(len(test.src)) {
+			t.Errorf("%s: %d bytes exceed the bound", test.name, len(compressed))
+		}
+
+		decompressed, err := lz4_decompress_block(compressed, len(test.src))
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if !bytes.Equal(decompressed, test.src) {
+			t.Errorf("%s: the round trip differs", test.name)
+		}
+	}
+}
+
+func TestLZ4Compresses(t *testing.T) {
+	src := make([]byte, 1<<20)
+
+	if compressed := lz4_compress_block(src); len(compressed) > len(src)/100 {
+		t.Errorf("%d zero bytes compressed into %d", len(src), len(compressed))
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris"
+)
+
+//latency buckets [s]
+var DECODE_BUCKETS = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+var RENDER_BUCKETS = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+//counterVec is a Prometheus counter keyed by its formatted labels
+type counterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	values map[string]float64
+}
+
+type histogramSeries struct {
+	counts []uint64 //per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+func new_counter(name, help string) *counterVec {
+	return &counterVec{name: name, help: help, values: make(map[string]float64)}
+}
+
+func new_histogram(name, help string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+var metrics = struct {
+	cache_requests     *counterVec
+	download_bytes     *counterVec
+	download_seconds   *counterVec
+	download_failures  *counterVec
+	websocket_accepted *counterVec
+	decode_seconds     *histogramVec
+	render_seconds     *histogramVec
+}{
+	cache_requests:     new_counter("subaruwebql_cache_requests_total", "Cache lookups by cache and result."),
+	download_bytes:     new_counter("subaruwebql_download_bytes_total", "Bytes downloaded per upstream host."),
+	download_seconds:   new_counter("subaruwebql_download_seconds_total", "Time spent downloading per upstream host."),
+	download_failures:  new_counter("subaruwebql_download_failures_total", "Failed downloads per upstream host."),
+	websocket_accepted: new_counter("subaruwebql_websocket_connections_total", "Websocket connections accepted."),
+	decode_seconds:     new_histogram("subaruwebql_decode_seconds", "Time to decode a dataset and compute its statistics.", DECODE_BUCKETS),
+	render_seconds:     new_histogram("subaruwebql_render_seconds", "Time to render a viewport or a tile.", RENDER_BUCKETS),
+}
+
+//metric_labels formats label pairs, metric_labels("cache", "fits") -> cache="fits"
+func metric_labels(pairs ...string) string {
+	labels := make([]string, 0, len(pairs)/2)
+
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(pairs[i+1])
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", pairs[i], value))
+	}
+
+	return strings.Join(labels, ",")
+}
+
+func (c *counterVec) add(labels string, v float64) {
+	c.Lock()
+	c.values[labels] += v
+	c.Unlock()
+}
+
+func (h *histogramVec) observe(labels string, v float64) {
+	h.Lock()
+	defer h.Unlock()
+
+	s, ok := h.series[labels]
+
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[labels] = s
+	}
+
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+			break
+		}
+	}
+
+	s.sum += v
+	s.count++
+}
+
+//since observes the time elapsed since start, meant for defer
+func (h *histogramVec) since(labels string, start time.Time) {
+	h.observe(labels, time.Since(start).Seconds())
+}
+
+func count_cache(cache string, hit bool) {
+	result := "miss"
+
+	if hit {
+		result = "hit"
+	}
+
+	metrics.cache_requests.add(metric_labels("cache", cache, "result", result), 1)
+}
+
+//upstream_host labels a download with its host when it is one of the configured upstreams,
+//the VOTable server or a catalogue service; any other host is "other" to keep the label bounded
+func upstream_host(address string) string {
+	u, err := url.Parse(address)
+
+	if err != nil || u.Host == "" {
+		return "unknown"
+	}
+
+	host := u.Hostname()
+
+	if strings.EqualFold(host, VOTABLESERVER) {
+		return host
+	}
+
+	for _, service := range CATALOGUE_SERVICES {
+		if s, err := url.Parse(service.URL); err == nil && strings.EqualFold(host, s.Hostname()) {
+			return host
+		}
+	}
+
+	return "other"
+}
+
+//count_download records a finished (err == nil) or failed download from address
+func count_download(address string, size int64, start time.Time, err error) {
+	labels := metric_labels("host", upstream_host(address))
+
+	metrics.download_bytes.add(labels, float64(size))
+	metrics.download_seconds.add(labels, time.Since(start).Seconds())
+
+	if err != nil {
+		metrics.download_failures.add(labels, 1)
+	}
+}
+
+func format_metric_value(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return fmt.Sprintf("%g", v)
+}
+
+func sorted_keys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func series_name(name, labels string) string {
+	if labels == "" {
+		return name
+	}
+
+	return name + "{" + labels + "}"
+}
+
+func write_metric_header(b *strings.Builder, name, help, kind string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func write_gauge(b *strings.Builder, name, help string, values map[string]float64) {
+	write_metric_header(b, name, help, "gauge")
+
+	for _, labels := range sorted_keys(values) {
+		fmt.Fprintf(b, "%s %s\n", series_name(name, labels), format_metric_value(values[labels]))
+	}
+}
+
+func (c *counterVec) write(b *strings.Builder) {
+	c.Lock()
+	defer c.Unlock()
+
+	write_metric_header(b, c.name, c.help, "counter")
+
+	for _, labels := range sorted_keys(c.values) {
+		fmt.Fprintf(b, "%s %s\n", series_name(c.name, labels), format_metric_value(c.values[labels]))
+	}
+}
+
+func (h *histogramVec) write(b *strings.Builder) {
+	h.Lock()
+	defer h.Unlock()
+
+	write_metric_header(b, h.name, h.help, "histogram")
+
+	keys := make([]string, 0, len(h.series))
+
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, labels := range keys {
+		s := h.series[labels]
+		prefix := labels
+
+		if prefix != "" {
+			prefix += ","
+		}
+
+		var cumulative uint64
+
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(b, "%s_bucket{%sle=\"%s\"} %d\n", h.name, prefix, format_metric_value(le), cumulative)
+		}
+
+		fmt.Fprintf(b, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, prefix, s.count)
+		fmt.Fprintf(b, "%s %s\n", series_name(h.name+"_sum", labels), format_metric_value(s.sum))
+		fmt.Fprintf(b, "%s %d\n", series_name(h.name+"_count", labels), s.count)
+	}
+}
+
+//dataset_bytes is the memory held by the pixels of a dataset, mapped pixel caches are counted separately
+func dataset_bytes(fits *FITS) (heap, mapped float64) {
+	pixels := float64(4*(len(fits.data)+len(fits.cube)) + len(fits.rgb))
+
+	if fits.mapping != nil {
+		return float64(len(fits.rgb)), pixels - float64(len(fits.rgb))
+	}
+
+	return pixels, 0
+}
+
+func write_metrics(b *strings.Builder) {
+	loaded := map[string]float64{metric_labels("state", "loading"): 0, metric_labels("state", "loaded"): 0}
+	memory := map[string]float64{metric_labels("storage", "heap"): 0, metric_labels("storage", "mapped"): 0}
+
+	datasets.RLock()
+
+	for _, subaru := range datasets.subaru {
+		subaru.RLock()
+
+		if subaru.has_fits {
+			loaded[metric_labels("state", "loaded")]++
+
+			heap, mapped := dataset_bytes(&subaru.fits)
+			memory[metric_labels("storage", "heap")] += heap
+			memory[metric_labels("storage", "mapped")] += mapped
+		} else {
+			loaded[metric_labels("state", "loading")]++
+		}
+
+		subaru.RUnlock()
+	}
+
+	datasets.RUnlock()
+
+	write_gauge(b, "subaruwebql_datasets", "Datasets in memory.", loaded)
+	write_gauge(b, "subaruwebql_dataset_bytes", "Bytes held by the pixels of the datasets in memory.", memory)
+
+	metrics.cache_requests.write(b)
+	metrics.download_bytes.write(b)
+	metrics.download_seconds.write(b)
+	metrics.download_failures.write(b)
+	metrics.decode_seconds.write(b)
+	metrics.render_seconds.write(b)
+
+	connections := 0
+
+	ws_sessions.RLock()
+
+	for _, conns := range ws_sessions.conns {
+		connections += len(conns)
+	}
+
+	ws_sessions.RUnlock()
+
+	write_gauge(b, "subaruwebql_websocket_connections", "Open websocket connections.", map[string]float64{"": float64(connections)})
+	metrics.websocket_accepted.write(b)
+
+	prefetch.Lock()
+	queue := map[string]float64{metric_labels("state", "queued"): float64(len(prefetch.queue)), metric_labels("state", "loading"): float64(prefetch.loading)}
+	prefetch.Unlock()
+
+	write_gauge(b, "subaruwebql_prefetch", "Datasets waiting in or being loaded by the prefetch queue.", queue)
+
+	write_gauge(b, "go_goroutines", "Number of goroutines that currently exist.", map[string]float64{"": float64(runtime.NumGoroutine())})
+}
+
+//metrics_handler serves the metrics in the Prometheus text exposition format
+func metrics_handler(ctx iris.Context) {
+	var b strings.Builder
+
+	write_metrics(&b)
+
+	ctx.ContentType("text/plain; version=0.0.4; charset=utf-8")
+	ctx.WriteString(b.String())
+}
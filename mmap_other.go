@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import "io/ioutil"
+
+//without mmap the sidecar is read into memory, which still saves decoding the FITS file
+func mmap_file(filename string) ([]byte, error) {
+	return ioutil.ReadFile(filename)
+}
+
+func munmap_file(mapping []byte) error {
+	return nil
+}
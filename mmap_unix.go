@@ -0,0 +1,40 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+//mmap_file maps a whole file read-only, the pages are shared with other processes mapping it
+func mmap_file(filename string) ([]byte, error) {
+	file, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	stat, err := file.Stat()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if stat.Size() == 0 {
+		return []byte{}, nil
+	}
+
+	return syscall.Mmap(int(file.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap_file(mapping []byte) error {
+	if len(mapping) == 0 {
+		return nil
+	}
+
+	return syscall.Munmap(mapping)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris"
+)
+
+//named mosaics live in their own namespace so that they cannot shadow archive datasets
+const MOSAIC_PREFIX = "mosaic-"
+
+var errDatasetExists = errors.New("a dataset with this name exists already")
+
+//virtual datasets are computed on the server from loaded ones instead of being downloaded
+//once ready they are served exactly like the others
+func make_virtual_dataset(dataId, title string, inputs []*SubaruDataset, build func() (FITS, error)) (*SubaruDataset, error) {
+	return add_virtual_dataset(dataId, title, true, inputs, build)
+}
+
+//add_virtual_dataset registers and builds a virtual dataset, an existing dataset with the same id
+//is returned when reuse is set and refused with errDatasetExists otherwise;
+//the inputs are held until the build is done
+func add_virtual_dataset(dataId, title string, reuse bool, inputs []*SubaruDataset, build func() (FITS, error)) (*SubaruDataset, error) {
+	datasets.Lock()
+	defer datasets.Unlock()
+
+	if subaru, ok := datasets.subaru[dataId]; ok {
+		if !reuse {
+			return nil, fmt.Errorf("%w: %s", errDatasetExists, dataId)
+		}
+
+		return subaru, nil
+	}
+
+	if err := accepting_datasets(); err != nil {
+		return nil, err
+	}
+
+	subaru := new(SubaruDataset)
+	subaru.dataId = dataId
+	subaru.title = title
+	subaru.virtual = true
+	subaru.timestamp = time.Now()
+	datasets.subaru[dataId] = subaru
+
+	releases := make([]func(), len(inputs))
+
+	for k, input := range inputs {
+		releases[k] = hold_dataset(input)
+	}
+
+	go func() {
+		defer recover_dataset(subaru)
+
+		defer func() {
+			for _, release := range releases {
+				release()
+			}
+		}()
+
+		fits, err := build()
+
+		if err != nil {
+			dataset_logger(dataId).Error("virtual dataset failed", "error", err)
+			drop_failed_dataset(subaru)
+
+			return
+		}
+
+		make_image_statistics(&fits)
+
+		subaru.Lock()
+		subaru.fits = fits
+		subaru.has_fits = true
+		subaru.Unlock()
+
+		send_image_info_notification(subaru)
+	}()
+
+	return subaru, nil
+}
+
+//make_virtual_FITS wraps computed pixels with the WCS cards of the grid
+func make_virtual_FITS(grid *reprojectGrid, cards []string, data []float32) FITS {
+	fits := FITS{BITPIX: -32, NAXIS: 2, width: grid.width, height: grid.height, data: data, IGNRVAL: -math.MaxFloat32}
+	fits.header = append([]string{}, cards...)
+	fits.wcs = grid.wcs
+
+	return fits
+}
+
+//virtual_dataId derives a stable dataId from the request so that repeating it reuses the result
+func virtual_dataId(prefix string, parts ...interface{}) string {
+	h := fnv.New64a()
+	fmt.Fprint(h, parts...)
+
+	return fmt.Sprintf("%s-%016x", prefix, h.Sum64())
+}
+
+type mosaicOptions struct {
+	ref     string //the dataId whose pixel grid is used, otherwise a north-up grid is built
+	proj    string
+	ra, dec float64
+	scale   float64 //[arcsec]
+	width   int
+	height  int
+	method  int
+	weights string //a comma-separated list, "exptime" or "ivar"
+	name    string
+}
+
+func mosaic_options_from_form(ctx iris.Context) (mosaicOptions, error) {
+	opt := mosaicOptions{ref: strings.TrimSpace(ctx.FormValue("ref")), proj: ctx.FormValue("proj"), ra: math.NaN(), dec: math.NaN()}
+
+	if ra, ok := form_float(ctx, "ra"); ok {
+		opt.ra = ra
+	}
+
+	if dec, ok := form_float(ctx, "dec"); ok {
+		opt.dec = dec
+	}
+
+	opt.scale, _ = form_float(ctx, "scale")
+	opt.width = form_int(ctx, "width", 0)
+	opt.height = form_int(ctx, "height", 0)
+	opt.weights = strings.ToLower(strings.TrimSpace(ctx.FormValue("weights")))
+	opt.name = strings.TrimSpace(ctx.FormValue("name"))
+
+	if opt.name != "" && !safe_name.MatchString(opt.name) {
+		return opt, fmt.Errorf("invalid name '%s', only letters, digits, '_' and '-' are allowed", opt.name)
+	}
+
+	method, err := parse_reprojection(ctx.FormValue("interpolation"))
+	opt.method = method
+
+	return opt, err
+}
+
+//mosaic_weights: explicit values, the exposure times or the inverse variances of the inputs
+func mosaic_weights(inputs []*FITS, spec string) ([]float64, error) {
+	weights := make([]float64, len(inputs))
+
+	switch spec {
+	case "":
+		for k := range weights {
+			weights[k] = 1
+		}
+
+	case "exptime":
+		for k, fits := range inputs {
+			exptime, ok := FITS_header_float(fits, "EXPTIME")
+
+			if !ok || exptime <= 0 {
+				exptime = 1
+			}
+
+			weights[k] = exptime
+		}
+
+	case "ivar":
+		for k, fits := range inputs {
+			sigma := 1.4826 * float64(fits.mad)
+
+			if !(sigma > 0) {
+				return nil, errors.New("the noise of an input could not be estimated")
+			}
+
+			weights[k] = 1 / (sigma * sigma)
+		}
+
+	default:
+		items := strings.Split(spec, ",")
+
+		if len(items) != len(inputs) {
+			return nil, fmt.Errorf("%d weights given for %d datasets", len(items), len(inputs))
+		}
+
+		for k, item := range items {
+			w, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+
+			if err != nil || w < 0 {
+				return nil, fmt.Errorf("invalid weight '%s'", item)
+			}
+
+			weights[k] = w
+		}
+	}
+
+	return weights, nil
+}
+
+//start_mosaic validates the request and starts building the virtual dataset in the background
+func start_mosaic(inputs []*SubaruDataset, opt mosaicOptions) (*SubaruDataset, error) {
+	images := make([]*FITS, len(inputs))
+	ids := make([]string, len(inputs))
+
+	for k, subaru := range inputs {
+		images[k] = &subaru.fits
+		ids[k] = subaru.dataId
+	}
+
+	weights, err := mosaic_weights(images, opt.weights)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var grid reprojectGrid
+	var cards []string
+
+	if opt.ref != "" {
+		ref, ok := get_loaded_dataset(opt.ref)
+
+		if !ok {
+			return nil, fmt.Errorf("the reference %s has not been loaded", opt.ref)
+		}
+
+		grid, cards, err = reference_grid(&ref.fits)
+	} else {
+		grid, cards, err = target_grid(images, opt.proj, opt.ra, opt.dec, opt.scale, opt.width, opt.height)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	dataId := virtual_dataId("mosaic", ids, weights, opt.ref, opt.proj, opt.ra, opt.dec, opt.scale, opt.width, opt.height, opt.method)
+
+	if opt.name != "" {
+		dataId = MOSAIC_PREFIX + opt.name
+	}
+
+	title := "mosaic of " + strings.Join(ids, ", ")
+
+	if len(ids) == 1 {
+		title = "reprojection of " + ids[0]
+	}
+
+	return add_virtual_dataset(dataId, title, opt.name == "", inputs, func() (FITS, error) {
+		data, err := make_mosaic(images, weights, &grid, opt.method)
+
+		if err != nil {
+			return FITS{}, err
+		}
+
+		return make_virtual_FITS(&grid, cards, data), nil
+	})
+}
+
+type VirtualDatasetInfo struct {
+	DataId string `json:"dataId"`
+	Title  string `json:"title"`
+	URL    string `json:"url"`
+}
+
+func virtual_dataset_handler(ctx iris.Context, ids []string) {
+	if len(ids) == 0 {
+		http_error(ctx, iris.StatusBadRequest, errors.New("no datasets given"))
+		return
+	}
+
+	opt, err := mosaic_options_from_form(ctx)
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	if opt.ref != "" {
+		ids = append(ids, opt.ref)
+	}
+
+	subarus, ok := launched_datasets_or_wait(ctx, ids)
+
+	if !ok {
+		return
+	}
+
+	if opt.ref != "" {
+		subarus = subarus[:len(subarus)-1]
+	}
+
+	subaru, err := start_mosaic(subarus, opt)
+
+	if errors.Is(err, errDatasetExists) {
+		http_error(ctx, iris.StatusConflict, err)
+		return
+	}
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	ctx.JSON(VirtualDatasetInfo{DataId: subaru.dataId, Title: subaru.title, URL: "/subaruwebql/SubaruWebQL.html?dataId=" + subaru.dataId})
+}
+
+//GET /subaruwebql/reproject?dataId=...&(ref=dataId | [ra=&dec=][&scale=][&width=&height=][&proj=TAN])
+//[&interpolation=nearest|bilinear|bicubic|lanczos|flux][&name=...], a name becomes the dataId mosaic-<name>
+func reproject_handler(ctx iris.Context) {
+	virtual_dataset_handler(ctx, form_list(ctx, "dataId"))
+}
+
+//GET /subaruwebql/mosaic?dataIds=a,b,...[&weights=w1,w2,...|exptime|ivar] followed by the reproject parameters
+func mosaic_handler(ctx iris.Context) {
+	virtual_dataset_handler(ctx, form_list(ctx, "dataIds"))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+//the smallest amount of work worth handing to another goroutine [pixels]
+const PARALLEL_GRAIN = 64 * 1024
+
+//the number of chunks per worker, so that uneven chunks still keep every worker busy
+const PARALLEL_CHUNKS_PER_WORKER = 4
+
+func parallel_workers() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+//the goroutines helping callers of parallel_for, shared by all the calls in flight so that
+//concurrent requests do not multiply them; the caller itself always takes part
+var parallel_helpers = make(chan struct{}, parallel_workers()-1)
+
+//parallel_chunks is the number of chunks parallel_for splits n items into, for callers keeping per-chunk results
+func parallel_chunks(n, grain int) int {
+	if n <= 0 {
+		return 0
+	}
+
+	if grain < 1 {
+		grain = 1
+	}
+
+	chunks := (n + grain - 1) / grain
+
+	if max := PARALLEL_CHUNKS_PER_WORKER * parallel_workers(); chunks > max {
+		chunks = max
+	}
+
+	return chunks
+}
+
+//parallel_for splits [0, n) into parallel_chunks(n, grain) contiguous chunks, chunk c covering
+//[c*n/chunks, (c+1)*n/chunks), and runs work on them in the caller and the helpers that are free;
+//it returns once every chunk is done, a panic in any chunk is re-raised in the caller
+func parallel_for(n, grain int, work func(chunk, start, end int)) {
+	chunks := parallel_chunks(n, grain)
+
+	if chunks == 0 {
+		return
+	}
+
+	if chunks == 1 {
+		work(0, 0, n)
+		return
+	}
+
+	var next int64 = -1
+	var failure atomic.Value
+	var wg sync.WaitGroup
+
+	run := func() {
+		defer func() {
+			if r := recover(); r != nil {
+				failure.Store(fmt.Errorf("parallel_for: %v", r))
+			}
+		}()
+
+		for {
+			c := int(atomic.AddInt64(&next, 1))
+
+			if c >= chunks {
+				return
+			}
+
+			if failure.Load() != nil {
+				continue
+			}
+
+			work(c, c*n/chunks, (c+1)*n/chunks)
+		}
+	}
+
+	//a busy pool never blocks, the caller then does more of the work
+	helper := func() bool {
+		select {
+		case parallel_helpers <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+
+	for h := 1; h < chunks && helper(); h++ {
+		wg.Add(1)
+
+		go func() {
+			defer func() {
+				<-parallel_helpers
+				wg.Done()
+			}()
+
+			run()
+		}()
+	}
+
+	run()
+	wg.Wait()
+
+	if err := failure.Load(); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/kataras/iris"
+)
+
+//used when the FITS header supplies neither MAGZPT nor PHOTZP (SUBARUWEBQL_PHOT_ZEROPOINT), zero disables magnitudes
+//zero points are for count rates: magnitudes are only given when the header supplies EXPTIME
+var PHOT_ZEROPOINT = 0.0
+
+//each pixel is split into PHOT_SUBPIXELS x PHOT_SUBPIXELS samples to weigh partially covered pixels
+const PHOT_SUBPIXELS = 5
+
+const PHOT_FLAG_EDGE = 1   //the aperture extends beyond the image
+const PHOT_FLAG_MASKED = 2 //NaN or IGNRVAL pixels inside the aperture
+const PHOT_FLAG_NOSKY = 4  //no usable pixels in the background annulus
+
+type PhotometryResult struct {
+	Id            int      `json:"id"`
+	X             float64  `json:"x"`
+	Y             float64  `json:"y"`
+	RA            *float64 `json:"ra"`
+	Dec           *float64 `json:"dec"`
+	Flux          float64  `json:"flux"` //background-subtracted [ADU]
+	FluxErr       float64  `json:"flux_err"`
+	Area          float64  `json:"area"` //the effective number of aperture pixels
+	Background    float64  `json:"background"`
+	BackgroundStd float64  `json:"background_std"`
+	Mag           *float64 `json:"mag"`
+	MagErr        *float64 `json:"mag_err"`
+	Flags         int      `json:"flags"`
+}
+
+type Photometry struct {
+	DataId  string             `json:"dataId"`
+	Shape   string             `json:"shape"`
+	ZeroPt  *float64           `json:"zero_point"`
+	ExpTime *float64           `json:"exptime"`
+	Gain    float64            `json:"gain"`
+	Results []PhotometryResult `json:"results"`
+}
+
+type apertureOptions struct {
+	spec      RegionSpec //the aperture shape; X and Y are replaced by each position
+	inner     float64    //the background annulus [pixel or arcsec, following spec.Frame]
+	outer     float64
+	zeropoint float64
+}
+
+//aperture_sum integrates the image over an aperture, weighting pixels by the covered fraction
+func aperture_sum(fits *FITS, r *Region) (float64, float64, int) {
+	var sum, area float64
+	flags := 0
+
+	//grow the bounds by a pixel to catch partial coverage
+	x0, x1, y0, y1 := r.bounds(fits)
+	rx0, rx1, ry0, ry1 := x0-1, x1+1, y0-1, y1+1
+
+	for j := ry0; j <= ry1; j++ {
+		for i := rx0; i <= rx1; i++ {
+			inside := 0
+
+			for sj := 0; sj < PHOT_SUBPIXELS; sj++ {
+				for si := 0; si < PHOT_SUBPIXELS; si++ {
+					sx := float64(i+1) - 0.5 + (float64(si)+0.5)/PHOT_SUBPIXELS
+					sy := float64(j+1) - 0.5 + (float64(sj)+0.5)/PHOT_SUBPIXELS
+
+					if r.contains(sx, sy) {
+						inside++
+					}
+				}
+			}
+
+			if inside == 0 {
+				continue
+			}
+
+			if i < 0 || j < 0 || i >= fits.width || j >= fits.height {
+				flags |= PHOT_FLAG_EDGE
+				continue
+			}
+
+			value := fits.data[j*fits.width+i]
+
+			if !is_valid_pixel(fits, value) {
+				flags |= PHOT_FLAG_MASKED
+				continue
+			}
+
+			weight := float64(inside) / (PHOT_SUBPIXELS * PHOT_SUBPIXELS)
+			sum += weight * float64(value)
+			area += weight
+		}
+	}
+
+	return sum, area, flags
+}
+
+//photometry_zeropoint prefers the zero point of the request, then the header, then PHOT_ZEROPOINT
+func photometry_zeropoint(fits *FITS, def float64) *float64 {
+	if def != 0 {
+		return &def
+	}
+
+	for _, key := range []string{"MAGZPT", "PHOTZP", "MAGZERO"} {
+		if zp, ok := FITS_header_float(fits, key); ok {
+			return &zp
+		}
+	}
+
+	if PHOT_ZEROPOINT != 0 {
+		zp := PHOT_ZEROPOINT
+		return &zp
+	}
+
+	return nil
+}
+
+//aperture_photometry measures every position (FITS pixel coordinates or RA/Dec in the image frame)
+func aperture_photometry(subaru *SubaruDataset, positions [][2]float64, opt apertureOptions) (Photometry, error) {
+	fits := &subaru.fits
+
+	phot := Photometry{DataId: subaru.dataId, Shape: strings.ToLower(opt.spec.Shape)}
+	phot.ZeroPt = photometry_zeropoint(fits, opt.zeropoint)
+
+	if exptime, ok := FITS_header_float(fits, "EXPTIME"); ok && exptime > 0 {
+		phot.ExpTime = &exptime
+	}
+
+	phot.Gain, _ = FITS_header_float(fits, "GAIN")
+
+	for n, pos := range positions {
+		spec := opt.spec
+		spec.X, spec.Y = pos[0], pos[1]
+
+		r, err := resolve_region(fits, spec)
+
+		if err != nil {
+			return phot, err
+		}
+
+		result := PhotometryResult{Id: n + 1, X: r.x, Y: r.y}
+
+		if fits.wcs != nil {
+			if ra, dec, err := fits.wcs.PixelToSky(r.x, r.y); err == nil {
+				result.RA, result.Dec = &ra, &dec
+			}
+		}
+
+		//the annulus in pixels
+		inner, outer := opt.inner, opt.outer
+
+		if strings.ToLower(spec.Frame) == "sky" && fits.wcs != nil {
+			inner /= fits.wcs.PixelScale()
+			outer /= fits.wcs.PixelScale()
+		}
+
+		sum, area, flags := aperture_sum(fits, r)
+		result.Area = area
+		result.Flags = flags
+
+		nsky := 0
+
+		if outer > inner {
+			background, background_std, err := annulus_background(fits, r.x, r.y, inner, outer)
+
+			if err == nil {
+				result.Background = background
+				result.BackgroundStd = background_std
+				nsky = int(math.Pi * (outer*outer - inner*inner))
+			} else {
+				result.Flags |= PHOT_FLAG_NOSKY
+			}
+		}
+
+		result.Flux = sum - area*result.Background
+
+		//sky noise in the aperture, the uncertainty of the sky level and Poisson noise of the source
+		variance := area * result.BackgroundStd * result.BackgroundStd
+
+		if nsky > 0 {
+			variance += area * area * result.BackgroundStd * result.BackgroundStd / float64(nsky)
+		}
+
+		if phot.Gain > 0 && result.Flux > 0 {
+			variance += result.Flux / phot.Gain
+		}
+
+		result.FluxErr = math.Sqrt(variance)
+
+		if phot.ZeroPt != nil && phot.ExpTime != nil && result.Flux > 0 {
+			mag := *phot.ZeroPt - 2.5*math.Log10(result.Flux / *phot.ExpTime)
+			mag_err := 2.5 / math.Ln10 * result.FluxErr / result.Flux
+			result.Mag, result.MagErr = &mag, &mag_err
+		}
+
+		phot.Results = append(phot.Results, result)
+	}
+
+	return phot, nil
+}
+
+func photometry_votable(phot Photometry) *VOTable {
+	t := &VOTable{Resource: phot.DataId, Name: "aperture_photometry"}
+
+	t.Params = []VOParam{{Name: "aperture", Datatype: "char", Value: phot.Shape}}
+
+	if phot.ZeroPt != nil {
+		t.Params = append(t.Params, VOParam{Name: "zero_point", Datatype: "double", Unit: "mag", UCD: "phot.mag;arith.zp", Value: strconv.FormatFloat(*phot.ZeroPt, 'g', -1, 64)})
+	}
+
+	if phot.ExpTime != nil {
+		t.Params = append(t.Params, VOParam{Name: "exptime", Datatype: "double", Unit: "s", UCD: "time.duration;obs.exposure", Value: strconv.FormatFloat(*phot.ExpTime, 'g', -1, 64)})
+	}
+
+	t.Fields = []VOField{
+		{Name: "id", Datatype: "int", UCD: "meta.id;meta.main"},
+		{Name: "x", Datatype: "double", Unit: "pix", UCD: "pos.cartesian.x;instr.det"},
+		{Name: "y", Datatype: "double", Unit: "pix", UCD: "pos.cartesian.y;instr.det"},
+		{Name: "ra", Datatype: "double", Unit: "deg", UCD: "pos.eq.ra;meta.main"},
+		{Name: "dec", Datatype: "double", Unit: "deg", UCD: "pos.eq.dec;meta.main"},
+		{Name: "flux", Datatype: "double", Unit: "ct", UCD: "phot.count"},
+		{Name: "flux_err", Datatype: "double", Unit: "ct", UCD: "stat.error;phot.count"},
+		{Name: "area", Datatype: "double", Unit: "pix", UCD: "instr.pixel;arith.sum"},
+		{Name: "background", Datatype: "double", Unit: "ct", UCD: "instr.skyLevel"},
+		{Name: "background_std", Datatype: "double", Unit: "ct", UCD: "stat.stdev;instr.skyLevel"},
+		{Name: "mag", Datatype: "double", Unit: "mag", UCD: "phot.mag"},
+		{Name: "mag_err", Datatype: "double", Unit: "mag", UCD: "stat.error;phot.mag"},
+		{Name: "flags", Datatype: "int", UCD: "meta.code"},
+	}
+
+	for _, r := range phot.Results {
+		t.Rows = append(t.Rows, []interface{}{r.Id, r.X, r.Y, r.RA, r.Dec, r.Flux, r.FluxErr, r.Area, r.Background, r.BackgroundStd, r.Mag, r.MagErr, r.Flags})
+	}
+
+	return t
+}
+
+//parse_positions reads "x1,y1;x2,y2;..."
+func parse_positions(s string) ([][2]float64, error) {
+	positions := make([][2]float64, 0)
+
+	for _, pair := range strings.Split(s, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		coords := strings.Split(pair, ",")
+
+		if len(coords) != 2 {
+			return nil, fmt.Errorf("malformed position '%s'", pair)
+		}
+
+		x, err1 := strconv.ParseFloat(strings.TrimSpace(coords[0]), 64)
+		y, err2 := strconv.ParseFloat(strings.TrimSpace(coords[1]), 64)
+
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("malformed position '%s'", pair)
+		}
+
+		positions = append(positions, [2]float64{x, y})
+	}
+
+	if len(positions) == 0 {
+		return nil, errors.New("no positions given")
+	}
+
+	return positions, nil
+}
+
+//GET /subaruwebql/photometry?dataId=...&positions=x1,y1;x2,y2[&frame=sky]
+//&r=... (circle) or &a=...&b=...&angle=... (ellipse), &r_in=...&r_out=... [&zp=...][&format=json]
+//zp overrides the zero point of the header, magnitudes need EXPTIME in the header
+func photometry_handler(ctx iris.Context) {
+	subaru, ok := loaded_dataset_or_fail(ctx)
+
+	if !ok {
+		return
+	}
+
+	positions, err := parse_positions(ctx.FormValue("positions"))
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	opt := apertureOptions{spec: RegionSpec{Shape: "circle", Frame: ctx.FormValue("frame")}}
+
+	if r, ok := form_float(ctx, "r"); ok {
+		opt.spec.Radius = r
+	} else {
+		opt.spec.Shape = "ellipse"
+		opt.spec.A, _ = form_float(ctx, "a")
+		opt.spec.B, _ = form_float(ctx, "b")
+		opt.spec.Angle, _ = form_float(ctx, "angle")
+	}
+
+	opt.inner, _ = form_float(ctx, "r_in")
+	opt.outer, _ = form_float(ctx, "r_out")
+	opt.zeropoint, _ = form_float(ctx, "zp")
+
+	phot, err := aperture_photometry(subaru, positions, opt)
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	if ctx.FormValue("format") == "json" {
+		ctx.JSON(phot)
+		return
+	}
+
+	ctx.ContentType("application/x-votable+xml")
+	photometry_votable(phot).Write(ctx)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/jvo203/SubaruWebQL/wcs"
+	"github.com/kataras/iris"
+)
+
+//the default half-size of the box around a queried pixel
+const PIXEL_NEIGHBOURHOOD = 2
+const MAX_PIXEL_NEIGHBOURHOOD = 50
+
+type SkyPosition struct {
+	Frame string  `json:"frame"`
+	Lon   float64 `json:"lon"`
+	Lat   float64 `json:"lat"`
+	LonS  string  `json:"lon_str"`
+	LatS  string  `json:"lat_str"`
+}
+
+type PixelStatistics struct {
+	Size   int     `json:"size"`
+	Count  int     `json:"count"`
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+	Std    float64 `json:"std"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+}
+
+//PixelInfo uses pointers for quantities that may be undefined (JSON has no NaN)
+type PixelInfo struct {
+	DataId        string           `json:"dataId"`
+	X             float64          `json:"x"`
+	Y             float64          `json:"y"`
+	Column        int              `json:"column"`
+	Row           int              `json:"row"`
+	Value         *float64         `json:"value"`
+	Tone          int              `json:"tone"`
+	Sky           []SkyPosition    `json:"sky"`
+	Neighbourhood *PixelStatistics `json:"neighbourhood"`
+}
+
+var PIXEL_FRAMES = []string{wcs.FK5, wcs.FK4, wcs.GALACTIC, wcs.ECLIPTIC}
+
+//sky_to_pixel converts a position [deg] in the image frame into FITS pixel coordinates
+func sky_to_pixel(fits *FITS, ra, dec float64) (float64, float64, error) {
+	if fits.wcs == nil {
+		return 0, 0, errors.New("the image has no usable WCS")
+	}
+
+	return fits.wcs.SkyToPixel(ra, dec)
+}
+
+func make_sky_positions(fits *FITS, x, y float64) []SkyPosition {
+	if fits.wcs == nil {
+		return nil
+	}
+
+	ra, dec, err := fits.wcs.PixelToSky(x, y)
+
+	if err != nil {
+		return nil
+	}
+
+	image_frame := fits.wcs.Frame()
+	positions := make([]SkyPosition, 0, len(PIXEL_FRAMES))
+
+	for _, frame := range PIXEL_FRAMES {
+		lon, lat, err := wcs.Convert(ra, dec, image_frame, frame)
+
+		if err != nil {
+			continue
+		}
+
+		pos := SkyPosition{Frame: frame, Lon: lon, Lat: lat}
+
+		if frame == wcs.FK5 || frame == wcs.FK4 {
+			pos.LonS = wcs.FormatHMS(lon)
+			pos.LatS = wcs.FormatDMS(lat)
+		} else {
+			pos.LonS = fmt.Sprintf("%.6f", lon)
+			pos.LatS = fmt.Sprintf("%+.6f", lat)
+		}
+
+		positions = append(positions, pos)
+	}
+
+	return positions
+}
+
+//make_pixel_statistics summarises the valid pixels in a (2*radius+1)^2 box, clipped to the image
+func make_pixel_statistics(fits *FITS, column, row, radius int) *PixelStatistics {
+	values := make([]float32, 0, (2*radius+1)*(2*radius+1))
+
+	for y := row - radius; y <= row+radius; y++ {
+		if y < 0 || y >= fits.height {
+			continue
+		}
+
+		for x := column - radius; x <= column+radius; x++ {
+			if x < 0 || x >= fits.width {
+				continue
+			}
+
+			value := fits.data[y*fits.width+x]
+
+			if is_valid_pixel(fits, value) {
+				values = append(values, value)
+			}
+		}
+	}
+
+	if len(values) == 0 {
+		return nil
+	}
+
+	stats := PixelStatistics{Size: 2*radius + 1, Count: len(values), Min: math.Inf(1), Max: math.Inf(-1)}
+
+	var sum, sum2 float64
+
+	for _, value := range values {
+		v := float64(value)
+		sum += v
+		sum2 += v * v
+		stats.Min = math.Min(stats.Min, v)
+		stats.Max = math.Max(stats.Max, v)
+	}
+
+	n := float64(len(values))
+	stats.Mean = sum / n
+	stats.Std = math.Sqrt(math.Max(0, sum2/n-stats.Mean*stats.Mean))
+	stats.Median = float64(median_float32(values))
+
+	return &stats
+}
+
+//query_pixel takes FITS pixel coordinates (the centre of the first pixel is at (1, 1))
+func query_pixel(subaru *SubaruDataset, x, y float64, radius int) (PixelInfo, error) {
+	fits := &subaru.fits
+
+	info := PixelInfo{DataId: subaru.dataId, X: x, Y: y}
+
+	info.Column = int(math.Floor(x+0.5)) - 1
+	info.Row = int(math.Floor(y+0.5)) - 1
+
+	if info.Column < 0 || info.Column >= fits.width || info.Row < 0 || info.Row >= fits.height {
+		return info, fmt.Errorf("(%.1f, %.1f) lies outside the image", x, y)
+	}
+
+	if radius < 0 {
+		radius = PIXEL_NEIGHBOURHOOD
+	}
+
+	if radius > MAX_PIXEL_NEIGHBOURHOOD {
+		radius = MAX_PIXEL_NEIGHBOURHOOD
+	}
+
+	value := fits.data[info.Row*fits.width+info.Column]
+
+	if is_valid_pixel(fits, value) {
+		v := float64(value)
+		info.Value = &v
+	}
+
+	info.Tone = int(tone_map_pixel(fits, value))
+	info.Sky = make_sky_positions(fits, x, y)
+	info.Neighbourhood = make_pixel_statistics(fits, info.Column, info.Row, radius)
+
+	return info, nil
+}
+
+//query_sky takes a position [deg] in the image frame
+func query_sky(subaru *SubaruDataset, ra, dec float64, radius int) (PixelInfo, error) {
+	x, y, err := sky_to_pixel(&subaru.fits, ra, dec)
+
+	if err != nil {
+		return PixelInfo{DataId: subaru.dataId}, err
+	}
+
+	return query_pixel(subaru, x, y, radius)
+}
+
+//GET /subaruwebql/pixel?dataId=...&x=...&y=... or &ra=...&dec=... [deg], optional &radius=...
+func pixel_handler(ctx iris.Context) {
+	subaru, ok := loaded_dataset_or_fail(ctx)
+
+	if !ok {
+		return
+	}
+
+	radius := form_int(ctx, "radius", PIXEL_NEIGHBOURHOOD)
+
+	var info PixelInfo
+	var err error
+
+	x, has_x := form_float(ctx, "x")
+	y, has_y := form_float(ctx, "y")
+	ra, has_ra := form_float(ctx, "ra")
+	dec, has_dec := form_float(ctx, "dec")
+
+	switch {
+	case has_x && has_y:
+		info, err = query_pixel(subaru, x, y, radius)
+	case has_ra && has_dec:
+		info, err = query_sky(subaru, ra, dec, radius)
+	default:
+		err = errors.New("either x,y or ra,dec are required")
+	}
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	ctx.JSON(info)
+}
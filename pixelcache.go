@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+//bumped whenever the sidecar layout changes
+const PIXEL_CACHE_VERSION = 1
+
+//the largest header read when validating a sidecar [FITS blocks]
+const PIXEL_CACHE_MAX_HEADER_BLOCKS = 1000
+
+//pixelCacheInfo is stored next to the decoded pixels: the image statistics and what the pixels were decoded from
+type pixelCacheInfo struct {
+	Version     int     `json:"version"`
+	Digest      string  `json:"digest"` //of the header cards
+	ByteOrder   string  `json:"byte_order"`
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+	Depth       int     `json:"depth"`
+	Min         float32 `json:"min"`
+	Max         float32 `json:"max"`
+	Median      float32 `json:"median"`
+	MAD         float32 `json:"mad"`
+	Black       float32 `json:"black"`
+	Sensitivity float32 `json:"sensitivity"`
+	Hist        []int   `json:"hist"`
+}
+
+//the sidecar files of a dataset in FITSCACHE: the float32 pixels (the displayed plane, then the cube if any)
+//in the byte order of the machine, and the statistics
+func pixel_cache_files(dataId string) (string, string) {
+	base := FITSCACHE + "/" + dataId
+
+	return base + ".pixels", base + ".stats.json"
+}
+
+func native_byte_order() string {
+	one := uint16(1)
+
+	if *(*byte)(unsafe.Pointer(&one)) == 1 {
+		return "little"
+	}
+
+	return "big"
+}
+
+func header_digest(fits *FITS) string {
+	h := sha256.New()
+
+	for _, card := range fits.header {
+		io.WriteString(h, card)
+	}
+
+	fmt.Fprintf(h, "%d %d %d %d", fits.BITPIX, fits.width, fits.height, fits.depth)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//float32_bytes views the pixels as bytes without copying
+func float32_bytes(data []float32) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+
+	return unsafe.Slice((*byte)(unsafe.Pointer(&data[0])), 4*len(data))
+}
+
+func bytes_float32(buf []byte) []float32 {
+	if len(buf) < 4 {
+		return nil
+	}
+
+	return unsafe.Slice((*float32)(unsafe.Pointer(&buf[0])), len(buf)/4)
+}
+
+func write_file_atomic(filename string, write func(*os.File) error) error {
+	tmpfile, err := os.Create(filename + ".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	err = write(tmpfile)
+
+	if cerr := tmpfile.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(filename + ".tmp")
+		return err
+	}
+
+	return os.Rename(filename+".tmp", filename)
+}
+
+//write_pixel_cache persists the decoded pixels, the statistics are written last as they mark the sidecar complete
+func write_pixel_cache(dataId string, fits *FITS) error {
+	pixels, stats := pixel_cache_files(dataId)
+
+	info := pixelCacheInfo{Version: PIXEL_CACHE_VERSION, Digest: header_digest(fits), ByteOrder: native_byte_order(),
+		Width: fits.width, Height: fits.height, Depth: fits.depth,
+		Min: fits.min, Max: fits.max, Median: fits.median, MAD: fits.mad, Black: fits.black, Sensitivity: fits.sensitivity,
+		Hist: fits.hist[:]}
+
+	doc, err := json.Marshal(info)
+
+	if err != nil {
+		return err
+	}
+
+	err = write_file_atomic(pixels, func(file *os.File) error {
+		if _, err := file.Write(float32_bytes(fits.data)); err != nil {
+			return err
+		}
+
+		_, err := file.Write(float32_bytes(fits.cube))
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return write_file_atomic(stats, func(file *os.File) error {
+		_, err := file.Write(doc)
+		return err
+	})
+}
+
+//read_header_blocks reads the primary header of an open FITS file, block by block up to the END card
+func read_header_blocks(fp *os.File) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	block := make([]byte, FITS_HEADER_LENGTH)
+
+	for n := 0; n < PIXEL_CACHE_MAX_HEADER_BLOCKS; n++ {
+		if _, err := io.ReadFull(fp, block); err != nil {
+			return nil, err
+		}
+
+		buf.Write(block)
+
+		for i := 0; i < FITS_HEADER_LENGTH; i += FITS_LINE_LENGTH {
+			if strings.HasPrefix(string(block[i:i+FITS_LINE_LENGTH]), "END     ") {
+				return &buf, nil
+			}
+		}
+	}
+
+	return nil, errors.New("no END card found")
+}
+
+//open_pixel_cache maps the sidecar of a FITS file when its header still matches, instead of decoding the file again
+func open_pixel_cache(dataId string, fp *os.File) (FITS, error) {
+	var fits FITS
+
+	pixels, stats := pixel_cache_files(dataId)
+
+	doc, err := ioutil.ReadFile(stats)
+
+	if err != nil {
+		return fits, err
+	}
+
+	var info pixelCacheInfo
+
+	if err := json.Unmarshal(doc, &info); err != nil {
+		return fits, err
+	}
+
+	header, err := read_header_blocks(fp)
+
+	if err != nil {
+		return fits, err
+	}
+
+	read_FITS_header(&fits, header)
+
+	if info.Version != PIXEL_CACHE_VERSION || info.ByteOrder != native_byte_order() || info.Digest != header_digest(&fits) || len(info.Hist) != NBINS {
+		return fits, errors.New("stale pixel cache")
+	}
+
+	size := fits.width * fits.height
+
+	if fits.depth > 1 {
+		size += fits.width * fits.height * fits.depth
+	}
+
+	mapping, err := mmap_file(pixels)
+
+	if err != nil {
+		return fits, err
+	}
+
+	if len(mapping) != 4*size {
+		munmap_file(mapping)
+		return fits, errors.New("truncated pixel cache")
+	}
+
+	data := bytes_float32(mapping)
+	fits.data = data[:fits.width*fits.height]
+
+	if fits.depth > 1 {
+		fits.cube = data[fits.width*fits.height:]
+	}
+
+	fits.mapping = mapping
+	fits.wcs = make_FITS_wcs(fits.header)
+
+	fits.min, fits.max = info.Min, info.Max
+	fits.median, fits.mad = info.Median, info.MAD
+	fits.black, fits.sensitivity = info.Black, info.Sensitivity
+	copy(fits.hist[:], info.Hist)
+
+	return fits, nil
+}
+
+//mapped pixels must stay mapped while anyone reads them: HTTP requests, websocket messages and the builds
+//of virtual datasets hold a dataset, an evicted dataset is retired and unmapped once the last holder is gone
+
+//hold_dataset registers a reader of the pixels, the returned function releases it
+func hold_dataset(subaru *SubaruDataset) func() {
+	subaru.Lock()
+	subaru.holders++
+	subaru.Unlock()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			subaru.Lock()
+			defer subaru.Unlock()
+
+			subaru.holders--
+
+			if subaru.retired && subaru.holders == 0 {
+				unmap_dataset(subaru)
+			}
+		})
+	}
+}
+
+//retire_dataset marks a dataset that has left datasets.subaru
+func retire_dataset(subaru *SubaruDataset) {
+	subaru.Lock()
+	defer subaru.Unlock()
+
+	subaru.retired = true
+
+	if subaru.holders == 0 {
+		unmap_dataset(subaru)
+	}
+}
+
+//unmap_dataset releases the pixel cache mapping of a dataset, the caller holds its lock
+//the dataset no longer counts as loaded so that a late reader finds no pixels rather than unmapped memory
+func unmap_dataset(subaru *SubaruDataset) {
+	mapping := subaru.fits.mapping
+
+	if mapping == nil {
+		return
+	}
+
+	subaru.fits.data, subaru.fits.cube, subaru.fits.mapping = nil, nil, nil
+	subaru.has_fits = false
+
+	if err := munmap_file(mapping); err != nil {
+		dataset_logger(subaru.dataId).Warn("pixel cache not unmapped", "error", err)
+	}
+}
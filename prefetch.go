@@ -0,0 +1,422 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris"
+)
+
+//datasets loaded concurrently by the prefetch queue
+const PREFETCH_WORKERS = 2
+
+//the longest queue accepted, further requests are refused with 429
+const PREFETCH_MAX_QUEUE = 1000
+
+//how long a prefetched dataset may take to load
+const PREFETCH_TIMEOUT = 30 * time.Minute
+
+//finished entries are reported for this long
+const PREFETCH_STATUS_TTL = time.Hour
+
+const PREFETCH_POLL_INTERVAL = 500 * time.Millisecond
+
+//priority levels, lower values are loaded first
+var PREFETCH_PRIORITIES = map[string]int{"high": 0, "normal": 1, "low": 2}
+
+type PrefetchItem struct {
+	Key      string     `json:"key"` //the dataId or the VOTable URL
+	DataId   string     `json:"dataId,omitempty"`
+	VOTable  string     `json:"votable,omitempty"`
+	Priority string     `json:"priority"`
+	Target   string     `json:"target"` //memory or cache
+	State    string     `json:"state"`  //queued, loading, loaded, cached, expanded or failed
+	Error    string     `json:"error,omitempty"`
+	Expanded []string   `json:"expanded,omitempty"` //the dataIds listed by a VOTable
+	Queued   time.Time  `json:"queued"`
+	Finished *time.Time `json:"finished,omitempty"`
+	rank     int
+	seq      uint64
+	index    int //in the heap, -1 once taken
+}
+
+type PrefetchRequest struct {
+	DataIds  []string `json:"dataIds"`
+	VOTables []string `json:"votables"`
+	Priority string   `json:"priority"` //high, normal (default) or low
+	Target   string   `json:"target"`   //memory (default) or cache: only keep the files in FITSCACHE/VOTABLECACHE
+}
+
+type PrefetchStatus struct {
+	Queued  int             `json:"queued"`
+	Loading int             `json:"loading"`
+	Workers int             `json:"workers"`
+	Items   []*PrefetchItem `json:"items"`
+}
+
+//prefetchHeap orders the queued items by priority, then by arrival
+type prefetchHeap []*PrefetchItem
+
+func (h prefetchHeap) Len() int { return len(h) }
+
+func (h prefetchHeap) Less(i, j int) bool {
+	if h[i].rank != h[j].rank {
+		return h[i].rank < h[j].rank
+	}
+
+	return h[i].seq < h[j].seq
+}
+
+func (h prefetchHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *prefetchHeap) Push(x interface{}) {
+	item := x.(*PrefetchItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *prefetchHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	item.index = -1
+	*h = old[:len(old)-1]
+
+	return item
+}
+
+var prefetch = struct {
+	sync.Mutex
+	cond    *sync.Cond
+	queue   prefetchHeap
+	items   map[string]*PrefetchItem
+	seq     uint64
+	loading int
+	once    sync.Once
+}{items: make(map[string]*PrefetchItem)}
+
+func init() {
+	prefetch.cond = sync.NewCond(&prefetch.Mutex)
+}
+
+//enqueue_prefetch queues a dataId or a VOTable URL; an item already waiting is moved up to the higher priority
+func enqueue_prefetch(key, dataId, votable, priority, target string) (*PrefetchItem, error) {
+	prefetch.once.Do(func() {
+		for w := 0; w < PREFETCH_WORKERS; w++ {
+			go prefetch_worker()
+		}
+	})
+
+	rank := PREFETCH_PRIORITIES[priority]
+
+	prefetch.Lock()
+	defer prefetch.Unlock()
+
+	if item, ok := prefetch.items[key]; ok && (item.State == "queued" || item.State == "loading") {
+		if item.State == "queued" && rank < item.rank {
+			item.rank, item.Priority = rank, priority
+			heap.Fix(&prefetch.queue, item.index)
+		}
+
+		return item, nil
+	}
+
+	if len(prefetch.queue) >= PREFETCH_MAX_QUEUE {
+		return nil, errors.New("the prefetch queue is full")
+	}
+
+	prefetch.seq++
+
+	item := &PrefetchItem{Key: key, DataId: dataId, VOTable: votable, Priority: priority, Target: target,
+		State: "queued", Queued: time.Now(), rank: rank, seq: prefetch.seq}
+
+	prefetch.items[key] = item
+	heap.Push(&prefetch.queue, item)
+	prefetch.cond.Signal()
+
+	return item, nil
+}
+
+//finish_prefetch records the outcome of an item and forgets the items that finished long ago
+func finish_prefetch(item *PrefetchItem, state string, err error) {
+	prefetch.Lock()
+	defer prefetch.Unlock()
+
+	now := time.Now()
+	item.State = state
+	item.Finished = &now
+
+	if err != nil {
+		item.State = "failed"
+		item.Error = err.Error()
+	}
+
+	prefetch.loading--
+
+	for key, other := range prefetch.items {
+		if other.Finished != nil && time.Since(*other.Finished) > PREFETCH_STATUS_TTL {
+			delete(prefetch.items, key)
+		}
+	}
+}
+
+func prefetch_worker() {
+	for {
+		prefetch.Lock()
+
+		for len(prefetch.queue) == 0 {
+			prefetch.cond.Wait()
+		}
+
+		item := heap.Pop(&prefetch.queue).(*PrefetchItem)
+		item.State = "loading"
+		prefetch.loading++
+
+		prefetch.Unlock()
+
+		state, err := run_prefetch(item)
+		finish_prefetch(item, state, err)
+	}
+}
+
+//run_prefetch loads one item through launch_subaru and waits for it; the archive readers panic on failures
+func run_prefetch(item *PrefetchItem) (state string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	log := logger.With("prefetch", item.Key)
+
+	if item.DataId == "" {
+		ids, err := expand_prefetch_votable(item)
+
+		if err != nil {
+			return "", err
+		}
+
+		prefetch.Lock()
+		item.Expanded = ids
+		prefetch.Unlock()
+
+		log.Info("prefetch VOTable expanded", "datasets", len(ids))
+
+		return "expanded", nil
+	}
+
+	_, known := get_dataset(item.DataId)
+
+	subaru, err := launch_subaru(item.DataId, item.VOTable)
+
+	if err != nil {
+		return "", err
+	}
+
+	deadline := time.Now().Add(PREFETCH_TIMEOUT)
+
+	for {
+		subaru.RLock()
+		has_fits := subaru.has_fits
+		subaru.RUnlock()
+
+		if has_fits {
+			break
+		}
+
+		//a failed load forgets the dataset
+		if current, ok := get_dataset(item.DataId); !ok || current != subaru {
+			return "", errors.New("the dataset could not be loaded")
+		}
+
+		if time.Now().After(deadline) {
+			return "", errors.New("timed out")
+		}
+
+		if shutting_down() {
+			return "", errShuttingDown
+		}
+
+		time.Sleep(PREFETCH_POLL_INTERVAL)
+	}
+
+	//only warming the caches: the files stay, the dataset leaves memory unless someone has opened it meanwhile;
+	//pixels mapped from the pixel cache are unmapped once the requests still reading them are done
+	if item.Target == "cache" && !known {
+		ws_sessions.RLock()
+		watched := len(ws_sessions.conns[item.DataId]) > 0
+		ws_sessions.RUnlock()
+
+		if !watched {
+			evict_dataset(item.DataId)
+			log.Debug("prefetched dataset cached")
+
+			return "cached", nil
+		}
+	}
+
+	log.Debug("prefetched dataset loaded")
+
+	return "loaded", nil
+}
+
+//expand_prefetch_votable queues the datasets listed by a VOTable, a single dataset keeps the VOTable for its metadata
+func expand_prefetch_votable(item *PrefetchItem) ([]string, error) {
+	h := fnv.New64a()
+	io.WriteString(h, item.VOTable)
+	filename := fmt.Sprintf("%s/prefetch-%016x.xml", VOTABLECACHE, h.Sum64())
+
+	if !file_exists(filename) {
+		if err := fetch_to_file(item.VOTable, filename, CATALOGUE_TIMEOUT); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := votable_chips(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(rows))
+
+	for _, row := range rows {
+		//the DATA_ID cells come from a remote document
+		if !safe_dataId.MatchString(row.DataId) {
+			logger.Warn("prefetch VOTable row skipped", "prefetch", item.Key, "error", fmt.Errorf("%w '%s'", errInvalidDataId, row.DataId))
+			continue
+		}
+
+		votable := ""
+
+		if len(rows) == 1 {
+			votable = item.VOTable
+		}
+
+		if _, err := enqueue_prefetch(row.DataId, row.DataId, votable, item.Priority, item.Target); err != nil {
+			return ids, err
+		}
+
+		ids = append(ids, row.DataId)
+	}
+
+	return ids, nil
+}
+
+func prefetch_status(keys []string) PrefetchStatus {
+	prefetch.Lock()
+	defer prefetch.Unlock()
+
+	status := PrefetchStatus{Queued: len(prefetch.queue), Loading: prefetch.loading, Workers: PREFETCH_WORKERS}
+
+	if len(keys) == 0 {
+		for _, item := range prefetch.items {
+			keys = append(keys, item.Key)
+		}
+	}
+
+	for _, key := range keys {
+		if item, ok := prefetch.items[key]; ok {
+			snapshot := *item
+			status.Items = append(status.Items, &snapshot)
+		} else {
+			status.Items = append(status.Items, &PrefetchItem{Key: key, DataId: key, State: "unknown"})
+		}
+	}
+
+	return status
+}
+
+//POST /subaruwebql/prefetch {"dataIds": [...], "votables": [...], "priority": "high|normal|low", "target": "memory|cache"}
+//queues background loads and replies with their status
+func prefetch_handler(ctx iris.Context) {
+	var req PrefetchRequest
+
+	if err := ctx.ReadJSON(&req); err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	if req.Priority == "" {
+		req.Priority = "normal"
+	}
+
+	if _, ok := PREFETCH_PRIORITIES[req.Priority]; !ok {
+		http_error(ctx, iris.StatusBadRequest, fmt.Errorf("unknown priority '%s'", req.Priority))
+		return
+	}
+
+	if req.Target == "" {
+		req.Target = "memory"
+	}
+
+	if req.Target != "memory" && req.Target != "cache" {
+		http_error(ctx, iris.StatusBadRequest, fmt.Errorf("unknown target '%s'", req.Target))
+		return
+	}
+
+	if len(req.DataIds)+len(req.VOTables) == 0 {
+		http_error(ctx, iris.StatusBadRequest, errors.New("no datasets given"))
+		return
+	}
+
+	//nothing is queued when one of the dataIds is invalid
+	for _, dataId := range req.DataIds {
+		if dataId = strings.TrimSpace(dataId); dataId != "" && !safe_dataId.MatchString(dataId) {
+			http_error(ctx, iris.StatusBadRequest, fmt.Errorf("%w '%s'", errInvalidDataId, dataId))
+			return
+		}
+	}
+
+	if err := accepting_datasets(); err != nil {
+		http_error(ctx, iris.StatusServiceUnavailable, err)
+		return
+	}
+
+	var keys []string
+
+	for _, dataId := range req.DataIds {
+		if dataId = strings.TrimSpace(dataId); dataId == "" {
+			continue
+		}
+
+		if _, err := enqueue_prefetch(dataId, dataId, "", req.Priority, req.Target); err != nil {
+			http_error(ctx, iris.StatusTooManyRequests, err)
+			return
+		}
+
+		keys = append(keys, dataId)
+	}
+
+	for _, votable := range req.VOTables {
+		if votable = strings.TrimSpace(votable); votable == "" {
+			continue
+		}
+
+		if _, err := enqueue_prefetch(votable, "", votable, req.Priority, req.Target); err != nil {
+			http_error(ctx, iris.StatusTooManyRequests, err)
+			return
+		}
+
+		keys = append(keys, votable)
+	}
+
+	request_logger(ctx).Info("prefetch queued", "items", len(keys), "priority", req.Priority, "target", req.Target)
+
+	ctx.StatusCode(iris.StatusAccepted)
+	ctx.JSON(prefetch_status(keys))
+}
+
+//GET /subaruwebql/prefetch[?keys=dataId1,votable2,...]
+func prefetch_status_handler(ctx iris.Context) {
+	ctx.JSON(prefetch_status(form_list(ctx, "keys")))
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/kataras/iris"
+)
+
+const MAX_PROFILE_SAMPLES = 100000
+const MAX_RADIAL_BINS = 10000
+
+type ProfileSample struct {
+	Distance float64  `json:"distance"` //[pixel] from the start of the line
+	X        float64  `json:"x"`
+	Y        float64  `json:"y"`
+	Value    *float64 `json:"value"`
+}
+
+type LineProfile struct {
+	DataId  string          `json:"dataId"`
+	Method  string          `json:"method"`
+	Length  float64         `json:"length"` //[pixel]
+	Scale   float64         `json:"scale"`  //[arcsec/pixel], 0 without a WCS
+	Samples []ProfileSample `json:"samples"`
+}
+
+type RadialBin struct {
+	Inner  float64 `json:"inner"` //[pixel]
+	Outer  float64 `json:"outer"`
+	Radius float64 `json:"radius"` //the mean radius of the pixels in the bin
+	Count  int     `json:"count"`
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+	Std    float64 `json:"std"`
+	Error  float64 `json:"error"` //the standard error of the mean
+}
+
+type RadialProfile struct {
+	DataId        string      `json:"dataId"`
+	X             float64     `json:"x"`
+	Y             float64     `json:"y"`
+	Scale         float64     `json:"scale"`
+	Background    float64     `json:"background"` //already subtracted from the bins
+	BackgroundStd float64     `json:"background_std"`
+	Bins          []RadialBin `json:"bins"`
+}
+
+func float_ptr(v float64) *float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil
+	}
+
+	return &v
+}
+
+func pixel_scale(fits *FITS) float64 {
+	if fits.wcs == nil {
+		return 0
+	}
+
+	return fits.wcs.PixelScale()
+}
+
+//line_profile samples the image along a straight line between two FITS pixel positions
+//with samples <= 0 the line is sampled once per pixel
+func line_profile(subaru *SubaruDataset, x1, y1, x2, y2 float64, method int, samples int) (LineProfile, error) {
+	fits := &subaru.fits
+
+	length := math.Hypot(x2-x1, y2-y1)
+
+	if samples <= 0 {
+		samples = int(math.Ceil(length)) + 1
+	}
+
+	if samples < 2 {
+		samples = 2
+	}
+
+	if samples > MAX_PROFILE_SAMPLES {
+		return LineProfile{}, fmt.Errorf("too many samples (%d)", samples)
+	}
+
+	profile := LineProfile{DataId: subaru.dataId, Length: length, Scale: pixel_scale(fits)}
+	profile.Method = INTERPOLATION_NAMES[method]
+	profile.Samples = make([]ProfileSample, samples)
+
+	for i := 0; i < samples; i++ {
+		t := float64(i) / float64(samples-1)
+		x := x1 + t*(x2-x1)
+		y := y1 + t*(y2-y1)
+
+		profile.Samples[i] = ProfileSample{Distance: t * length, X: x, Y: y, Value: float_ptr(interpolate(fits, x, y, method))}
+	}
+
+	return profile, nil
+}
+
+//annulus_background returns the sigma-clipped median and standard deviation between two radii [pixel]
+func annulus_background(fits *FITS, x, y, inner, outer float64) (float64, float64, error) {
+	if outer <= inner || inner < 0 {
+		return 0, 0, errors.New("invalid background annulus")
+	}
+
+	r := &Region{shape: "circle", x: x, y: y, a: outer, b: outer}
+	values := make([]float32, 0)
+
+	region_pixels(fits, r, func(index, i, j int) {
+		value := fits.data[index]
+		d := math.Hypot(float64(i+1)-x, float64(j+1)-y)
+
+		if d >= inner && is_valid_pixel(fits, value) {
+			values = append(values, value)
+		}
+	})
+
+	median, std, n := sigma_clip(values, 3.0, 5)
+
+	if n == 0 {
+		return 0, 0, errors.New("no valid pixels in the background annulus")
+	}
+
+	return median, std, nil
+}
+
+//radial_profile azimuthally averages the image around (x, y) in bins of width step up to rmax [pixel]
+func radial_profile(subaru *SubaruDataset, x, y, rmax, step, background, background_std float64) (RadialProfile, error) {
+	fits := &subaru.fits
+
+	if !(rmax > 0) || !(step > 0) || math.IsInf(rmax, 0) || math.IsInf(step, 0) {
+		return RadialProfile{}, errors.New("the radius and the bin width must be positive and finite")
+	}
+
+	//compared as a float, a huge ratio would overflow the int conversion
+	if math.Ceil(rmax/step) > MAX_RADIAL_BINS {
+		return RadialProfile{}, fmt.Errorf("too many bins (%g)", math.Ceil(rmax/step))
+	}
+
+	nbins := int(math.Ceil(rmax / step))
+
+	profile := RadialProfile{DataId: subaru.dataId, X: x, Y: y, Scale: pixel_scale(fits), Background: background, BackgroundStd: background_std}
+
+	values := make([][]float32, nbins)
+	radii := make([]float64, nbins)
+
+	r := &Region{shape: "circle", x: x, y: y, a: rmax, b: rmax}
+
+	region_pixels(fits, r, func(index, i, j int) {
+		value := fits.data[index]
+
+		if !is_valid_pixel(fits, value) {
+			return
+		}
+
+		d := math.Hypot(float64(i+1)-x, float64(j+1)-y)
+		bin := int(d / step)
+
+		if bin >= nbins {
+			return
+		}
+
+		values[bin] = append(values[bin], value-float32(background))
+		radii[bin] += d
+	})
+
+	for bin := 0; bin < nbins; bin++ {
+		n := len(values[bin])
+
+		if n == 0 {
+			continue
+		}
+
+		var sum, sum2 float64
+
+		for _, value := range values[bin] {
+			sum += float64(value)
+			sum2 += float64(value) * float64(value)
+		}
+
+		mean := sum / float64(n)
+		std := math.Sqrt(math.Max(0, sum2/float64(n)-mean*mean))
+
+		profile.Bins = append(profile.Bins, RadialBin{
+			Inner:  float64(bin) * step,
+			Outer:  float64(bin+1) * step,
+			Radius: radii[bin] / float64(n),
+			Count:  n,
+			Mean:   mean,
+			Median: float64(median_float32(values[bin])),
+			Std:    std,
+			Error:  std / math.Sqrt(float64(n)),
+		})
+	}
+
+	return profile, nil
+}
+
+func line_profile_votable(profile LineProfile) *VOTable {
+	t := &VOTable{Resource: profile.DataId, Name: "line_profile"}
+
+	t.Params = []VOParam{
+		{Name: "method", Datatype: "char", Value: profile.Method},
+		{Name: "scale", Datatype: "double", Unit: "arcsec/pix", Value: strconv.FormatFloat(profile.Scale, 'g', -1, 64)},
+	}
+
+	t.Fields = []VOField{
+		{Name: "distance", Datatype: "double", Unit: "pix", UCD: "pos.distance"},
+		{Name: "x", Datatype: "double", Unit: "pix", UCD: "pos.cartesian.x;instr.det"},
+		{Name: "y", Datatype: "double", Unit: "pix", UCD: "pos.cartesian.y;instr.det"},
+		{Name: "value", Datatype: "double", UCD: "phot.count"},
+	}
+
+	for _, s := range profile.Samples {
+		t.Rows = append(t.Rows, []interface{}{s.Distance, s.X, s.Y, s.Value})
+	}
+
+	return t
+}
+
+func radial_profile_votable(profile RadialProfile) *VOTable {
+	t := &VOTable{Resource: profile.DataId, Name: "radial_profile"}
+
+	t.Params = []VOParam{
+		{Name: "x", Datatype: "double", Unit: "pix", UCD: "pos.cartesian.x;instr.det", Value: strconv.FormatFloat(profile.X, 'g', -1, 64)},
+		{Name: "y", Datatype: "double", Unit: "pix", UCD: "pos.cartesian.y;instr.det", Value: strconv.FormatFloat(profile.Y, 'g', -1, 64)},
+		{Name: "scale", Datatype: "double", Unit: "arcsec/pix", Value: strconv.FormatFloat(profile.Scale, 'g', -1, 64)},
+		{Name: "background", Datatype: "double", UCD: "instr.skyLevel", Value: strconv.FormatFloat(profile.Background, 'g', -1, 64)},
+	}
+
+	t.Fields = []VOField{
+		{Name: "inner", Datatype: "double", Unit: "pix", UCD: "pos.distance;stat.min"},
+		{Name: "outer", Datatype: "double", Unit: "pix", UCD: "pos.distance;stat.max"},
+		{Name: "radius", Datatype: "double", Unit: "pix", UCD: "pos.distance;stat.mean"},
+		{Name: "count", Datatype: "int", UCD: "meta.number"},
+		{Name: "mean", Datatype: "double", UCD: "phot.count;stat.mean"},
+		{Name: "median", Datatype: "double", UCD: "phot.count;stat.median"},
+		{Name: "std", Datatype: "double", UCD: "stat.stdev"},
+		{Name: "error", Datatype: "double", UCD: "stat.error;phot.count"},
+	}
+
+	for _, b := range profile.Bins {
+		t.Rows = append(t.Rows, []interface{}{b.Inner, b.Outer, b.Radius, b.Count, b.Mean, b.Median, b.Std, b.Error})
+	}
+
+	return t
+}
+
+//send_table replies with JSON or, with format=votable, a VOTable
+func send_table(ctx iris.Context, v interface{}, votable func() *VOTable) {
+	if strings.ToLower(ctx.FormValue("format")) == "votable" {
+		ctx.ContentType("application/x-votable+xml")
+		votable().Write(ctx)
+		return
+	}
+
+	ctx.JSON(v)
+}
+
+//form_position reads a position, converting RA/Dec [deg] into pixels with frame=sky
+func form_position(ctx iris.Context, fits *FITS, xname, yname string) (float64, float64, error) {
+	x, has_x := form_float(ctx, xname)
+	y, has_y := form_float(ctx, yname)
+
+	if !(has_x && has_y) {
+		return 0, 0, fmt.Errorf("%s and %s are required", xname, yname)
+	}
+
+	if strings.ToLower(ctx.FormValue("frame")) == "sky" {
+		return sky_to_pixel(fits, x, y)
+	}
+
+	return x, y, nil
+}
+
+//form_length reads a length, converting arcseconds into pixels with frame=sky
+func form_length(ctx iris.Context, fits *FITS, name string, def float64) float64 {
+	length, ok := form_float(ctx, name)
+
+	if !ok {
+		return def
+	}
+
+	if strings.ToLower(ctx.FormValue("frame")) == "sky" && fits.wcs != nil {
+		return length / fits.wcs.PixelScale()
+	}
+
+	return length
+}
+
+//GET /subaruwebql/profile/line?dataId=...&x1=...&y1=...&x2=...&y2=...[&frame=sky][&method=bilinear][&samples=...][&format=votable]
+func line_profile_handler(ctx iris.Context) {
+	subaru, ok := loaded_dataset_or_fail(ctx)
+
+	if !ok {
+		return
+	}
+
+	fits := &subaru.fits
+
+	x1, y1, err := form_position(ctx, fits, "x1", "y1")
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	x2, y2, err := form_position(ctx, fits, "x2", "y2")
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	method, err := parse_interpolation(ctx.FormValue("method"))
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	profile, err := line_profile(subaru, x1, y1, x2, y2, method, form_int(ctx, "samples", 0))
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	send_table(ctx, profile, func() *VOTable { return line_profile_votable(profile) })
+}
+
+//GET /subaruwebql/profile/radial?dataId=...&x=...&y=...&rmax=...[&step=1][&frame=sky]
+//[&bg=annulus&bg_inner=...&bg_outer=... | &bg=<value>][&format=votable]
+func radial_profile_handler(ctx iris.Context) {
+	subaru, ok := loaded_dataset_or_fail(ctx)
+
+	if !ok {
+		return
+	}
+
+	fits := &subaru.fits
+
+	x, y, err := form_position(ctx, fits, "x", "y")
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	rmax := form_length(ctx, fits, "rmax", 0)
+	step := form_length(ctx, fits, "step", 1)
+
+	var background, background_std float64
+
+	switch bg := strings.ToLower(ctx.FormValue("bg")); bg {
+	case "", "none":
+	case "annulus":
+		inner := form_length(ctx, fits, "bg_inner", rmax)
+		outer := form_length(ctx, fits, "bg_outer", 1.5*rmax)
+
+		if background, background_std, err = annulus_background(fits, x, y, inner, outer); err != nil {
+			http_error(ctx, iris.StatusBadRequest, err)
+			return
+		}
+	default:
+		if background, err = strconv.ParseFloat(bg, 64); err != nil {
+			http_error(ctx, iris.StatusBadRequest, fmt.Errorf("invalid background '%s'", bg))
+			return
+		}
+	}
+
+	profile, err := radial_profile(subaru, x, y, rmax, step, background, background_std)
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	send_table(ctx, profile, func() *VOTable { return radial_profile_votable(profile) })
+}
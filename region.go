@@ -0,0 +1,422 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/kataras/iris"
+)
+
+//RegionSpec is a region as sent by the client
+//in the "image" frame positions are FITS pixel coordinates, sizes are in pixels and angles are
+//measured counter-clockwise from the x axis; in the "sky" frame positions are RA/Dec [deg] in the image frame,
+//sizes are in arcseconds and angles are position angles east of north
+type RegionSpec struct {
+	Shape  string       `json:"shape"` //box, circle, ellipse, polygon or point
+	Frame  string       `json:"frame"` //image (default) or sky
+	X      float64      `json:"x"`
+	Y      float64      `json:"y"`
+	Width  float64      `json:"width"`
+	Height float64      `json:"height"`
+	Radius float64      `json:"radius"`
+	A      float64      `json:"a"` //ellipse semi-axes
+	B      float64      `json:"b"`
+	Angle  float64      `json:"angle"`
+	Points [][2]float64 `json:"points"`
+}
+
+//Region is a RegionSpec resolved into pixel coordinates
+type Region struct {
+	shape         string
+	x, y          float64
+	width, height float64
+	a, b          float64
+	angle         float64 //[rad], counter-clockwise from the x axis
+	points        [][2]float64
+}
+
+type RegionStatistics struct {
+	DataId string  `json:"dataId"`
+	Shape  string  `json:"shape"`
+	Count  int     `json:"count"`
+	Masked int     `json:"masked"` //NaN and IGNRVAL pixels inside the region
+	Sum    float64 `json:"sum"`
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+	Std    float64 `json:"std"`
+	MAD    float64 `json:"mad"`
+	Min    float64 `json:"min"`
+	MinX   int     `json:"min_x"` //FITS pixel coordinates of the extremes
+	MinY   int     `json:"min_y"`
+	Max    float64 `json:"max"`
+	MaxX   int     `json:"max_x"`
+	MaxY   int     `json:"max_y"`
+}
+
+//sky_directions returns unit vectors pointing north and east in pixel space at (x, y)
+func sky_directions(fits *FITS, x, y float64) ([2]float64, [2]float64, error) {
+	var north, east [2]float64
+
+	if fits.wcs == nil {
+		return north, east, errors.New("the image has no usable WCS")
+	}
+
+	ra, dec, err := fits.wcs.PixelToSky(x, y)
+
+	if err != nil {
+		return north, east, err
+	}
+
+	const delta = 1.0 / 3600.0
+
+	nx, ny, err := fits.wcs.SkyToPixel(ra, dec+delta)
+
+	if err != nil {
+		return north, east, err
+	}
+
+	ex, ey, err := fits.wcs.SkyToPixel(ra+delta/math.Cos(dec*math.Pi/180.0), dec)
+
+	if err != nil {
+		return north, east, err
+	}
+
+	n := math.Hypot(nx-x, ny-y)
+	e := math.Hypot(ex-x, ey-y)
+
+	north = [2]float64{(nx - x) / n, (ny - y) / n}
+	east = [2]float64{(ex - x) / e, (ey - y) / e}
+
+	return north, east, nil
+}
+
+func resolve_region(fits *FITS, spec RegionSpec) (*Region, error) {
+	r := &Region{shape: strings.ToLower(spec.Shape)}
+
+	switch r.shape {
+	case "box", "circle", "ellipse", "polygon", "point":
+	default:
+		return nil, fmt.Errorf("unknown region shape '%s'", spec.Shape)
+	}
+
+	frame := strings.ToLower(spec.Frame)
+
+	if frame == "" || frame == "image" || frame == "pixel" {
+		r.x, r.y = spec.X, spec.Y
+		r.width, r.height = spec.Width, spec.Height
+		r.a, r.b = spec.A, spec.B
+		r.angle = spec.Angle * math.Pi / 180.0
+		r.points = spec.Points
+
+		if r.shape == "circle" {
+			r.a, r.b = spec.Radius, spec.Radius
+		}
+
+		return r, validate_region(r)
+	}
+
+	if frame != "sky" {
+		return nil, fmt.Errorf("unknown region frame '%s'", spec.Frame)
+	}
+
+	if fits.wcs == nil {
+		return nil, errors.New("the image has no usable WCS")
+	}
+
+	var err error
+
+	if r.shape == "polygon" {
+		for _, p := range spec.Points {
+			x, y, err := fits.wcs.SkyToPixel(p[0], p[1])
+
+			if err != nil {
+				return nil, err
+			}
+
+			r.points = append(r.points, [2]float64{x, y})
+		}
+
+		return r, validate_region(r)
+	}
+
+	if r.x, r.y, err = fits.wcs.SkyToPixel(spec.X, spec.Y); err != nil {
+		return nil, err
+	}
+
+	north, east, err := sky_directions(fits, r.x, r.y)
+
+	if err != nil {
+		return nil, err
+	}
+
+	scale := fits.wcs.PixelScale()
+
+	r.width, r.height = spec.Width/scale, spec.Height/scale
+	r.a, r.b = spec.A/scale, spec.B/scale
+
+	if r.shape == "circle" {
+		r.a, r.b = spec.Radius/scale, spec.Radius/scale
+	}
+
+	//the width (or the a axis) points along the position angle
+	pa := spec.Angle * math.Pi / 180.0
+	dx := math.Cos(pa)*north[0] + math.Sin(pa)*east[0]
+	dy := math.Cos(pa)*north[1] + math.Sin(pa)*east[1]
+	r.angle = math.Atan2(dy, dx)
+
+	return r, validate_region(r)
+}
+
+func validate_region(r *Region) error {
+	switch r.shape {
+	case "box":
+		if r.width <= 0 || r.height <= 0 {
+			return errors.New("a box needs a positive width and height")
+		}
+	case "circle", "ellipse":
+		if r.a <= 0 || r.b <= 0 {
+			return errors.New("a circle or an ellipse needs positive axes")
+		}
+	case "polygon":
+		if len(r.points) < 3 {
+			return errors.New("a polygon needs at least three vertices")
+		}
+	}
+
+	return nil
+}
+
+//contains takes FITS pixel coordinates
+func (r *Region) contains(x, y float64) bool {
+	dx := x - r.x
+	dy := y - r.y
+
+	//rotate into the region frame
+	c := math.Cos(r.angle)
+	s := math.Sin(r.angle)
+	u := c*dx + s*dy
+	v := -s*dx + c*dy
+
+	switch r.shape {
+	case "box":
+		return math.Abs(u) <= 0.5*r.width && math.Abs(v) <= 0.5*r.height
+	case "circle", "ellipse":
+		return (u*u)/(r.a*r.a)+(v*v)/(r.b*r.b) <= 1.0
+	case "point":
+		return math.Floor(x+0.5) == math.Floor(r.x+0.5) && math.Floor(y+0.5) == math.Floor(r.y+0.5)
+	case "polygon":
+		//even-odd rule
+		inside := false
+		n := len(r.points)
+
+		for i, j := 0, n-1; i < n; j, i = i, i+1 {
+			xi, yi := r.points[i][0], r.points[i][1]
+			xj, yj := r.points[j][0], r.points[j][1]
+
+			if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+				inside = !inside
+			}
+		}
+
+		return inside
+	}
+
+	return false
+}
+
+//bounds returns the zero-based [x0, x1] x [y0, y1] pixel range enclosing the region, clipped to the image
+func (r *Region) bounds(fits *FITS) (int, int, int, int) {
+	var xmin, xmax, ymin, ymax float64
+
+	switch r.shape {
+	case "polygon":
+		xmin, ymin = math.Inf(1), math.Inf(1)
+		xmax, ymax = math.Inf(-1), math.Inf(-1)
+
+		for _, p := range r.points {
+			xmin = math.Min(xmin, p[0])
+			xmax = math.Max(xmax, p[0])
+			ymin = math.Min(ymin, p[1])
+			ymax = math.Max(ymax, p[1])
+		}
+	case "point":
+		xmin, xmax, ymin, ymax = r.x, r.x, r.y, r.y
+	default:
+		//the circumscribed circle is good enough
+		radius := math.Max(r.a, r.b)
+
+		if r.shape == "box" {
+			radius = 0.5 * math.Hypot(r.width, r.height)
+		}
+
+		xmin, xmax = r.x-radius, r.x+radius
+		ymin, ymax = r.y-radius, r.y+radius
+	}
+
+	x0 := int(math.Floor(xmin+0.5)) - 1
+	x1 := int(math.Floor(xmax+0.5)) - 1
+	y0 := int(math.Floor(ymin+0.5)) - 1
+	y1 := int(math.Floor(ymax+0.5)) - 1
+
+	if x0 < 0 {
+		x0 = 0
+	}
+
+	if y0 < 0 {
+		y0 = 0
+	}
+
+	if x1 > fits.width-1 {
+		x1 = fits.width - 1
+	}
+
+	if y1 > fits.height-1 {
+		y1 = fits.height - 1
+	}
+
+	return x0, x1, y0, y1
+}
+
+//region_pixels visits every pixel whose centre lies inside the region
+func region_pixels(fits *FITS, r *Region, f func(index, x, y int)) {
+	x0, x1, y0, y1 := r.bounds(fits)
+
+	for y := y0; y <= y1; y++ {
+		for x := x0; x <= x1; x++ {
+			if r.contains(float64(x+1), float64(y+1)) {
+				f(y*fits.width+x, x, y)
+			}
+		}
+	}
+}
+
+func region_statistics(subaru *SubaruDataset, r *Region) (RegionStatistics, error) {
+	return visit_statistics(subaru, r.shape, func(f func(index, x, y int)) {
+		region_pixels(&subaru.fits, r, f)
+	})
+}
+
+//visit_statistics gathers the statistics of the pixels passed on by visit
+func visit_statistics(subaru *SubaruDataset, shape string, visit func(func(index, x, y int))) (RegionStatistics, error) {
+	fits := &subaru.fits
+
+	stats := RegionStatistics{DataId: subaru.dataId, Shape: shape, Min: math.Inf(1), Max: math.Inf(-1)}
+	values := make([]float32, 0)
+
+	var sum, sum2 float64
+
+	visit(func(index, x, y int) {
+		value := fits.data[index]
+
+		if !is_valid_pixel(fits, value) {
+			stats.Masked++
+			return
+		}
+
+		v := float64(value)
+		values = append(values, value)
+		sum += v
+		sum2 += v * v
+
+		if v < stats.Min {
+			stats.Min, stats.MinX, stats.MinY = v, x+1, y+1
+		}
+
+		if v > stats.Max {
+			stats.Max, stats.MaxX, stats.MaxY = v, x+1, y+1
+		}
+	})
+
+	stats.Count = len(values)
+
+	if stats.Count == 0 {
+		return stats, errors.New("no valid pixels in the region")
+	}
+
+	n := float64(stats.Count)
+	stats.Sum = sum
+	stats.Mean = sum / n
+	stats.Std = math.Sqrt(math.Max(0, sum2/n-stats.Mean*stats.Mean))
+
+	median := median_float32(values)
+	stats.Median = float64(median)
+
+	for i, value := range values {
+		values[i] = float32(math.Abs(float64(value - median)))
+	}
+
+	stats.MAD = float64(median_float32(values))
+
+	return stats, nil
+}
+
+//region_spec_from_form reads a region from the query string, polygon vertices are given
+//as points=x1,y1,x2,y2,...
+func region_spec_from_form(ctx iris.Context) (RegionSpec, error) {
+	spec := RegionSpec{Shape: ctx.FormValue("shape"), Frame: ctx.FormValue("frame")}
+
+	spec.X, _ = form_float(ctx, "x")
+	spec.Y, _ = form_float(ctx, "y")
+	spec.Width, _ = form_float(ctx, "width")
+	spec.Height, _ = form_float(ctx, "height")
+	spec.Radius, _ = form_float(ctx, "radius")
+	spec.A, _ = form_float(ctx, "a")
+	spec.B, _ = form_float(ctx, "b")
+	spec.Angle, _ = form_float(ctx, "angle")
+
+	if points := strings.TrimSpace(ctx.FormValue("points")); points != "" {
+		coords := strings.Split(points, ",")
+
+		if len(coords)%2 != 0 {
+			return spec, errors.New("polygon vertices come in pairs")
+		}
+
+		for i := 0; i < len(coords); i += 2 {
+			x, err1 := strconv.ParseFloat(strings.TrimSpace(coords[i]), 64)
+			y, err2 := strconv.ParseFloat(strings.TrimSpace(coords[i+1]), 64)
+
+			if err1 != nil || err2 != nil {
+				return spec, errors.New("malformed polygon vertices")
+			}
+
+			spec.Points = append(spec.Points, [2]float64{x, y})
+		}
+	}
+
+	return spec, nil
+}
+
+//GET /subaruwebql/region?dataId=...&shape=...&frame=image|sky&x=...&y=...
+func region_handler(ctx iris.Context) {
+	subaru, ok := loaded_dataset_or_fail(ctx)
+
+	if !ok {
+		return
+	}
+
+	spec, err := region_spec_from_form(ctx)
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	r, err := resolve_region(&subaru.fits, spec)
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	stats, err := region_statistics(subaru, r)
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	ctx.JSON(stats)
+}
@@ -0,0 +1,1434 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/jvo203/SubaruWebQL/wcs"
+	"github.com/kataras/iris"
+)
+
+//the largest region file accepted [bytes]
+const REGION_FILE_MAX_SIZE = 1 << 20
+
+//the session used when the client does not name one
+const REGION_DEFAULT_SESSION = "default"
+
+//region sets are kept in memory with the dataset: the sessions per dataset and the shapes per session are bounded
+const REGION_MAX_SESSIONS = 32
+const REGION_MAX_ITEMS = 10000
+
+var errRegionSessions = fmt.Errorf("no more than %d region sessions per dataset", REGION_MAX_SESSIONS)
+var errRegionItems = fmt.Errorf("no more than %d regions per session", REGION_MAX_ITEMS)
+
+//RegionItem is one shape of a region file or drawn in the viewer, text items only annotate
+type RegionItem struct {
+	RegionSpec
+	Text    string `json:"text,omitempty"` //the label, or the text of a text item
+	Exclude bool   `json:"exclude,omitempty"`
+	Color   string `json:"color,omitempty"`
+}
+
+type RegionSet struct {
+	DataId   string       `json:"dataId"`
+	Session  string       `json:"session"`
+	Regions  []RegionItem `json:"regions"`
+	Warnings []string     `json:"warnings,omitempty"` //the lines that could not be imported
+}
+
+type RegionSetStatistics struct {
+	DataId   string             `json:"dataId"`
+	Session  string             `json:"session"`
+	Regions  []RegionStatistics `json:"regions"`  //one per shape, text items are left out
+	Combined RegionStatistics   `json:"combined"` //the included pixels less the excluded ones
+}
+
+//regionContext converts the coordinates of a region file line into a RegionSpec
+type regionContext struct {
+	fits  *FITS
+	frame string //"image" or the celestial frame of the file coordinates
+	sky   bool   //the spec is built in the sky frame
+}
+
+//parse_region_coordinate returns degrees (unit "deg"), pixels ("pix") or a bare number ("")
+//sexagesimal values use ':' or h/d/m/s separators, CASA writes declinations as dd.mm.ss
+func parse_region_coordinate(token string, hours bool) (float64, string, error) {
+	s := strings.ToLower(strings.TrimSpace(token))
+
+	for _, suffix := range []string{"pix", "p", "i"} {
+		if strings.HasSuffix(s, suffix) {
+			v, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64)
+
+			if err == nil {
+				return v, "pix", nil
+			}
+		}
+	}
+
+	if strings.HasSuffix(s, "rad") {
+		v, err := strconv.ParseFloat(strings.TrimSuffix(s, "rad"), 64)
+		return v * 180 / math.Pi, "deg", err
+	}
+
+	for _, suffix := range []string{"deg", "d"} {
+		if strings.HasSuffix(s, suffix) {
+			if v, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64); err == nil {
+				return v, "deg", nil
+			}
+		}
+	}
+
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		return v, "", nil
+	}
+
+	switch {
+	case strings.ContainsAny(s, "h"):
+		hours = true
+	case strings.ContainsAny(s, "dms"):
+		hours = false
+	case !strings.Contains(s, ":") && strings.Count(s, ".") >= 2:
+		//dd.mm.ss[.sss]
+		n := strings.Index(s, ".")
+		m := n + 1 + strings.Index(s[n+1:], ".")
+		s = s[:n] + ":" + s[n+1:m] + ":" + s[m+1:]
+		hours = false
+	}
+
+	s = strings.Map(func(r rune) rune {
+		if strings.ContainsRune("hdms:", r) {
+			return ' '
+		}
+		return r
+	}, s)
+
+	v, err := parse_angle(s, hours)
+
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid coordinate '%s'", token)
+	}
+
+	return v, "deg", nil
+}
+
+//parse_region_size returns arcseconds (unit "arcsec"), pixels ("pix") or a bare number ("")
+func parse_region_size(token string) (float64, string, error) {
+	s := strings.ToLower(strings.TrimSpace(token))
+
+	units := []struct {
+		suffix string
+		unit   string
+		factor float64
+	}{
+		{"arcsec", "arcsec", 1}, {"arcmin", "arcsec", 60}, {"deg", "arcsec", 3600}, {"rad", "arcsec", 3600 * 180 / math.Pi},
+		{"pix", "pix", 1}, {"\"", "arcsec", 1}, {"'", "arcsec", 60}, {"d", "arcsec", 3600}, {"r", "arcsec", 3600 * 180 / math.Pi},
+		{"p", "pix", 1}, {"i", "pix", 1},
+	}
+
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			v, err := strconv.ParseFloat(strings.TrimSuffix(s, u.suffix), 64)
+
+			if err != nil {
+				return 0, "", fmt.Errorf("invalid size '%s'", token)
+			}
+
+			return v * u.factor, u.unit, nil
+		}
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid size '%s'", token)
+	}
+
+	return v, "", nil
+}
+
+//parse_region_angle returns degrees, "rad" and "deg" suffixes are allowed
+func parse_region_angle(token string) (float64, error) {
+	s := strings.ToLower(strings.TrimSpace(token))
+	factor := 1.0
+
+	if strings.HasSuffix(s, "rad") {
+		s, factor = strings.TrimSuffix(s, "rad"), 180/math.Pi
+	}
+
+	s = strings.TrimSuffix(s, "deg")
+	v, err := strconv.ParseFloat(s, 64)
+
+	if err != nil {
+		return 0, fmt.Errorf("invalid angle '%s'", token)
+	}
+
+	return v * factor, nil
+}
+
+//begin chooses the frame of the spec: image coordinates (or pixel units) give an image spec
+func (c *regionContext) begin(x string) error {
+	_, unit, _ := parse_region_coordinate(x, true)
+	c.sky = c.frame != "image" && unit != "pix"
+
+	if c.frame != "image" && c.fits.wcs == nil {
+		return errors.New("the image has no usable WCS")
+	}
+
+	return nil
+}
+
+func (c *regionContext) spec_frame() string {
+	if c.sky {
+		return "sky"
+	}
+
+	return "image"
+}
+
+//position returns FITS pixel coordinates or RA/Dec [deg] in the image frame depending on the spec frame
+func (c *regionContext) position(xs, ys string) (float64, float64, error) {
+	x, ux, err := parse_region_coordinate(xs, c.frame != "image")
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	y, uy, err := parse_region_coordinate(ys, false)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if c.frame == "image" || ux == "pix" || uy == "pix" {
+		if ux == "deg" || uy == "deg" {
+			return 0, 0, errors.New("angular coordinates given as pixels")
+		}
+
+		if !c.sky {
+			return x, y, nil
+		}
+
+		return c.fits.wcs.PixelToSky(x, y)
+	}
+
+	lon, lat, err := wcs.Convert(x, y, c.frame, c.fits.wcs.Frame())
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if c.sky {
+		return lon, lat, nil
+	}
+
+	return c.fits.wcs.SkyToPixel(lon, lat)
+}
+
+//size returns pixels or arcseconds depending on the spec frame, bare numbers are degrees on the sky
+func (c *regionContext) size(token string) (float64, error) {
+	v, unit, err := parse_region_size(token)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if unit == "" {
+		if c.frame == "image" {
+			unit = "pix"
+		} else {
+			v, unit = v*3600, "arcsec"
+		}
+	}
+
+	switch {
+	case unit == "pix" && c.sky:
+		return v * c.fits.wcs.PixelScale(), nil
+	case unit == "arcsec" && !c.sky:
+		if c.fits.wcs == nil {
+			return 0, errors.New("the image has no usable WCS")
+		}
+
+		return v / c.fits.wcs.PixelScale(), nil
+	default:
+		return v, nil
+	}
+}
+
+//axis_angle turns the angle of the first axis as a position angle (counter-clockwise from the +y axis
+//for pixel coordinates) into the RegionSpec angle
+func (c *regionContext) axis_angle(phi float64) float64 {
+	if c.sky {
+		return phi
+	}
+
+	return phi + 90
+}
+
+//region_frame_name maps DS9 and CASA coordinate system names onto image or a celestial frame
+func region_frame_name(fits *FITS, name string) (string, bool) {
+	switch strings.ToLower(name) {
+	case "image", "physical", "pix", "pixel":
+		return "image", true
+	case "fk5", "j2000":
+		return wcs.FK5, true
+	case "icrs":
+		return wcs.ICRS, true
+	case "fk4", "b1950", "b1950_vla":
+		return wcs.FK4, true
+	case "galactic":
+		return wcs.GALACTIC, true
+	case "ecliptic":
+		return wcs.ECLIPTIC, true
+	case "wcs":
+		if fits.wcs != nil {
+			return fits.wcs.Frame(), true
+		}
+
+		return wcs.ICRS, true
+	}
+
+	return "", false
+}
+
+//split_outside splits s at sep, leaving braced and bracketed (and optionally quoted) text alone
+//DS9 coordinates use '"' and '\'' as units so quotes only count in properties
+func split_outside(s string, sep rune, quotes bool) []string {
+	var parts []string
+	var quote rune
+	depth, start := 0, 0
+
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case quotes && (r == '"' || r == '\''):
+			quote = r
+		case r == '{' || r == '[' || r == '(':
+			depth++
+		case r == '}' || r == ']' || r == ')':
+			depth--
+		case r == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + len(string(r))
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+//parse_region_properties reads key=value pairs, values may be quoted, braced or bracketed
+func parse_region_properties(s string, sep rune) map[string]string {
+	props := make(map[string]string)
+
+	for _, item := range split_outside(s, sep, true) {
+		item = strings.TrimSpace(item)
+		n := strings.Index(item, "=")
+
+		if n <= 0 {
+			if item != "" {
+				props[strings.ToLower(item)] = ""
+			}
+			continue
+		}
+
+		value := strings.TrimSpace(item[n+1:])
+
+		if len(value) >= 2 && strings.ContainsRune("\"'{", rune(value[0])) {
+			value = value[1 : len(value)-1]
+		}
+
+		props[strings.ToLower(strings.TrimSpace(item[:n]))] = value
+	}
+
+	return props
+}
+
+//parse_DS9_regions reads a DS9 region file (version 4) against the WCS of fits
+//lines that cannot be imported are reported as warnings rather than failing the whole file
+func parse_DS9_regions(fits *FITS, text string) ([]RegionItem, []string) {
+	var items []RegionItem
+	var warnings []string
+
+	c := &regionContext{fits: fits, frame: "image"}
+	color := ""
+
+	for n, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		comment := ""
+
+		if k := strings.Index(line, "#"); k >= 0 {
+			line, comment = strings.TrimSpace(line[:k]), strings.TrimSpace(line[k+1:])
+
+			//old versions write text regions as comments
+			if line == "" && strings.HasPrefix(comment, "text") {
+				line, comment = comment, ""
+
+				if k := strings.Index(line, ")"); k >= 0 {
+					line, comment = line[:k+1], line[k+1:]
+				}
+			}
+		}
+
+		if line == "" {
+			continue
+		}
+
+		statements := split_outside(line, ';', false)
+
+		for s, statement := range statements {
+			statement = strings.TrimSpace(statement)
+
+			if statement == "" {
+				continue
+			}
+
+			if strings.HasPrefix(strings.ToLower(statement), "global") {
+				if value, ok := parse_region_properties(statement[len("global"):], ' ')["color"]; ok {
+					color = value
+				}
+				continue
+			}
+
+			if frame, ok := region_frame_name(fits, statement); ok {
+				c.frame = frame
+				continue
+			}
+
+			props := ""
+
+			if s == len(statements)-1 {
+				props = comment
+			}
+
+			item, err := parse_DS9_shape(c, statement, props, color)
+
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("line %d: %s", n+1, err))
+				continue
+			}
+
+			items = append(items, item)
+		}
+	}
+
+	return items, warnings
+}
+
+//parse_DS9_shape reads a single shape such as -box(10:00:24,+2:12:00,20",10",45) with its properties
+func parse_DS9_shape(c *regionContext, statement, props, color string) (RegionItem, error) {
+	var item RegionItem
+
+	switch statement[0] {
+	case '-':
+		item.Exclude = true
+		statement = statement[1:]
+	case '+':
+		statement = statement[1:]
+	}
+
+	var name string
+	var args []string
+
+	if k := strings.Index(statement, "("); k >= 0 && strings.HasSuffix(statement, ")") {
+		name = strings.TrimSpace(statement[:k])
+
+		for _, arg := range split_outside(statement[k+1:len(statement)-1], ',', false) {
+			if arg = strings.TrimSpace(arg); arg != "" {
+				args = append(args, arg)
+			}
+		}
+	} else if fields := strings.Fields(statement); len(fields) > 0 {
+		name, args = fields[0], fields[1:]
+	}
+
+	name = strings.ToLower(name)
+	properties := parse_region_properties(props, ' ')
+
+	item.Text = properties["text"]
+	item.Color = color
+
+	if value, ok := properties["color"]; ok {
+		item.Color = value
+	}
+
+	if name == "text" && len(args) == 3 {
+		item.Text = strings.Trim(args[2], "{}\"'")
+		args = args[:2]
+	}
+
+	counts := map[string][]int{"circle": {3}, "box": {4, 5}, "ellipse": {4, 5}, "point": {2}, "text": {2}}
+
+	if name == "polygon" {
+		if len(args) < 6 || len(args)%2 != 0 {
+			return item, errors.New("a polygon needs at least three vertices")
+		}
+	} else if _, ok := counts[name]; !ok {
+		return item, fmt.Errorf("unsupported shape '%s'", name)
+	} else {
+		valid := false
+
+		for _, count := range counts[name] {
+			valid = valid || len(args) == count
+		}
+
+		if !valid {
+			return item, fmt.Errorf("wrong number of arguments for %s", name)
+		}
+	}
+
+	if err := c.begin(args[0]); err != nil {
+		return item, err
+	}
+
+	item.Shape = name
+	item.Frame = c.spec_frame()
+
+	var err error
+
+	if name == "polygon" {
+		for i := 0; i < len(args); i += 2 {
+			x, y, err := c.position(args[i], args[i+1])
+
+			if err != nil {
+				return item, err
+			}
+
+			item.Points = append(item.Points, [2]float64{x, y})
+		}
+
+		return item, nil
+	}
+
+	if item.X, item.Y, err = c.position(args[0], args[1]); err != nil {
+		return item, err
+	}
+
+	switch name {
+	case "circle":
+		item.Radius, err = c.size(args[2])
+	case "box", "ellipse":
+		var w, h float64
+
+		if w, err = c.size(args[2]); err != nil {
+			return item, err
+		}
+
+		if h, err = c.size(args[3]); err != nil {
+			return item, err
+		}
+
+		//DS9 angles run counter-clockwise from the x axis, or from west on the sky
+		theta := 0.0
+
+		if len(args) == 5 {
+			if theta, err = parse_region_angle(args[4]); err != nil {
+				return item, err
+			}
+		}
+
+		item.Angle = c.axis_angle(theta - 90)
+
+		if name == "box" {
+			item.Width, item.Height = w, h
+		} else {
+			item.A, item.B = w, h
+		}
+	}
+
+	return item, err
+}
+
+//crtfNode is a bracketed CRTF list: either a value or a list of nodes
+type crtfNode struct {
+	value string
+	list  []crtfNode
+}
+
+//parse_CRTF_list reads the bracketed list starting at s[0] == '[' and returns the remainder of s
+func parse_CRTF_list(s string) (crtfNode, string, error) {
+	var node crtfNode
+
+	if !strings.HasPrefix(s, "[") {
+		return node, s, errors.New("expected '['")
+	}
+
+	s = s[1:]
+
+	for {
+		s = strings.TrimLeft(s, " \t,")
+
+		if s == "" {
+			return node, s, errors.New("unterminated '['")
+		}
+
+		switch s[0] {
+		case ']':
+			return node, s[1:], nil
+
+		case '[':
+			child, rest, err := parse_CRTF_list(s)
+
+			if err != nil {
+				return node, rest, err
+			}
+
+			node.list = append(node.list, child)
+			s = rest
+
+		case '"', '\'':
+			end := strings.IndexByte(s[1:], s[0])
+
+			if end < 0 {
+				return node, s, errors.New("unterminated string")
+			}
+
+			node.list = append(node.list, crtfNode{value: s[1 : end+1]})
+			s = s[end+2:]
+
+		default:
+			end := strings.IndexAny(s, ",]")
+
+			if end < 0 {
+				return node, s, errors.New("unterminated '['")
+			}
+
+			node.list = append(node.list, crtfNode{value: strings.TrimSpace(s[:end])})
+			s = s[end:]
+		}
+	}
+}
+
+//pair returns the two values of a [x, y] node
+func (n crtfNode) pair() (string, string, bool) {
+	if len(n.list) != 2 || n.list[0].list != nil || n.list[1].list != nil {
+		return "", "", false
+	}
+
+	return n.list[0].value, n.list[1].value, true
+}
+
+//parse_CRTF_regions reads a CASA region text format (CRTF v0) file against the WCS of fits
+func parse_CRTF_regions(fits *FITS, text string) ([]RegionItem, []string) {
+	var items []RegionItem
+	var warnings []string
+
+	global := map[string]string{"coord": "J2000"}
+
+	for n, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(strings.ToLower(line), "global") {
+			for key, value := range parse_region_properties(line[len("global"):], ',') {
+				global[key] = value
+			}
+			continue
+		}
+
+		item, err := parse_CRTF_shape(fits, line, global)
+
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("line %d: %s", n+1, err))
+			continue
+		}
+
+		items = append(items, item)
+	}
+
+	return items, warnings
+}
+
+//parse_CRTF_shape reads a line such as -rotbox [[150.1deg, 2.2deg], [20arcsec, 10arcsec], 45deg] coord=ICRS, color=red
+func parse_CRTF_shape(fits *FITS, line string, global map[string]string) (RegionItem, error) {
+	var item RegionItem
+
+	switch {
+	case strings.HasPrefix(line, "-"):
+		item.Exclude = true
+		line = line[1:]
+	case strings.HasPrefix(line, "+"):
+		line = line[1:]
+	case strings.HasPrefix(strings.ToLower(line), "ann"):
+		line = line[3:]
+	}
+
+	k := strings.Index(line, "[")
+
+	if k < 0 {
+		return item, errors.New("no coordinates")
+	}
+
+	name := strings.ToLower(strings.TrimSpace(line[:k]))
+	node, rest, err := parse_CRTF_list(line[k:])
+
+	if err != nil {
+		return item, err
+	}
+
+	props := make(map[string]string)
+
+	for key, value := range global {
+		props[key] = value
+	}
+
+	for key, value := range parse_region_properties(rest, ',') {
+		props[key] = value
+	}
+
+	frame, ok := region_frame_name(fits, props["coord"])
+
+	if !ok {
+		return item, fmt.Errorf("unsupported coordinate system '%s'", props["coord"])
+	}
+
+	c := &regionContext{fits: fits, frame: frame}
+	item.Color = props["color"]
+	item.Text = props["label"]
+
+	args := node.list
+
+	if len(args) == 0 || len(args[0].list) != 2 {
+		return item, fmt.Errorf("malformed %s", name)
+	}
+
+	if err := c.begin(args[0].list[0].value); err != nil {
+		return item, err
+	}
+
+	item.Frame = c.spec_frame()
+
+	center := func() error {
+		x, y, _ := args[0].pair()
+		item.X, item.Y, err = c.position(x, y)
+		return err
+	}
+
+	sizes := func(node crtfNode) (float64, float64, error) {
+		w, h, ok := node.pair()
+
+		if !ok {
+			return 0, 0, fmt.Errorf("malformed %s", name)
+		}
+
+		a, err := c.size(w)
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		b, err := c.size(h)
+
+		return a, b, err
+	}
+
+	angle := func(node crtfNode) (float64, error) {
+		if node.list != nil {
+			return 0, fmt.Errorf("malformed %s", name)
+		}
+
+		return parse_region_angle(node.value)
+	}
+
+	switch {
+	case name == "circle" && len(args) == 2:
+		item.Shape = "circle"
+
+		if err = center(); err == nil {
+			item.Radius, err = c.size(args[1].value)
+		}
+
+	case (name == "centerbox" || name == "rotbox") && len(args) >= 2:
+		item.Shape = "box"
+
+		if err = center(); err != nil {
+			return item, err
+		}
+
+		if item.Width, item.Height, err = sizes(args[1]); err != nil {
+			return item, err
+		}
+
+		//the width lies east-west (along x) at pa = 0
+		pa := 0.0
+
+		if name == "rotbox" && len(args) == 3 {
+			pa, err = angle(args[2])
+		}
+
+		item.Angle = c.axis_angle(pa + 90)
+
+	case name == "box" && len(args) == 2:
+		item.Shape = "box"
+
+		x1, y1, ok1 := args[0].pair()
+		x2, y2, ok2 := args[1].pair()
+
+		if !ok1 || !ok2 {
+			return item, errors.New("malformed box")
+		}
+
+		//the corners are resolved in pixels, then turned into the frame of the spec
+		c.sky = false
+
+		px1, py1, err := c.position(x1, y1)
+
+		if err != nil {
+			return item, err
+		}
+
+		px2, py2, err := c.position(x2, y2)
+
+		if err != nil {
+			return item, err
+		}
+
+		item.Frame = "image"
+		item.X, item.Y = (px1+px2)/2, (py1+py2)/2
+		item.Width, item.Height = math.Abs(px2-px1), math.Abs(py2-py1)
+
+	case name == "ellipse" && len(args) == 3:
+		item.Shape = "ellipse"
+
+		if err = center(); err != nil {
+			return item, err
+		}
+
+		if item.A, item.B, err = sizes(args[1]); err != nil {
+			return item, err
+		}
+
+		//the first axis points north at pa = 0
+		pa, err := angle(args[2])
+
+		if err != nil {
+			return item, err
+		}
+
+		item.Angle = c.axis_angle(pa)
+
+	case name == "poly" && len(args) >= 3:
+		item.Shape = "polygon"
+
+		for _, vertex := range args {
+			x, y, ok := vertex.pair()
+
+			if !ok {
+				return item, errors.New("malformed polygon")
+			}
+
+			px, py, err := c.position(x, y)
+
+			if err != nil {
+				return item, err
+			}
+
+			item.Points = append(item.Points, [2]float64{px, py})
+		}
+
+	case name == "symbol" && len(args) >= 1:
+		item.Shape = "point"
+		err = center()
+
+	case name == "text" && len(args) == 2:
+		item.Shape = "text"
+		item.Text = args[1].value
+		err = center()
+
+	default:
+		return item, fmt.Errorf("unsupported shape '%s'", name)
+	}
+
+	return item, err
+}
+
+//parse_region_file detects the format unless it is given: CRTF files start with #CRTF
+func parse_region_file(fits *FITS, text, format string) ([]RegionItem, []string, error) {
+	if format == "" {
+		format = "ds9"
+
+		if strings.HasPrefix(strings.TrimSpace(text), "#CRTF") {
+			format = "crtf"
+		}
+	}
+
+	switch strings.ToLower(format) {
+	case "ds9", "reg":
+		items, warnings := parse_DS9_regions(fits, text)
+		return items, warnings, nil
+	case "crtf", "casa":
+		items, warnings := parse_CRTF_regions(fits, text)
+		return items, warnings, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown region format '%s'", format)
+	}
+}
+
+//resolve_item resolves a region item into pixel coordinates, a text item is resolved as its anchor point
+func resolve_item(fits *FITS, item RegionItem) (*Region, error) {
+	spec := item.RegionSpec
+
+	if strings.ToLower(spec.Shape) == "text" {
+		spec.Shape = "point"
+	}
+
+	r, err := resolve_region(fits, spec)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.shape = strings.ToLower(item.Shape)
+
+	return r, nil
+}
+
+//regionMask is a bitset over the image pixels
+type regionMask []uint64
+
+func (m regionMask) set(index int) {
+	m[index>>6] |= 1 << uint(index&63)
+}
+
+func (m regionMask) clear(index int) {
+	m[index>>6] &^= 1 << uint(index&63)
+}
+
+func (m regionMask) has(index int) bool {
+	return m[index>>6]&(1<<uint(index&63)) != 0
+}
+
+//region_set_mask selects the pixels inside the included shapes (or the whole image when there are none)
+//that lie outside all of the excluded ones
+func region_set_mask(fits *FITS, items []RegionItem) (regionMask, error) {
+	var include, exclude []*Region
+
+	for _, item := range items {
+		if strings.ToLower(item.Shape) == "text" || strings.ToLower(item.Shape) == "point" {
+			continue
+		}
+
+		r, err := resolve_item(fits, item)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if item.Exclude {
+			exclude = append(exclude, r)
+		} else {
+			include = append(include, r)
+		}
+	}
+
+	mask := make(regionMask, (fits.width*fits.height+63)/64)
+
+	if len(include) == 0 {
+		for i := 0; i < fits.width*fits.height; i++ {
+			mask.set(i)
+		}
+	}
+
+	for _, r := range include {
+		region_pixels(fits, r, func(index, x, y int) { mask.set(index) })
+	}
+
+	for _, r := range exclude {
+		region_pixels(fits, r, func(index, x, y int) { mask.clear(index) })
+	}
+
+	return mask, nil
+}
+
+//position_angle measures the angle of the region axis east of north [deg]
+func position_angle(fits *FITS, r *Region) (float64, error) {
+	north, east, err := sky_directions(fits, r.x, r.y)
+
+	if err != nil {
+		return 0, err
+	}
+
+	dx, dy := math.Cos(r.angle), math.Sin(r.angle)
+	pa := math.Atan2(dx*east[0]+dy*east[1], dx*north[0]+dy*north[1]) * 180 / math.Pi
+
+	return pa, nil
+}
+
+func normalise_angle(deg float64) float64 {
+	deg = math.Mod(deg, 360)
+
+	if deg < 0 {
+		deg += 360
+	}
+
+	return deg
+}
+
+//regionWriter formats the resolved regions of a session in image coordinates or on the sky
+type regionWriter struct {
+	fits  *FITS
+	frame string //"image" or a celestial frame
+}
+
+//position formats a pixel position
+func (w *regionWriter) position(x, y float64, crtf bool) (string, error) {
+	if w.frame == "image" {
+		if crtf {
+			return fmt.Sprintf("%.3fpix, %.3fpix", x, y), nil
+		}
+
+		return fmt.Sprintf("%.3f,%.3f", x, y), nil
+	}
+
+	ra, dec, err := w.fits.wcs.PixelToSky(x, y)
+
+	if err != nil {
+		return "", err
+	}
+
+	if ra, dec, err = wcs.Convert(ra, dec, w.fits.wcs.Frame(), w.frame); err != nil {
+		return "", err
+	}
+
+	if crtf {
+		return fmt.Sprintf("%.8fdeg, %.8fdeg", ra, dec), nil
+	}
+
+	return fmt.Sprintf("%.8f,%.8f", ra, dec), nil
+}
+
+//size formats a length in pixels
+func (w *regionWriter) size(length float64, crtf bool) string {
+	switch {
+	case w.frame == "image" && crtf:
+		return fmt.Sprintf("%.3fpix", length)
+	case w.frame == "image":
+		return fmt.Sprintf("%.3f", length)
+	case crtf:
+		return fmt.Sprintf("%.4farcsec", length*w.fits.wcs.PixelScale())
+	default:
+		return fmt.Sprintf("%.4f\"", length*w.fits.wcs.PixelScale())
+	}
+}
+
+//axis_angle returns the position angle of the region axis, counter-clockwise from +y for image coordinates
+func (w *regionWriter) axis_angle(r *Region) (float64, error) {
+	if w.frame == "image" {
+		return r.angle*180/math.Pi - 90, nil
+	}
+
+	return position_angle(w.fits, r)
+}
+
+func (w *regionWriter) DS9_shape(item RegionItem, r *Region) (string, error) {
+	var args []string
+
+	if r.shape == "polygon" {
+		for _, p := range r.points {
+			pos, err := w.position(p[0], p[1], false)
+
+			if err != nil {
+				return "", err
+			}
+
+			args = append(args, pos)
+		}
+	} else {
+		pos, err := w.position(r.x, r.y, false)
+
+		if err != nil {
+			return "", err
+		}
+
+		args = append(args, pos)
+	}
+
+	switch r.shape {
+	case "circle":
+		args = append(args, w.size(r.a, false))
+
+	case "box", "ellipse":
+		phi, err := w.axis_angle(r)
+
+		if err != nil {
+			return "", err
+		}
+
+		//DS9 measures from the x axis, or from west on the sky
+		theta := fmt.Sprintf("%.3f", normalise_angle(phi+90))
+
+		if r.shape == "box" {
+			args = append(args, w.size(r.width, false), w.size(r.height, false), theta)
+		} else {
+			args = append(args, w.size(r.a, false), w.size(r.b, false), theta)
+		}
+	}
+
+	line := r.shape + "(" + strings.Join(args, ",") + ")"
+
+	if item.Exclude {
+		line = "-" + line
+	}
+
+	var props []string
+
+	if item.Color != "" {
+		props = append(props, "color="+item.Color)
+	}
+
+	if item.Text != "" {
+		props = append(props, "text={"+item.Text+"}")
+	}
+
+	if len(props) > 0 {
+		line += " # " + strings.Join(props, " ")
+	}
+
+	return line, nil
+}
+
+func (w *regionWriter) CRTF_shape(item RegionItem, r *Region) (string, error) {
+	var line, pos string
+	var phi float64
+	var err error
+
+	if r.shape != "polygon" {
+		if pos, err = w.position(r.x, r.y, true); err != nil {
+			return "", err
+		}
+	}
+
+	if r.shape == "box" || r.shape == "ellipse" {
+		if phi, err = w.axis_angle(r); err != nil {
+			return "", err
+		}
+	}
+
+	switch r.shape {
+	case "circle":
+		line = fmt.Sprintf("circle [[%s], %s]", pos, w.size(r.a, true))
+	case "box":
+		line = fmt.Sprintf("rotbox [[%s], [%s, %s], %.3fdeg]", pos, w.size(r.width, true), w.size(r.height, true), normalise_angle(phi-90))
+	case "ellipse":
+		line = fmt.Sprintf("ellipse [[%s], [%s, %s], %.3fdeg]", pos, w.size(r.a, true), w.size(r.b, true), normalise_angle(phi))
+	case "point":
+		line = fmt.Sprintf("symbol [[%s], .]", pos)
+	case "text":
+		line = fmt.Sprintf("text [[%s], '%s']", pos, strings.Replace(item.Text, "'", "", -1))
+	case "polygon":
+		var vertices []string
+
+		for _, p := range r.points {
+			pos, err := w.position(p[0], p[1], true)
+
+			if err != nil {
+				return "", err
+			}
+
+			vertices = append(vertices, "["+pos+"]")
+		}
+
+		line = "poly [" + strings.Join(vertices, ", ") + "]"
+	}
+
+	if item.Exclude {
+		line = "-" + line
+	}
+
+	var props []string
+
+	switch w.frame {
+	case wcs.FK5:
+		props = append(props, "coord=J2000")
+	case wcs.ICRS:
+		props = append(props, "coord=ICRS")
+	}
+
+	if item.Color != "" {
+		props = append(props, "color="+item.Color)
+	}
+
+	if item.Text != "" && r.shape != "text" {
+		props = append(props, "label='"+strings.Replace(item.Text, "'", "", -1)+"'")
+	}
+
+	if len(props) > 0 {
+		line += " " + strings.Join(props, ", ")
+	}
+
+	return line, nil
+}
+
+//write_region_file exports the items in the DS9 or the CASA format, frame is image, fk5 or icrs
+func write_region_file(fits *FITS, items []RegionItem, format, frame string) (string, error) {
+	var buf bytes.Buffer
+
+	format = strings.ToLower(format)
+	frame_name, ok := region_frame_name(fits, frame)
+
+	if !ok || (frame_name != "image" && frame_name != wcs.FK5 && frame_name != wcs.ICRS) {
+		return "", fmt.Errorf("cannot export regions in the '%s' frame", frame)
+	}
+
+	if frame_name != "image" && fits.wcs == nil {
+		return "", errors.New("the image has no usable WCS")
+	}
+
+	w := &regionWriter{fits: fits, frame: frame_name}
+
+	switch format {
+	case "ds9", "reg":
+		buf.WriteString("# Region file format: DS9 version 4.1\n")
+		buf.WriteString("global color=green\n")
+		buf.WriteString(strings.ToLower(frame_name) + "\n")
+	case "crtf", "casa":
+		buf.WriteString("#CRTFv0 CASA Region Text Format version 0\n")
+	default:
+		return "", fmt.Errorf("unknown region format '%s'", format)
+	}
+
+	for _, item := range items {
+		r, err := resolve_item(fits, item)
+
+		if err != nil {
+			return "", err
+		}
+
+		var line string
+
+		if format == "ds9" || format == "reg" {
+			line, err = w.DS9_shape(item, r)
+		} else {
+			line, err = w.CRTF_shape(item, r)
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		buf.WriteString(line + "\n")
+	}
+
+	return buf.String(), nil
+}
+
+func region_session(ctx iris.Context) string {
+	if session := strings.TrimSpace(ctx.FormValue("session")); session != "" {
+		return session
+	}
+
+	return REGION_DEFAULT_SESSION
+}
+
+func get_region_set(subaru *SubaruDataset, session string) []RegionItem {
+	subaru.RLock()
+	defer subaru.RUnlock()
+
+	return subaru.regions[session]
+}
+
+//set_region_set replaces the items of a session, or appends to them; the stored slices are never modified in place
+//so that the readers of get_region_set may keep theirs
+func set_region_set(subaru *SubaruDataset, session string, items []RegionItem, add bool) ([]RegionItem, error) {
+	subaru.Lock()
+	defer subaru.Unlock()
+
+	if subaru.regions == nil {
+		subaru.regions = make(map[string][]RegionItem)
+	}
+
+	existing, ok := subaru.regions[session]
+
+	if add {
+		merged := make([]RegionItem, 0, len(existing)+len(items))
+		merged = append(merged, existing...)
+		items = append(merged, items...)
+	}
+
+	if len(items) == 0 {
+		delete(subaru.regions, session)
+		return items, nil
+	}
+
+	if len(items) > REGION_MAX_ITEMS {
+		return nil, errRegionItems
+	}
+
+	if !ok && len(subaru.regions) >= REGION_MAX_SESSIONS {
+		return nil, errRegionSessions
+	}
+
+	subaru.regions[session] = items
+
+	return items, nil
+}
+
+//POST /subaruwebql/regions?dataId=...[&session=...][&format=ds9|crtf|json][&append=true]
+//the body is a DS9 or CRTF region file, or a JSON list of the regions drawn in the viewer; an empty body clears the session
+func regions_import_handler(ctx iris.Context) {
+	subaru, ok := loaded_dataset_or_fail(ctx)
+
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(ctx.Request().Body, REGION_FILE_MAX_SIZE+1))
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	if len(body) > REGION_FILE_MAX_SIZE {
+		http_error(ctx, iris.StatusRequestEntityTooLarge, errors.New("the region file is too large"))
+		return
+	}
+
+	set := RegionSet{DataId: subaru.dataId, Session: region_session(ctx)}
+	format := strings.ToLower(ctx.FormValue("format"))
+	text := strings.TrimSpace(string(body))
+
+	if format == "json" || (format == "" && strings.HasPrefix(text, "[")) {
+		if err := json.Unmarshal(body, &set.Regions); err != nil {
+			http_error(ctx, iris.StatusBadRequest, err)
+			return
+		}
+
+		for _, item := range set.Regions {
+			if _, err := resolve_item(&subaru.fits, item); err != nil {
+				http_error(ctx, iris.StatusBadRequest, err)
+				return
+			}
+		}
+	} else if text != "" {
+		if set.Regions, set.Warnings, err = parse_region_file(&subaru.fits, text, format); err != nil {
+			http_error(ctx, iris.StatusBadRequest, err)
+			return
+		}
+	}
+
+	if set.Regions, err = set_region_set(subaru, set.Session, set.Regions, ctx.FormValue("append") == "true"); err != nil {
+		status := iris.StatusRequestEntityTooLarge
+
+		if errors.Is(err, errRegionSessions) {
+			status = iris.StatusTooManyRequests
+		}
+
+		http_error(ctx, status, err)
+		return
+	}
+
+	ctx.JSON(set)
+}
+
+//GET /subaruwebql/regions?dataId=...[&session=...][&format=json|ds9|crtf][&frame=image|fk5|icrs]
+func regions_export_handler(ctx iris.Context) {
+	subaru, ok := loaded_dataset_or_fail(ctx)
+
+	if !ok {
+		return
+	}
+
+	set := RegionSet{DataId: subaru.dataId, Session: region_session(ctx)}
+	set.Regions = get_region_set(subaru, set.Session)
+
+	format := strings.ToLower(ctx.FormValue("format"))
+
+	if format == "" || format == "json" {
+		ctx.JSON(set)
+		return
+	}
+
+	frame := ctx.FormValue("frame")
+
+	if frame == "" {
+		frame = "fk5"
+
+		if subaru.fits.wcs == nil {
+			frame = "image"
+		}
+	}
+
+	text, err := write_region_file(&subaru.fits, set.Regions, format, frame)
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	extension := ".reg"
+
+	if format == "crtf" || format == "casa" {
+		extension = ".crtf"
+	}
+
+	ctx.ContentType("text/plain")
+	ctx.Header("Content-Disposition", "attachment; filename=\""+subaru.dataId+extension+"\"")
+	ctx.WriteString(text)
+}
+
+//GET /subaruwebql/regions/statistics?dataId=...[&session=...]
+func regions_statistics_handler(ctx iris.Context) {
+	subaru, ok := loaded_dataset_or_fail(ctx)
+
+	if !ok {
+		return
+	}
+
+	session := region_session(ctx)
+	items := get_region_set(subaru, session)
+	stats := RegionSetStatistics{DataId: subaru.dataId, Session: session, Regions: []RegionStatistics{}}
+
+	for _, item := range items {
+		if strings.ToLower(item.Shape) == "text" {
+			continue
+		}
+
+		r, err := resolve_item(&subaru.fits, item)
+
+		if err == nil {
+			var s RegionStatistics
+
+			if s, err = region_statistics(subaru, r); err == nil {
+				stats.Regions = append(stats.Regions, s)
+			}
+		}
+
+		if err != nil {
+			http_error(ctx, iris.StatusBadRequest, err)
+			return
+		}
+	}
+
+	mask, err := region_set_mask(&subaru.fits, items)
+
+	if err == nil {
+		stats.Combined, err = visit_statistics(subaru, "mask", func(f func(index, x, y int)) {
+			fits := &subaru.fits
+
+			for index := 0; index < fits.width*fits.height; index++ {
+				if mask.has(index) {
+					f(index, index%fits.width, index/fits.width)
+				}
+			}
+		})
+	}
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	ctx.JSON(stats)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+//region_test_image is a 400 x 300 image with 0.2"/pixel around (150, 2)
+func region_test_image() *FITS {
+	fits := &FITS{BITPIX: -32, NAXIS: 2, width: 400, height: 300, depth: 1}
+
+	fits.header = []string{
+		make_FITS_card("CTYPE1", "'RA---TAN'", ""),
+		make_FITS_card("CTYPE2", "'DEC--TAN'", ""),
+		make_FITS_card("CRVAL1", "150.0", ""),
+		make_FITS_card("CRVAL2", "2.0", ""),
+		make_FITS_card("CRPIX1", "200.5", ""),
+		make_FITS_card("CRPIX2", "150.5", ""),
+		make_FITS_card("CD1_1", "-5.5555555555556E-05", ""),
+		make_FITS_card("CD1_2", "0.0", ""),
+		make_FITS_card("CD2_1", "0.0", ""),
+		make_FITS_card("CD2_2", "5.5555555555556E-05", ""),
+		make_FITS_card("RADESYS", "'ICRS'", ""),
+	}
+
+	fits.wcs = make_FITS_wcs(fits.header)
+
+	return fits
+}
+
+const ds9_test_regions = `# Region file format: DS9 version 4.1
+global color=green
+image
+circle(100,120,15) # text={source A}
+-box(250.5,80,40,20,30) # color=red
+ellipse(300,200,25,10,120)
+polygon(50,50,90,60,70,110)
+point(180,220)
+fk5
+circle(10:00:00.5,+2:00:10,4")
+box(149.9995,1.9990,6",3",45)
+`
+
+const crtf_test_regions = `#CRTFv0 CASA Region Text Format version 0
+circle [[100pix, 120pix], 15pix], label="source A"
+-box [[230.5pix, 70pix], [270.5pix, 90pix]]
+ellipse [[300pix, 200pix], [25pix, 10pix], 30deg]
+poly [[50pix, 50pix], [90pix, 60pix], [70pix, 110pix]]
+symbol [[180pix, 220pix], .]
+circle [[10:00:00.5, +02.00.10], 4arcsec], coord=ICRS
+`
+
+//same_region compares the resolved shapes, angles modulo the symmetry of the shape
+func same_region(t *testing.T, name string, a, b RegionItem, fits *FITS) {
+	t.Helper()
+
+	ra, err := resolve_item(fits, a)
+
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+
+	rb, err := resolve_item(fits, b)
+
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+
+	const tolerance = 1e-2 //[pixel]
+
+	close := func(u, v float64) bool { return math.Abs(u-v) < tolerance }
+
+	if ra.shape != rb.shape || a.Exclude != b.Exclude || a.Text != b.Text {
+		t.Errorf("%s: %s/%v/%q became %s/%v/%q", name, ra.shape, a.Exclude, a.Text, rb.shape, b.Exclude, b.Text)
+		return
+	}
+
+	if !close(ra.x, rb.x) || !close(ra.y, rb.y) || !close(ra.width, rb.width) || !close(ra.height, rb.height) || !close(ra.a, rb.a) || !close(ra.b, rb.b) {
+		t.Errorf("%s: %+v became %+v", name, *ra, *rb)
+	}
+
+	if ra.shape == "box" || ra.shape == "ellipse" {
+		if math.Abs(math.Remainder(ra.angle-rb.angle, math.Pi)) > 1e-4 {
+			t.Errorf("%s: the angle %g became %g", name, ra.angle, rb.angle)
+		}
+	}
+
+	if len(ra.points) != len(rb.points) {
+		t.Errorf("%s: %d vertices became %d", name, len(ra.points), len(rb.points))
+		return
+	}
+
+	for k := range ra.points {
+		if !close(ra.points[k][0], rb.points[k][0]) || !close(ra.points[k][1], rb.points[k][1]) {
+			t.Errorf("%s: vertex %v became %v", name, ra.points[k], rb.points[k])
+		}
+	}
+}
+
+func TestRegionRoundTrip(t *testing.T) {
+	fits := region_test_image()
+
+	tests := []struct {
+		name   string
+		text   string
+		format string
+		frame  string
+		items  int
+	}{
+		{"ds9 to ds9 image", ds9_test_regions, "ds9", "image", 7},
+		{"ds9 to ds9 fk5", ds9_test_regions, "ds9", "fk5", 7},
+		{"ds9 to crtf icrs", ds9_test_regions, "crtf", "icrs", 7},
+		{"crtf to crtf image", crtf_test_regions, "crtf", "image", 6},
+		{"crtf to ds9 icrs", crtf_test_regions, "ds9", "icrs", 6},
+	}
+
+	for _, test := range tests {
+		items, warnings, err := parse_region_file(fits, test.text, "")
+
+		if err != nil || len(warnings) > 0 {
+			t.Fatalf("%s: %v %v", test.name, err, warnings)
+		}
+
+		if len(items) != test.items {
+			t.Fatalf("%s: %d regions parsed", test.name, len(items))
+		}
+
+		text, err := write_region_file(fits, items, test.format, test.frame)
+
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		again, warnings, err := parse_region_file(fits, text, test.format)
+
+		if err != nil || len(warnings) > 0 {
+			t.Fatalf("%s: %v %v\n%s", test.name, err, warnings, text)
+		}
+
+		if len(again) != len(items) {
+			t.Fatalf("%s: %d regions written, %d read back\n%s", test.name, len(items), len(again), text)
+		}
+
+		for k := range items {
+			same_region(t, test.name, items[k], again[k], fits)
+		}
+	}
+}
+
+func TestRegionParseErrors(t *testing.T) {
+	fits := region_test_image()
+
+	for _, line := range []string{
+		"image\nannulus(100,100,5,10)",
+		"image\ncircle(100,100)",
+		"image\npolygon(1,1,2,2)",
+		"image\ncircle(100,100,abc)",
+	} {
+		items, warnings, err := parse_region_file(fits, line, "ds9")
+
+		if err != nil || len(items) != 0 || len(warnings) != 1 {
+			t.Errorf("%q: %d regions, warnings %v, %v", line, len(items), warnings, err)
+		}
+	}
+
+	if _, _, err := parse_region_file(fits, "circle(1,1,1)", "fits"); err == nil {
+		t.Error("an unknown format is accepted")
+	}
+}
+
+func TestRegionSetLimits(t *testing.T) {
+	subaru := &SubaruDataset{dataId: "regions"}
+	item := RegionItem{RegionSpec: RegionSpec{Shape: "point", X: 1, Y: 1}}
+
+	for k := 0; k < REGION_MAX_SESSIONS; k++ {
+		if _, err := set_region_set(subaru, string(rune('a'+k)), []RegionItem{item}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := set_region_set(subaru, "one too many", []RegionItem{item}, false); err != errRegionSessions {
+		t.Errorf("session %d: %v", REGION_MAX_SESSIONS+1, err)
+	}
+
+	items, err := set_region_set(subaru, "a", []RegionItem{item, item}, true)
+
+	if err != nil || len(items) != 3 {
+		t.Errorf("append: %d regions, %v", len(items), err)
+	}
+
+	if _, err := set_region_set(subaru, "a", make([]RegionItem, REGION_MAX_ITEMS), true); err != errRegionItems {
+		t.Errorf("too many regions: %v", err)
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/jvo203/SubaruWebQL/wcs"
+)
+
+//flux-conserving resampling, in addition to the INTERP_* point interpolations
+const REPROJECT_FLUX = 16
+
+//the largest number of sub-samples per output pixel side in the flux-conserving mode
+const REPROJECT_MAX_SUBSAMPLES = 8
+
+//the largest reprojected image or mosaic [pixel]
+const REPROJECT_MAX_PIXELS = 8192 * 8192
+
+//reprojectGrid is a target pixel grid tied to a reference WCS, the zero-based output pixel (i, j)
+//lies at the reference FITS pixel ((i+0.5)*scale + 0.5, (j+0.5)*scale + 0.5)
+type reprojectGrid struct {
+	width, height int
+	scale         float64
+	wcs           *wcs.WCS
+}
+
+func parse_reprojection(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "flux", "exact":
+		return REPROJECT_FLUX, nil
+	default:
+		return parse_interpolation(name)
+	}
+}
+
+//make_reproject_grid covers the reference image, binned so that neither side exceeds max_size (0: no limit)
+func make_reproject_grid(ref *FITS, max_size int) (reprojectGrid, error) {
+	if ref.wcs == nil {
+		return reprojectGrid{}, errors.New("the reference image has no usable WCS")
+	}
+
+	scale := 1.0
+
+	if max_size > 0 {
+		longer := ref.width
+
+		if ref.height > longer {
+			longer = ref.height
+		}
+
+		if longer > max_size {
+			scale = float64(longer) / float64(max_size)
+		}
+	}
+
+	grid := reprojectGrid{scale: scale, wcs: ref.wcs}
+	grid.width = int(math.Ceil(float64(ref.width) / scale))
+	grid.height = int(math.Ceil(float64(ref.height) / scale))
+
+	return grid, nil
+}
+
+//the WCS keywords carried over into a reprojected image
+func is_WCS_keyword(key string) bool {
+	if cube_axis_keyword.MatchString(key) {
+		return false
+	}
+
+	for _, prefix := range []string{"CTYPE", "CRVAL", "CRPIX", "CDELT", "CROTA", "CUNIT", "CD1_", "CD2_", "PC1_", "PC2_", "PV1_", "PV2_", "A_", "B_", "AP_", "BP_"} {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return key == "EQUINOX" || key == "RADESYS" || key == "LONPOLE" || key == "LATPOLE"
+}
+
+//reference_grid keeps the reference image pixels, the returned cards describe its WCS
+func reference_grid(ref *FITS) (reprojectGrid, []string, error) {
+	if ref.wcs == nil {
+		return reprojectGrid{}, nil, errors.New("the reference image has no usable WCS")
+	}
+
+	var cards []string
+
+	for _, card := range ref.header {
+		if key, _, ok := parse_FITS_card(card); ok && is_WCS_keyword(key) {
+			cards = append(cards, card)
+		}
+	}
+
+	return reprojectGrid{width: ref.width, height: ref.height, scale: 1, wcs: ref.wcs}, cards, nil
+}
+
+//make_target_cards writes a simple celestial WCS, scale is in [deg/pixel] and the rotation is zero
+func make_target_cards(proj, frame string, ra, dec, crpix1, crpix2, scale float64) []string {
+	cards := []string{
+		make_FITS_card("CTYPE1", fmt.Sprintf("'RA---%s'", proj), ""),
+		make_FITS_card("CTYPE2", fmt.Sprintf("'DEC--%s'", proj), ""),
+		make_FITS_card("CRVAL1", fits_float_value(ra), "[deg]"),
+		make_FITS_card("CRVAL2", fits_float_value(dec), "[deg]"),
+		make_FITS_card("CRPIX1", fits_float_value(crpix1), ""),
+		make_FITS_card("CRPIX2", fits_float_value(crpix2), ""),
+		make_FITS_card("CD1_1", fits_float_value(-scale), "[deg/pixel]"),
+		make_FITS_card("CD1_2", fits_float_value(0), ""),
+		make_FITS_card("CD2_1", fits_float_value(0), ""),
+		make_FITS_card("CD2_2", fits_float_value(scale), "[deg/pixel]"),
+	}
+
+	switch frame {
+	case wcs.FK4:
+		cards = append(cards, make_FITS_card("RADESYS", "'FK4'", ""), make_FITS_card("EQUINOX", fits_float_value(1950), ""))
+	case wcs.FK5:
+		cards = append(cards, make_FITS_card("RADESYS", "'FK5'", ""), make_FITS_card("EQUINOX", fits_float_value(2000), ""))
+	default:
+		cards = append(cards, make_FITS_card("RADESYS", "'ICRS'", ""))
+	}
+
+	return cards
+}
+
+//target_grid builds a north-up grid centred on (ra, dec) [deg] with a pixel scale [arcsec]
+//NaN positions default to the centre of the first input and a non-positive scale to the finest input
+//a non-positive width or height grows the grid to cover all the inputs
+func target_grid(inputs []*FITS, proj string, ra, dec, scale float64, width, height int) (reprojectGrid, []string, error) {
+	for _, fits := range inputs {
+		if fits.wcs == nil {
+			return reprojectGrid{}, nil, errors.New("every input needs a usable WCS")
+		}
+	}
+
+	first := inputs[0]
+	frame := first.wcs.Frame()
+
+	if frame != wcs.FK4 && frame != wcs.FK5 {
+		frame = wcs.ICRS
+	}
+
+	if proj == "" {
+		proj = "TAN"
+	}
+
+	proj = strings.ToUpper(proj)
+
+	if math.IsNaN(ra) || math.IsNaN(dec) {
+		r, d, err := first.wcs.PixelToSky(0.5*float64(first.width+1), 0.5*float64(first.height+1))
+
+		if err != nil {
+			return reprojectGrid{}, nil, err
+		}
+
+		if r, d, err = wcs.Convert(r, d, first.wcs.Frame(), frame); err != nil {
+			return reprojectGrid{}, nil, err
+		}
+
+		ra, dec = r, d
+	}
+
+	if scale <= 0 {
+		for _, fits := range inputs {
+			if s := fits.wcs.PixelScale(); scale <= 0 || s < scale {
+				scale = s
+			}
+		}
+	}
+
+	if !(scale > 0) {
+		return reprojectGrid{}, nil, errors.New("the pixel scale could not be determined")
+	}
+
+	crpix1 := 0.5 * float64(width+1)
+	crpix2 := 0.5 * float64(height+1)
+
+	if width <= 0 || height <= 0 {
+		//project the outlines of all the inputs onto a provisional grid with CRPIX = (0, 0)
+		cards := make_target_cards(proj, frame, ra, dec, 0, 0, scale/3600)
+		provisional := make_FITS_wcs(cards)
+
+		if provisional == nil {
+			return reprojectGrid{}, nil, fmt.Errorf("unsupported projection %s", proj)
+		}
+
+		xmin, xmax, ymin, ymax := math.Inf(1), math.Inf(-1), math.Inf(1), math.Inf(-1)
+
+		for _, fits := range inputs {
+			for _, t := range []float64{0, 0.25, 0.5, 0.75, 1} {
+				for _, p := range [][2]float64{
+					{0.5 + t*float64(fits.width), 0.5}, {0.5 + t*float64(fits.width), float64(fits.height) + 0.5},
+					{0.5, 0.5 + t*float64(fits.height)}, {float64(fits.width) + 0.5, 0.5 + t*float64(fits.height)},
+				} {
+					r, d, err := fits.wcs.PixelToSky(p[0], p[1])
+
+					if err != nil {
+						continue
+					}
+
+					if r, d, err = wcs.Convert(r, d, fits.wcs.Frame(), frame); err != nil {
+						continue
+					}
+
+					x, y, err := provisional.SkyToPixel(r, d)
+
+					if err != nil {
+						continue
+					}
+
+					xmin, xmax = math.Min(xmin, x), math.Max(xmax, x)
+					ymin, ymax = math.Min(ymin, y), math.Max(ymax, y)
+				}
+			}
+		}
+
+		if xmin > xmax || ymin > ymax {
+			return reprojectGrid{}, nil, errors.New("the inputs could not be projected onto the target")
+		}
+
+		//pixel edges at half-integers, with some slack for the rounding of the projections
+		x0 := math.Floor(xmin - 0.5 + 1e-6)
+		y0 := math.Floor(ymin - 0.5 + 1e-6)
+		width = int(math.Ceil(xmax-0.5-1e-6) - x0)
+		height = int(math.Ceil(ymax-0.5-1e-6) - y0)
+		crpix1 = -x0
+		crpix2 = -y0
+	}
+
+	//the sides are checked separately, their product may overflow
+	if width <= 0 || height <= 0 || width > REPROJECT_MAX_PIXELS/height {
+		return reprojectGrid{}, nil, fmt.Errorf("the target grid of %d x %d pixels is too large", width, height)
+	}
+
+	cards := make_target_cards(proj, frame, ra, dec, crpix1, crpix2, scale/3600)
+	world := make_FITS_wcs(cards)
+
+	if world == nil {
+		return reprojectGrid{}, nil, fmt.Errorf("unsupported projection %s", proj)
+	}
+
+	return reprojectGrid{width: width, height: height, scale: 1, wcs: world}, cards, nil
+}
+
+//reference returns the reference FITS pixel coordinates of the output pixel (i, j)
+func (grid *reprojectGrid) reference(i, j int) (float64, float64) {
+	return (float64(i)+0.5)*grid.scale + 0.5, (float64(j)+0.5)*grid.scale + 0.5
+}
+
+//to_source maps reference FITS pixel coordinates onto the FITS pixel coordinates of src
+func (grid *reprojectGrid) to_source(src *FITS, x, y float64) (float64, float64, bool) {
+	ra, dec, err := grid.wcs.PixelToSky(x, y)
+
+	if err != nil {
+		return 0, 0, false
+	}
+
+	if from, to := grid.wcs.Frame(), src.wcs.Frame(); from != to {
+		if ra, dec, err = wcs.Convert(ra, dec, from, to); err != nil {
+			return 0, 0, false
+		}
+	}
+
+	sx, sy, err := src.wcs.SkyToPixel(ra, dec)
+
+	return sx, sy, err == nil
+}
+
+//reproject resamples src onto the grid, output pixels falling outside src become NaN
+//method is one of INTERP_* or REPROJECT_FLUX
+func reproject(src *FITS, grid *reprojectGrid, method int) ([]float32, error) {
+	if src.wcs == nil {
+		return nil, errors.New("the image has no usable WCS")
+	}
+
+	if method == REPROJECT_FLUX {
+		return reproject_flux(src, grid), nil
+	}
+
+	dst := make([]float32, grid.width*grid.height)
+
+	for j := 0; j < grid.height; j++ {
+		for i := 0; i < grid.width; i++ {
+			dst[j*grid.width+i] = float32(math.NaN())
+
+			x, y := grid.reference(i, j)
+
+			if sx, sy, ok := grid.to_source(src, x, y); ok {
+				dst[j*grid.width+i] = float32(interpolate(src, sx, sy, method))
+			}
+		}
+	}
+
+	return dst, nil
+}
+
+//reproject_flux integrates src over the footprint of every output pixel, so that the total flux is preserved
+//the footprint is the quadrilateral spanned by the projected pixel corners, sub-sampled on a regular grid;
+//output pixels less than half covered by valid input become NaN
+func reproject_flux(src *FITS, grid *reprojectGrid) []float32 {
+	dst := make([]float32, grid.width*grid.height)
+
+	//the corners of the output pixels in src coordinates, two rows at a time
+	corners := func(j int) [][2]float64 {
+		row := make([][2]float64, grid.width+1)
+
+		for i := range row {
+			x := float64(i)*grid.scale + 0.5
+			y := float64(j)*grid.scale + 0.5
+
+			if sx, sy, ok := grid.to_source(src, x, y); ok {
+				row[i] = [2]float64{sx, sy}
+			} else {
+				row[i] = [2]float64{math.NaN(), math.NaN()}
+			}
+		}
+
+		return row
+	}
+
+	bottom := corners(0)
+
+	for j := 0; j < grid.height; j++ {
+		top := corners(j + 1)
+
+		for i := 0; i < grid.width; i++ {
+			dst[j*grid.width+i] = float32(math.NaN())
+
+			c00, c10, c11, c01 := bottom[i], bottom[i+1], top[i+1], top[i]
+
+			if math.IsNaN(c00[0]) || math.IsNaN(c10[0]) || math.IsNaN(c11[0]) || math.IsNaN(c01[0]) {
+				continue
+			}
+
+			//the shoelace formula gives the footprint in input pixels
+			area := 0.5 * math.Abs((c00[0]-c11[0])*(c10[1]-c01[1])-(c10[0]-c01[0])*(c00[1]-c11[1]))
+
+			n := int(math.Ceil(2 * math.Sqrt(area)))
+
+			if n < 2 {
+				n = 2
+			}
+
+			if n > REPROJECT_MAX_SUBSAMPLES {
+				n = REPROJECT_MAX_SUBSAMPLES
+			}
+
+			var sum float64
+			valid := 0
+
+			for sv := 0; sv < n; sv++ {
+				v := (float64(sv) + 0.5) / float64(n)
+
+				for su := 0; su < n; su++ {
+					u := (float64(su) + 0.5) / float64(n)
+
+					x := (1-u)*(1-v)*c00[0] + u*(1-v)*c10[0] + u*v*c11[0] + (1-u)*v*c01[0]
+					y := (1-u)*(1-v)*c00[1] + u*(1-v)*c10[1] + u*v*c11[1] + (1-u)*v*c01[1]
+
+					value := pixel_at(src, int(math.Floor(x-0.5)), int(math.Floor(y-0.5)))
+
+					if !math.IsNaN(value) {
+						sum += value
+						valid++
+					}
+				}
+			}
+
+			if 2*valid >= n*n {
+				dst[j*grid.width+i] = float32(area * sum / float64(valid))
+			}
+		}
+
+		bottom = top
+	}
+
+	return dst
+}
+
+//mosaicSum accumulates the weighted planes of the inputs one at a time
+type mosaicSum struct {
+	sum  []float32
+	wsum []float32
+}
+
+func make_mosaic_sum(grid *reprojectGrid) *mosaicSum {
+	return &mosaicSum{sum: make([]float32, grid.width*grid.height), wsum: make([]float32, grid.width*grid.height)}
+}
+
+func (m *mosaicSum) add(plane []float32, w float32) {
+	for i, value := range plane {
+		if !math.IsNaN(float64(value)) {
+			m.sum[i] += w * value
+			m.wsum[i] += w
+		}
+	}
+}
+
+//mean turns the sums into the weighted mean, pixels without valid samples become NaN
+func (m *mosaicSum) mean() []float32 {
+	for i := range m.sum {
+		if m.wsum[i] > 0 {
+			m.sum[i] /= m.wsum[i]
+		} else {
+			m.sum[i] = float32(math.NaN())
+		}
+	}
+
+	return m.sum
+}
+
+//make_mosaic co-adds the inputs on the grid as a weighted mean of the valid samples
+func make_mosaic(inputs []*FITS, weights []float64, grid *reprojectGrid, method int) ([]float32, error) {
+	sum := make_mosaic_sum(grid)
+
+	for k, src := range inputs {
+		plane, err := reproject(src, grid, method)
+
+		if err != nil {
+			return nil, err
+		}
+
+		sum.add(plane, float32(weights[k]))
+	}
+
+	return sum.mean(), nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"strings"
+
+	"github.com/kataras/iris"
+)
+
+//the longer side of a colour composite [pixel]
+const RGB_MAX_SIZE = 4096
+const RGB_DEFAULT_SIZE = 2048
+
+var RGB_CHANNELS = [3]string{"r", "g", "b"}
+
+type rgbOptions struct {
+	stretch string     //linear, asinh (both per channel) or lupton
+	q       float64    //the Lupton softening
+	soft    float64    //the per-channel asinh softening in units of the channel MAD
+	scales  [3]float64 //multiplied into each channel before a Lupton stretch
+	ref     int        //the channel whose WCS defines the output grid
+	size    int
+	method  int
+}
+
+//channel_linear maps a pixel onto [0, 1] between the channel black and white points
+func channel_linear(fits *FITS, v float32) float64 {
+	t := float64((v - fits.black) * fits.sensitivity)
+
+	return math.Max(0, math.Min(1, t))
+}
+
+//channel_asinh compresses the highlights, soft (in MADs) sets where the stretch turns logarithmic
+func channel_asinh(fits *FITS, v float32, soft float64) float64 {
+	beta := soft * float64(fits.mad)
+
+	if !(beta > 0) || !(fits.sensitivity > 0) {
+		return channel_linear(fits, v)
+	}
+
+	white := 1 / float64(fits.sensitivity)
+	t := math.Asinh(float64(v-fits.black)/beta) / math.Asinh(white/beta)
+
+	return math.Max(0, math.Min(1, t))
+}
+
+//make_rgb_composite reprojects the three channels onto the grid of the reference and renders them
+//the rows are flipped so that north is up as in the viewer
+func make_rgb_composite(channels [3]*FITS, opt rgbOptions) (*image.NRGBA, error) {
+	grid, err := make_reproject_grid(channels[opt.ref], opt.size)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var planes [3][]float32
+
+	for c := range channels {
+		if planes[c], err = reproject(channels[c], &grid, opt.method); err != nil {
+			return nil, fmt.Errorf("%s: %s", RGB_CHANNELS[c], err)
+		}
+	}
+
+	//the Lupton stretch works on the sum of the background-subtracted channels
+	stretch := 0.0
+
+	for c := range channels {
+		if channels[c].sensitivity > 0 {
+			stretch += opt.scales[c] / float64(channels[c].sensitivity) / 3
+		}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, grid.width, grid.height))
+
+	for j := 0; j < grid.height; j++ {
+		for i := 0; i < grid.width; i++ {
+			var rgb [3]float64
+			valid := true
+
+			for c := range channels {
+				v := planes[c][j*grid.width+i]
+
+				if !is_valid_pixel(channels[c], v) {
+					valid = false
+					break
+				}
+
+				switch opt.stretch {
+				case "asinh":
+					rgb[c] = channel_asinh(channels[c], v, opt.soft)
+				case "lupton":
+					rgb[c] = opt.scales[c] * float64(v-channels[c].median)
+				default:
+					rgb[c] = channel_linear(channels[c], v)
+				}
+			}
+
+			if !valid {
+				continue
+			}
+
+			if opt.stretch == "lupton" {
+				//Lupton et al. (2004): F(I)/I scales all channels alike, preserving the colours
+				intensity := (rgb[0] + rgb[1] + rgb[2]) / 3
+
+				if intensity <= 0 || stretch <= 0 {
+					rgb = [3]float64{}
+				} else {
+					f := math.Asinh(opt.q*intensity/stretch) / opt.q / intensity
+					peak := 0.0
+
+					for c := range rgb {
+						rgb[c] = math.Max(0, rgb[c]*f)
+						peak = math.Max(peak, rgb[c])
+					}
+
+					if peak > 1 {
+						for c := range rgb {
+							rgb[c] /= peak
+						}
+					}
+				}
+			}
+
+			img.SetNRGBA(i, grid.height-1-j, color.NRGBA{R: uint8(255 * rgb[0]), G: uint8(255 * rgb[1]), B: uint8(255 * rgb[2]), A: 255})
+		}
+	}
+
+	return img, nil
+}
+
+//GET /subaruwebql/rgb?r=dataId&g=dataId&b=dataId[&ref=r|g|b][&stretch=linear|asinh|lupton]
+//[&Q=...][&soft=...][&rscale=...&gscale=...&bscale=...][&size=...][&interpolation=...]
+//datasets not loaded yet are launched and the request answered with 503 until all three are available
+func rgb_handler(ctx iris.Context) {
+	ids := make([]string, len(RGB_CHANNELS))
+
+	for c, name := range RGB_CHANNELS {
+		if ids[c] = strings.TrimSpace(ctx.FormValue(name)); ids[c] == "" {
+			http_error(ctx, iris.StatusBadRequest, fmt.Errorf("missing the '%s' dataId", name))
+			return
+		}
+	}
+
+	subarus, ok := launched_datasets_or_wait(ctx, ids)
+
+	if !ok {
+		return
+	}
+
+	var channels [3]*FITS
+
+	for c := range channels {
+		channels[c] = &subarus[c].fits
+	}
+
+	opt := rgbOptions{stretch: strings.ToLower(ctx.FormValue("stretch")), q: 8, soft: 3, scales: [3]float64{1, 1, 1}, ref: 1}
+
+	if opt.stretch == "" {
+		opt.stretch = "lupton"
+	}
+
+	if opt.stretch != "linear" && opt.stretch != "asinh" && opt.stretch != "lupton" {
+		http_error(ctx, iris.StatusBadRequest, fmt.Errorf("unknown stretch '%s'", opt.stretch))
+		return
+	}
+
+	if q, ok := form_float(ctx, "Q"); ok && q > 0 {
+		opt.q = q
+	}
+
+	if soft, ok := form_float(ctx, "soft"); ok && soft > 0 {
+		opt.soft = soft
+	}
+
+	for c, name := range RGB_CHANNELS {
+		if scale, ok := form_float(ctx, name+"scale"); ok {
+			opt.scales[c] = scale
+		}
+
+		if ctx.FormValue("ref") == name {
+			opt.ref = c
+		}
+	}
+
+	opt.size = form_int(ctx, "size", RGB_DEFAULT_SIZE)
+
+	if opt.size <= 0 || opt.size > RGB_MAX_SIZE {
+		opt.size = RGB_MAX_SIZE
+	}
+
+	method, err := parse_interpolation(ctx.FormValue("interpolation"))
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	opt.method = method
+
+	img, err := make_rgb_composite(channels, opt)
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	var buf bytes.Buffer
+
+	if err := png.Encode(&buf, img); err != nil {
+		http_error(ctx, iris.StatusInternalServerError, err)
+		return
+	}
+
+	ctx.ContentType("image/png")
+	ctx.Write(buf.Bytes())
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris"
+	"github.com/kataras/iris/websocket"
+)
+
+//how long in-flight downloads may take to finish once a shutdown has been requested
+var SHUTDOWN_TIMEOUT = 30 * time.Second
+
+//how long aborted downloads get to checkpoint themselves
+const SHUTDOWN_ABORT_TIMEOUT = 5 * time.Second
+
+//websocket close frame: opcode and the 'going away' status code (RFC 6455)
+const WS_CLOSE_MESSAGE = 8
+const WS_CLOSE_GOING_AWAY = 1001
+
+var errShuttingDown = errors.New("the server is shutting down")
+
+//lifecycle tracks the downloads and cache writes in flight so that a shutdown can wait for them
+var lifecycle = struct {
+	sync.Mutex
+	draining bool
+	pending  sync.WaitGroup
+	abort    chan struct{} //closed once the downloads should give up
+}{abort: make(chan struct{})}
+
+func shutting_down() bool {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+
+	return lifecycle.draining
+}
+
+//accepting_datasets fails once a shutdown has begun
+func accepting_datasets() error {
+	if shutting_down() {
+		return errShuttingDown
+	}
+
+	return nil
+}
+
+//begin_cache_io registers a download or a cache write, the returned function marks it done
+func begin_cache_io() (func(), error) {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+
+	if lifecycle.draining {
+		return nil, errShuttingDown
+	}
+
+	lifecycle.pending.Add(1)
+
+	return lifecycle.pending.Done, nil
+}
+
+//download_aborted tells the write callbacks to stop the transfer
+func download_aborted() bool {
+	select {
+	case <-lifecycle.abort:
+		return true
+	default:
+		return false
+	}
+}
+
+//wait_pending waits for the registered work for at most timeout
+func wait_pending(timeout time.Duration) bool {
+	done := make(chan struct{})
+
+	go func() {
+		lifecycle.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+//close_websockets tells every client the server is going away and disconnects it
+func close_websockets() {
+	payload := make([]byte, 2, 2+len(errShuttingDown.Error()))
+	binary.BigEndian.PutUint16(payload, WS_CLOSE_GOING_AWAY)
+	payload = append(payload, errShuttingDown.Error()...)
+
+	ws_sessions.RLock()
+
+	var conns []websocket.Connection
+
+	for _, sessions := range ws_sessions.conns {
+		for _, c := range sessions {
+			conns = append(conns, c)
+		}
+	}
+
+	ws_sessions.RUnlock()
+
+	for _, c := range conns {
+		c.Write(WS_CLOSE_MESSAGE, payload)
+		c.Disconnect()
+	}
+}
+
+//flush_caches writes the pixel cache of loaded datasets that have none (e.g. after a purge)
+//and removes the temporary files of interrupted writes
+func flush_caches() {
+	datasets.RLock()
+	list := make([]*SubaruDataset, 0, len(datasets.subaru))
+
+	for _, subaru := range datasets.subaru {
+		list = append(list, subaru)
+	}
+
+	datasets.RUnlock()
+
+	for _, subaru := range list {
+		subaru.RLock()
+
+		if subaru.has_fits && !subaru.virtual && subaru.fits.mapping == nil {
+			if _, stats := pixel_cache_files(subaru.dataId); !file_exists(stats) {
+				if err := write_pixel_cache(subaru.dataId, &subaru.fits); err != nil {
+					dataset_logger(subaru.dataId).Warn("pixel cache not written", "error", err)
+				}
+			}
+		}
+
+		subaru.RUnlock()
+	}
+
+	for _, dir := range []string{VOTABLECACHE, FITSCACHE} {
+		tmpfiles, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+
+		for _, filename := range tmpfiles {
+			if err := os.Remove(filename); err == nil {
+				logger.Debug("temporary file removed", "file", filename)
+			}
+		}
+	}
+}
+
+//resume_partial reopens the checkpoint of an interrupted download for appending and reads it into buf,
+//without a checkpoint it starts an empty filename.tmp
+func resume_partial(filename string, buf *bytes.Buffer) (*os.File, error) {
+	partial := filename + ".partial"
+
+	if data, err := ioutil.ReadFile(partial); err == nil && os.Rename(partial, filename+".tmp") == nil {
+		buf.Write(data)
+
+		return os.OpenFile(filename+".tmp", os.O_WRONLY|os.O_APPEND, 0644)
+	}
+
+	return os.Create(filename + ".tmp")
+}
+
+//rangeCheck follows the response headers of a resumed download: a 206 must continue at the offset,
+//a 200 carries the whole file from the start so the checkpointed data is discarded
+type rangeCheck struct {
+	offset  int64
+	status  int
+	start   int64
+	checked bool
+}
+
+//header takes one header line, a redirect starts a new response
+func (r *rangeCheck) header(line string) {
+	if strings.HasPrefix(line, "HTTP/") {
+		r.status, r.start = 0, -1
+
+		if fields := strings.Fields(line); len(fields) > 1 {
+			r.status, _ = strconv.Atoi(fields[1])
+		}
+
+		return
+	}
+
+	if strings.HasPrefix(strings.ToLower(line), "content-range:") {
+		fmt.Sscanf(strings.TrimSpace(line[len("content-range:"):]), "bytes %d-", &r.start)
+	}
+}
+
+//restart is called with the first bytes of the body, it tells whether the checkpointed data must be discarded
+func (r *rangeCheck) restart() (bool, error) {
+	if r.checked || r.offset == 0 {
+		return false, nil
+	}
+
+	r.checked = true
+
+	switch r.status {
+	case 0:
+		//not HTTP, the transfer resumes as requested
+		return false, nil
+	case 206:
+		if r.start != r.offset {
+			return false, fmt.Errorf("the server resumed at byte %d instead of %d", r.start, r.offset)
+		}
+
+		return false, nil
+	case 200:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unexpected HTTP status %d", r.status)
+	}
+}
+
+func file_exists(filename string) bool {
+	_, err := os.Stat(filename)
+
+	return err == nil
+}
+
+//graceful_shutdown stops accepting new datasets, lets the downloads finish (or checkpoints them past the deadline),
+//closes the websockets, stops the HTTP server and flushes the caches
+func graceful_shutdown(app *iris.Application) {
+	lifecycle.Lock()
+	lifecycle.draining = true
+	lifecycle.Unlock()
+
+	logger.Info("waiting for the downloads in flight", "timeout", SHUTDOWN_TIMEOUT)
+
+	if !wait_pending(SHUTDOWN_TIMEOUT) {
+		logger.Warn("downloads still in flight, checkpointing them")
+		close(lifecycle.abort)
+
+		if !wait_pending(SHUTDOWN_ABORT_TIMEOUT) {
+			logger.Error("downloads did not stop in time")
+		}
+	}
+
+	close_websockets()
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_ABORT_TIMEOUT)
+	defer cancel()
+
+	if err := app.Shutdown(ctx); err != nil {
+		logger.Error("HTTP server shutdown", "error", err)
+	}
+
+	flush_caches()
+}
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/kataras/iris"
+)
+
+//source extraction defaults
+const DETECT_SIGMA = 3.0
+const DETECT_MINAREA = 5
+const DEBLEND_NTHRESH = 32
+
+//each deblending level rescans the object, more levels than this are refused
+const DEBLEND_MAX_NTHRESH = 64
+const DEBLEND_MINCONT = 0.005
+
+const SOURCE_FLAG_BLENDED = 1   //the object was deblended from a larger one
+const SOURCE_FLAG_EDGE = 2      //the object touches the image border
+const SOURCE_FLAG_MASKED = 4    //the object is next to NaN or IGNRVAL pixels
+const SOURCE_FLAG_SATURATED = 8 //the peak reaches SATURATE
+
+type Source struct {
+	Id          int      `json:"id"`
+	X           float64  `json:"x"` //FITS pixel coordinates of the flux-weighted centroid
+	Y           float64  `json:"y"`
+	RA          *float64 `json:"ra"`
+	Dec         *float64 `json:"dec"`
+	Flux        float64  `json:"flux"`
+	FluxErr     float64  `json:"flux_err"`
+	Peak        float64  `json:"peak"`
+	Area        int      `json:"area"` //[pixel]
+	A           float64  `json:"a"`    //semi-axes [pixel]
+	B           float64  `json:"b"`
+	Theta       float64  `json:"theta"` //[deg], counter-clockwise from the x axis
+	Ellipticity float64  `json:"ellipticity"`
+	FWHM        float64  `json:"fwhm"` //[pixel]
+	Flags       int      `json:"flags"`
+}
+
+type SourceCatalogue struct {
+	DataId    string   `json:"dataId"`
+	Threshold float64  `json:"threshold"` //[sigma]
+	MinArea   int      `json:"minarea"`
+	Scale     float64  `json:"scale"`
+	Sources   []Source `json:"sources"`
+}
+
+type detectOptions struct {
+	nsigma  float64
+	minarea int
+	mesh    int
+	nthresh int
+	mincont float64
+	mask    regionMask //only these pixels are searched, nil for the whole image
+}
+
+//a detected object: zero-based pixel indices and their background-subtracted values
+type detection struct {
+	pixels  []int
+	signal  []float32
+	blended bool
+}
+
+var neighbours8 = [8][2]int{{-1, -1}, {0, -1}, {1, -1}, {-1, 0}, {1, 0}, {-1, 1}, {0, 1}, {1, 1}}
+
+//label_components finds 8-connected groups of above-threshold pixels, removing those smaller than minarea
+func label_components(fits *FITS, signal []float32, above []bool, minarea int) []detection {
+	visited := make([]bool, len(above))
+	detections := make([]detection, 0)
+	stack := make([]int, 0, 1024)
+
+	for start := range above {
+		if !above[start] || visited[start] {
+			continue
+		}
+
+		var d detection
+		stack = append(stack[:0], start)
+		visited[start] = true
+
+		for len(stack) > 0 {
+			index := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			d.pixels = append(d.pixels, index)
+			d.signal = append(d.signal, signal[index])
+
+			x := index % fits.width
+			y := index / fits.width
+
+			for _, n := range neighbours8 {
+				nx, ny := x+n[0], y+n[1]
+
+				if nx < 0 || ny < 0 || nx >= fits.width || ny >= fits.height {
+					continue
+				}
+
+				ni := ny*fits.width + nx
+
+				if above[ni] && !visited[ni] {
+					visited[ni] = true
+					stack = append(stack, ni)
+				}
+			}
+		}
+
+		if len(d.pixels) >= minarea {
+			detections = append(detections, d)
+		}
+	}
+
+	return detections
+}
+
+//split_above finds the 8-connected parts of a detection brighter than the threshold
+//the result holds positions within d.pixels
+func split_above(fits *FITS, d *detection, threshold float32) [][]int {
+	position := make(map[int]int, len(d.pixels))
+
+	for i, index := range d.pixels {
+		if d.signal[i] > threshold {
+			position[index] = i
+		}
+	}
+
+	visited := make(map[int]bool, len(position))
+	parts := make([][]int, 0)
+
+	for i, index := range d.pixels {
+		if d.signal[i] <= threshold || visited[index] {
+			continue
+		}
+
+		part := make([]int, 0)
+		stack := []int{index}
+		visited[index] = true
+
+		for len(stack) > 0 {
+			current := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			part = append(part, position[current])
+
+			x := current % fits.width
+			y := current / fits.width
+
+			for _, n := range neighbours8 {
+				nx, ny := x+n[0], y+n[1]
+
+				if nx < 0 || ny < 0 || nx >= fits.width || ny >= fits.height {
+					continue
+				}
+
+				ni := ny*fits.width + nx
+
+				if _, ok := position[ni]; ok && !visited[ni] {
+					visited[ni] = true
+					stack = append(stack, ni)
+				}
+			}
+		}
+
+		parts = append(parts, part)
+	}
+
+	return parts
+}
+
+//assign_to_seeds grows the seed branches over the remaining pixels in decreasing order of signal (a watershed)
+func assign_to_seeds(fits *FITS, d *detection, seeds [][]int) []detection {
+	label := make(map[int]int, len(d.pixels))
+
+	for s, seed := range seeds {
+		for _, pos := range seed {
+			label[d.pixels[pos]] = s
+		}
+	}
+
+	order := make([]int, len(d.pixels))
+
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.Slice(order, func(i, j int) bool { return d.signal[order[i]] > d.signal[order[j]] })
+
+	signal_of := make(map[int]float32, len(d.pixels))
+
+	for i, index := range d.pixels {
+		signal_of[index] = d.signal[i]
+	}
+
+	for {
+		changed := false
+		pending := 0
+
+		for _, pos := range order {
+			index := d.pixels[pos]
+
+			if _, ok := label[index]; ok {
+				continue
+			}
+
+			x := index % fits.width
+			y := index / fits.width
+			best := -1
+			best_signal := float32(math.Inf(-1))
+
+			for _, n := range neighbours8 {
+				nx, ny := x+n[0], y+n[1]
+
+				if nx < 0 || ny < 0 || nx >= fits.width || ny >= fits.height {
+					continue
+				}
+
+				ni := ny*fits.width + nx
+
+				if l, ok := label[ni]; ok && signal_of[ni] > best_signal {
+					best = l
+					best_signal = signal_of[ni]
+				}
+			}
+
+			if best >= 0 {
+				label[index] = best
+				changed = true
+			} else {
+				pending++
+			}
+		}
+
+		if pending == 0 || !changed {
+			break
+		}
+	}
+
+	parts := make([]detection, len(seeds))
+
+	for i, index := range d.pixels {
+		l, ok := label[index]
+
+		if !ok {
+			continue
+		}
+
+		parts[l].pixels = append(parts[l].pixels, index)
+		parts[l].signal = append(parts[l].signal, d.signal[i])
+		parts[l].blended = true
+	}
+
+	return parts
+}
+
+//deblend applies multi-thresholding between the detection threshold and the peak
+func deblend(fits *FITS, d detection, opt detectOptions, level int) []detection {
+	var floor, peak, total float32 = float32(math.Inf(1)), float32(math.Inf(-1)), 0
+
+	for _, s := range d.signal {
+		if s < floor {
+			floor = s
+		}
+
+		if s > peak {
+			peak = s
+		}
+
+		total += s
+	}
+
+	if floor <= 0 || peak <= floor || opt.nthresh < 2 {
+		return []detection{d}
+	}
+
+	for k := level; k < opt.nthresh; k++ {
+		threshold := floor * float32(math.Pow(float64(peak/floor), float64(k)/float64(opt.nthresh)))
+
+		seeds := make([][]int, 0)
+
+		for _, part := range split_above(fits, &d, threshold) {
+			var flux float32
+
+			for _, pos := range part {
+				flux += d.signal[pos]
+			}
+
+			if float64(flux) > opt.mincont*float64(total) {
+				seeds = append(seeds, part)
+			}
+		}
+
+		if len(seeds) < 2 {
+			continue
+		}
+
+		result := make([]detection, 0)
+
+		for _, part := range assign_to_seeds(fits, &d, seeds) {
+			if len(part.pixels) < opt.minarea {
+				continue
+			}
+
+			for _, child := range deblend(fits, part, opt, k+1) {
+				child.blended = true
+				result = append(result, child)
+			}
+		}
+
+		if len(result) > 0 {
+			return result
+		}
+	}
+
+	return []detection{d}
+}
+
+func measure_source(fits *FITS, d detection, rms []float32, gain, saturate float64) Source {
+	var src Source
+
+	var sum, sx, sy float64
+	peak := math.Inf(-1)
+
+	for i, index := range d.pixels {
+		s := float64(d.signal[i])
+		x := float64(index%fits.width + 1)
+		y := float64(index/fits.width + 1)
+
+		if s > peak {
+			peak = s
+		}
+
+		if s > 0 {
+			sum += s
+			sx += s * x
+			sy += s * y
+		}
+	}
+
+	src.Area = len(d.pixels)
+	src.Peak = peak
+
+	if sum <= 0 {
+		return src
+	}
+
+	src.X = sx / sum
+	src.Y = sy / sum
+
+	var x2, y2, xy, flux, variance float64
+
+	for i, index := range d.pixels {
+		s := float64(d.signal[i])
+		dx := float64(index%fits.width+1) - src.X
+		dy := float64(index/fits.width+1) - src.Y
+
+		flux += s
+		variance += float64(rms[i]) * float64(rms[i])
+
+		if gain > 0 && s > 0 {
+			variance += s / gain
+		}
+
+		if s > 0 {
+			x2 += s * dx * dx
+			y2 += s * dy * dy
+			xy += s * dx * dy
+		}
+	}
+
+	x2 /= sum
+	y2 /= sum
+	xy /= sum
+
+	//a single pixel has no extent
+	x2 += 1.0 / 12.0
+	y2 += 1.0 / 12.0
+
+	t1 := 0.5 * (x2 + y2)
+	t2 := math.Sqrt(0.25*(x2-y2)*(x2-y2) + xy*xy)
+
+	src.A = math.Sqrt(t1 + t2)
+	src.B = math.Sqrt(math.Max(0, t1-t2))
+	src.Theta = 0.5 * math.Atan2(2*xy, x2-y2) * 180.0 / math.Pi
+	src.Ellipticity = 1.0 - src.B/src.A
+	src.FWHM = 2.0 * math.Sqrt(2.0*math.Ln2) * math.Sqrt(0.5*(src.A*src.A+src.B*src.B))
+	src.Flux = flux
+	src.FluxErr = math.Sqrt(variance)
+
+	if d.blended {
+		src.Flags |= SOURCE_FLAG_BLENDED
+	}
+
+	for _, index := range d.pixels {
+		x := index % fits.width
+		y := index / fits.width
+
+		if saturate > 0 && float64(fits.data[index]) >= saturate {
+			src.Flags |= SOURCE_FLAG_SATURATED
+		}
+
+		if x == 0 || y == 0 || x == fits.width-1 || y == fits.height-1 {
+			src.Flags |= SOURCE_FLAG_EDGE
+			continue
+		}
+
+		for _, n := range neighbours8 {
+			if !is_valid_pixel(fits, fits.data[(y+n[1])*fits.width+x+n[0]]) {
+				src.Flags |= SOURCE_FLAG_MASKED
+			}
+		}
+	}
+
+	if fits.wcs != nil {
+		if ra, dec, err := fits.wcs.PixelToSky(src.X, src.Y); err == nil {
+			src.RA, src.Dec = &ra, &dec
+		}
+	}
+
+	return src
+}
+
+func detect_sources(subaru *SubaruDataset, opt detectOptions) (SourceCatalogue, error) {
+	fits := &subaru.fits
+
+	if opt.nsigma <= 0 || opt.minarea < 1 {
+		return SourceCatalogue{}, errors.New("the threshold and the minimum area must be positive")
+	}
+
+	bg := make_background(fits, opt.mesh)
+
+	signal := make([]float32, len(fits.data))
+	noise := make([]float32, len(fits.data))
+	above := make([]bool, len(fits.data))
+
+	for j := 0; j < fits.height; j++ {
+		for i := 0; i < fits.width; i++ {
+			index := j*fits.width + i
+			value := fits.data[index]
+
+			if !is_valid_pixel(fits, value) || (opt.mask != nil && !opt.mask.has(index)) {
+				continue
+			}
+
+			level, rms := background_at(bg, i, j)
+			signal[index] = value - level
+			noise[index] = rms
+			above[index] = rms > 0 && float64(signal[index]) > opt.nsigma*float64(rms)
+		}
+	}
+
+	gain, _ := FITS_header_float(fits, "GAIN")
+	saturate, _ := FITS_header_float(fits, "SATURATE")
+
+	catalogue := SourceCatalogue{DataId: subaru.dataId, Threshold: opt.nsigma, MinArea: opt.minarea, Scale: pixel_scale(fits)}
+
+	for _, d := range label_components(fits, signal, above, opt.minarea) {
+		for _, object := range deblend(fits, d, opt, 1) {
+			object_noise := make([]float32, len(object.pixels))
+
+			for i, index := range object.pixels {
+				object_noise[i] = noise[index]
+			}
+
+			src := measure_source(fits, object, object_noise, gain, saturate)
+
+			if src.Flux > 0 {
+				catalogue.Sources = append(catalogue.Sources, src)
+			}
+		}
+	}
+
+	sort.Slice(catalogue.Sources, func(i, j int) bool { return catalogue.Sources[i].Flux > catalogue.Sources[j].Flux })
+
+	for i := range catalogue.Sources {
+		catalogue.Sources[i].Id = i + 1
+	}
+
+	return catalogue, nil
+}
+
+func source_catalogue_votable(catalogue SourceCatalogue) *VOTable {
+	t := &VOTable{Resource: catalogue.DataId, Name: "sources"}
+
+	t.Params = []VOParam{
+		{Name: "threshold", Datatype: "double", Unit: "sigma", Value: fmt.Sprintf("%g", catalogue.Threshold)},
+		{Name: "minarea", Datatype: "int", Unit: "pix", Value: fmt.Sprintf("%d", catalogue.MinArea)},
+		{Name: "scale", Datatype: "double", Unit: "arcsec/pix", Value: fmt.Sprintf("%g", catalogue.Scale)},
+	}
+
+	t.Fields = []VOField{
+		{Name: "id", Datatype: "int", UCD: "meta.id;meta.main"},
+		{Name: "x", Datatype: "double", Unit: "pix", UCD: "pos.cartesian.x;instr.det"},
+		{Name: "y", Datatype: "double", Unit: "pix", UCD: "pos.cartesian.y;instr.det"},
+		{Name: "ra", Datatype: "double", Unit: "deg", UCD: "pos.eq.ra;meta.main"},
+		{Name: "dec", Datatype: "double", Unit: "deg", UCD: "pos.eq.dec;meta.main"},
+		{Name: "flux", Datatype: "double", Unit: "ct", UCD: "phot.count"},
+		{Name: "flux_err", Datatype: "double", Unit: "ct", UCD: "stat.error;phot.count"},
+		{Name: "peak", Datatype: "double", Unit: "ct", UCD: "phot.count;stat.max"},
+		{Name: "area", Datatype: "int", Unit: "pix", UCD: "phys.area"},
+		{Name: "a", Datatype: "double", Unit: "pix", UCD: "phys.size.smajAxis"},
+		{Name: "b", Datatype: "double", Unit: "pix", UCD: "phys.size.sminAxis"},
+		{Name: "theta", Datatype: "double", Unit: "deg", UCD: "pos.posAng"},
+		{Name: "ellipticity", Datatype: "double", UCD: "src.ellipticity"},
+		{Name: "fwhm", Datatype: "double", Unit: "pix", UCD: "phys.size.diameter"},
+		{Name: "flags", Datatype: "int", UCD: "meta.code"},
+	}
+
+	for _, s := range catalogue.Sources {
+		t.Rows = append(t.Rows, []interface{}{s.Id, s.X, s.Y, s.RA, s.Dec, s.Flux, s.FluxErr, s.Peak, s.Area, s.A, s.B, s.Theta, s.Ellipticity, s.FWHM, s.Flags})
+	}
+
+	return t
+}
+
+//GET /subaruwebql/sources?dataId=...[&nsigma=3][&minarea=5][&mesh=64][&nthresh=32][&mincont=0.005][&format=votable]
+//[&regions=session] restricts the search to the stored regions of a session
+func sources_handler(ctx iris.Context) {
+	subaru, ok := loaded_dataset_or_fail(ctx)
+
+	if !ok {
+		return
+	}
+
+	opt := detectOptions{nsigma: DETECT_SIGMA, minarea: DETECT_MINAREA, mesh: BACK_SIZE, nthresh: DEBLEND_NTHRESH, mincont: DEBLEND_MINCONT}
+
+	if v, ok := form_float(ctx, "nsigma"); ok {
+		opt.nsigma = v
+	}
+
+	if v, ok := form_float(ctx, "mincont"); ok {
+		opt.mincont = v
+	}
+
+	opt.minarea = form_int(ctx, "minarea", opt.minarea)
+	opt.mesh = form_int(ctx, "mesh", opt.mesh)
+	opt.nthresh = form_int(ctx, "nthresh", opt.nthresh)
+
+	if opt.nthresh > DEBLEND_MAX_NTHRESH {
+		http_error(ctx, iris.StatusBadRequest, fmt.Errorf("nthresh exceeds %d", DEBLEND_MAX_NTHRESH))
+		return
+	}
+
+	if session := strings.TrimSpace(ctx.FormValue("regions")); session != "" {
+		mask, err := region_set_mask(&subaru.fits, get_region_set(subaru, session))
+
+		if err != nil {
+			http_error(ctx, iris.StatusBadRequest, err)
+			return
+		}
+
+		opt.mask = mask
+	}
+
+	catalogue, err := detect_sources(subaru, opt)
+
+	if err != nil {
+		http_error(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	if ctx.FormValue("format") == "votable" {
+		ctx.Header("Content-Disposition", "attachment; filename=\""+subaru.dataId+"_sources.xml\"")
+	}
+
+	send_table(ctx, catalogue, func() *VOTable { return source_catalogue_votable(catalogue) })
+}
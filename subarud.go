@@ -15,8 +15,12 @@ import (
 	"strconv"
 	"encoding/xml"
 	"compress/gzip"
+	"os/signal"
+	"syscall"
+	"log/slog"
 	"github.com/kataras/iris"
 	curl "github.com/andelf/go-curl"	
+	"github.com/jvo203/SubaruWebQL/wcs"
 )
 
 
@@ -40,6 +44,9 @@ type downloadChunk struct {
 	//zlib
 	gzip bool
 	buf bytes.Buffer
+	//a resumed download must continue at the checkpoint
+	resumed rangeCheck
+	err error
 }
 
 const NBINS = 1024
@@ -49,7 +56,9 @@ type FITS struct {
 	NAXIS int
 	width int
 	height int
+	depth int
 	data []float32
+	cube []float32
 	IGNRVAL float32
 	CRVAL1 float32
 	CDELT1 float32
@@ -69,6 +78,9 @@ type FITS struct {
 	black float32
 	sensitivity float32
 	rgb []byte
+	header []string
+	wcs *wcs.WCS
+	mapping []byte
 }
 
 type SubaruDataset struct {	
@@ -106,21 +118,28 @@ type SubaruDataset struct {
 	timestamp time.Time
 	sync.RWMutex
 	fits FITS
+	has_fits bool
+	background *BackgroundLayers
+	background_lock sync.Mutex
+	virtual bool
+	regions map[string][]RegionItem
+	exposure *Exposure
+	holders int
+	retired bool
+	votable_ready chan struct{}
+	votable_err error
 	/*
   sem_t sem_votable ;
   bool has_votable ;
   sem_t sem_fits ;
-  bool has_fits ;
   SubaruFITS* fits ;
   sem_t sem_sessions ;*/
 }
 
 var datasets = struct{
     sync.RWMutex
-    subaru map[string] SubaruDataset
-}{subaru: make(map[string] SubaruDataset)}
-
-var easy *curl.CURL
+    subaru map[string] *SubaruDataset
+}{subaru: make(map[string] *SubaruDataset)}
 
 func round(f float64) float64 {
     return math.Floor(f + .5)
@@ -279,7 +298,13 @@ func parseXMLVOTable(subaru *SubaruDataset, fp *os.File) {
 		return true
 	})
 
-	fmt.Printf("%+v\n", subaru)
+	dataset_logger(subaru.dataId).Debug("VOTable parsed", "title", subaru.title, "date_obs", subaru.date_obs,
+		"band", subaru.band_name, "ra", subaru.ra, "dec", subaru.dec, "file_size", subaru.file_size, "file_url", subaru.file_url)
+}
+
+//default_votable_url queries the archive for a single frame
+func default_votable_url(dataId string) string {
+	return "http://" + VOTABLESERVER + ":8060/skynode/do/tap/spcam/sync?REQUEST=queryData&QUERY=SELECT%20*%20FROM%20image_nocut%20WHERE%20data_id%20='" + dataId + "'"
 }
 
 func subaru_votable(subaru *SubaruDataset, votable string) {	
@@ -288,6 +313,8 @@ func subaru_votable(subaru *SubaruDataset, votable string) {
 	xmlfile, err := os.Open(filename)
 	defer xmlfile.Close()
 
+	count_cache("votable", err == nil)
+
 	if err != nil {
 
 		tmpfile, err := os.Create(filename+".tmp")
@@ -297,14 +324,21 @@ func subaru_votable(subaru *SubaruDataset, votable string) {
 			panic(err)
 		}
 
-		if len(strings.TrimSpace(votable)) > 0 {
-			easy.Setopt(curl.OPT_URL, votable)
-		} else {			
-			url := "http://" + VOTABLESERVER + ":8060/skynode/do/tap/spcam/sync?REQUEST=queryData&QUERY=SELECT%20*%20FROM%20image_nocut%20WHERE%20data_id%20='" + subaru.dataId + "'"
-			//fmt.Printf("%s\n",url)
-			easy.Setopt(curl.OPT_URL, url)
+		url := votable
+
+		if len(strings.TrimSpace(votable)) == 0 {
+			url = default_votable_url(subaru.dataId)
 		}
 
+		//concurrent downloads need their own handles
+		easy := curl.EasyInit()
+		defer easy.Cleanup()
+
+		//fmt.Printf("%s\n",url)
+		easy.Setopt(curl.OPT_URL, url)
+
+		var received int64
+
 		// make a callback function
 		writeFile := func (buf []byte, userdata interface{}) bool {
 			/*println("DEBUG: size=>", len(buf))
@@ -316,6 +350,8 @@ func subaru_votable(subaru *SubaruDataset, votable string) {
 			if _, err := file.Write(buf) ; err != nil {
 				panic(err)
 			}
+
+			received += int64(len(buf))
 			
 			return true
 		}
@@ -323,8 +359,13 @@ func subaru_votable(subaru *SubaruDataset, votable string) {
 		easy.Setopt(curl.OPT_WRITEFUNCTION, writeFile)
 		easy.Setopt(curl.OPT_WRITEDATA, tmpfile)
 
-		if err := easy.Perform(); err != nil {
-			fmt.Printf("ERROR: %+v\n", err)
+		start := time.Now()
+		err = easy.Perform()
+		count_download(url, received, start, err)
+
+		if err != nil {
+			dataset_logger(subaru.dataId).Error("VOTable download failed", "url", url, "error", err)
+			os.Remove(filename+".tmp")
 			panic(err)
 		} else {
 			os.Rename(filename+".tmp", filename)
@@ -344,9 +385,6 @@ func subaru_votable(subaru *SubaruDataset, votable string) {
 }
 
 func read_FITS_bytes(buf []byte, offset int, dest []float32) {
-
-	fmt.Println("len(slice):", len(buf))
-	
 	pos := 0
 	n := len(buf) / 4
 	
@@ -356,21 +394,19 @@ func read_FITS_bytes(buf []byte, offset int, dest []float32) {
 		float := math.Float32frombits(bits)
 		dest[offset+i] = float
 		pos += 4
-
-		if(i > n - 4) {
-			fmt.Println("bytes:", floatBuf, "float:", dest[offset+i])
-		}
 	}
 }
 
-func read_FITS_from_buffer(subaru *SubaruDataset, buffer *bytes.Buffer) {
-	fmt.Println("FITS buffer length:", buffer.Len())
-
+//read_FITS_header parses the header cards up to END and skips the padding, returning the header length
+func read_FITS_header(fits *FITS, buffer *bytes.Buffer) int {
 	//read the header first
 	hdrLine := make([]byte, FITS_LINE_LENGTH)
 	total := 0
 	fitsLen := buffer.Len()
 	hend := false	
+	fits.IGNRVAL = -math.MaxFloat32
+	fits.header = nil
+	fits.depth = 1
 
 	for total < fitsLen && !hend {
 		count, _ := buffer.Read(hdrLine)
@@ -382,81 +418,72 @@ func read_FITS_from_buffer(subaru *SubaruDataset, buffer *bytes.Buffer) {
 
 		if(strings.Contains(s, "END       ")) {
 			hend = true
+		} else {
+			fits.header = append(fits.header, s)
 		}
 
 		if(strings.Contains(s, "BITPIX  = ")) {
-			fmt.Println(s[10:])
-			fmt.Sscanf(s[10:], "%d", &subaru.fits.BITPIX)
+			fmt.Sscanf(s[10:], "%d", &fits.BITPIX)
 		}
 
 		if(strings.Contains(s, "NAXIS   = ")) {
-			fmt.Println(s[10:])
-			fmt.Sscanf(s[10:], "%d", &subaru.fits.NAXIS)
+			fmt.Sscanf(s[10:], "%d", &fits.NAXIS)
 		}
 
 		if(strings.Contains(s, "NAXIS1  = ")) {
-			fmt.Println(s[10:])
-			fmt.Sscanf(s[10:], "%d", &subaru.fits.width)
+			fmt.Sscanf(s[10:], "%d", &fits.width)
 		}
 
 		if(strings.Contains(s, "NAXIS2  = ")) {
-			fmt.Println(s[10:])
-			fmt.Sscanf(s[10:], "%d", &subaru.fits.height)
+			fmt.Sscanf(s[10:], "%d", &fits.height)
+		}
+
+		if(strings.Contains(s, "NAXIS3  = ")) {
+			fmt.Sscanf(s[10:], "%d", &fits.depth)
 		}
 
 		if(strings.Contains(s, "IGNRVAL = ")) {
-			fmt.Println(s[10:])
-			fmt.Sscanf(s[10:], "%f", &subaru.fits.IGNRVAL)
+			fmt.Sscanf(s[10:], "%f", &fits.IGNRVAL)
 		}
 
 		if(strings.Contains(s, "CRVAL1  = ")) {
-			fmt.Println(s[10:])
-			fmt.Sscanf(s[10:], "%f", &subaru.fits.CRVAL1)
+			fmt.Sscanf(s[10:], "%f", &fits.CRVAL1)
 		}
 
 		if(strings.Contains(s, "CDELT1  = ")) {
-			fmt.Println(s[10:])
-			fmt.Sscanf(s[10:], "%f", &subaru.fits.CDELT1)
+			fmt.Sscanf(s[10:], "%f", &fits.CDELT1)
 		}
 
 		if(strings.Contains(s, "CRPIX1  = ")) {
-			fmt.Println(s[10:])
-			fmt.Sscanf(s[10:], "%f", &subaru.fits.CRPIX1)
+			fmt.Sscanf(s[10:], "%f", &fits.CRPIX1)
 		}
 
 		if(strings.Contains(s, "CRVAL2  = ")) {
-			fmt.Println(s[10:])
-			fmt.Sscanf(s[10:], "%f", &subaru.fits.CRVAL2)
+			fmt.Sscanf(s[10:], "%f", &fits.CRVAL2)
 		}
 
 		if(strings.Contains(s, "CDELT2  = ")) {
-			fmt.Println(s[10:])
-			fmt.Sscanf(s[10:], "%f", &subaru.fits.CDELT2)
+			fmt.Sscanf(s[10:], "%f", &fits.CDELT2)
 		}
 
 		if(strings.Contains(s, "CRPIX2  = ")) {
-			fmt.Println(s[10:])
-			fmt.Sscanf(s[10:], "%f", &subaru.fits.CRPIX2)
+			fmt.Sscanf(s[10:], "%f", &fits.CRPIX2)
 		}
 
 		if(strings.Contains(s, "CD1_1   = ")) {
-			fmt.Println(s[10:])
-			fmt.Sscanf(s[10:], "%f", &subaru.fits.CD1_1)
+			fmt.Sscanf(s[10:], "%f", &fits.CD1_1)
 		}
 
 		if(strings.Contains(s, "CD1_2   = ")) {
-			fmt.Println(s[10:])
-			fmt.Sscanf(s[10:], "%f", &subaru.fits.CD1_2)
+			fmt.Sscanf(s[10:], "%f", &fits.CD1_2)
 		}
 
 		if(strings.Contains(s, "CD2_1   = ")) {
-			fmt.Println(s[10:])
-			fmt.Sscanf(s[10:], "%f", &subaru.fits.CD2_1)			
+			fmt.Sscanf(s[10:], "%f", &fits.CD2_1)			
 		}
 
 		if(strings.Contains(s, "CD2_2   = ")) {
-			fmt.Println(s[10:])
-			fmt.Sscanf(s[10:], "%f", &subaru.fits.CD2_2)
+			fmt.Sscanf(s[10:], "%f", &fits.CD2_2)
 		}
 	}
 
@@ -471,18 +498,32 @@ func read_FITS_from_buffer(subaru *SubaruDataset, buffer *bytes.Buffer) {
 		_, _ = buffer.Read(dummy)
 	}	
 
-	fmt.Println("FITS HEADER LENGTH:", offset, "total:", total, "rem:", rem)
-	fmt.Println("data size:", subaru.fits.width*subaru.fits.height*4)
-	fmt.Printf("%+v\n", subaru.fits)
+	//AKARI spectral products and IFU data carry a third axis
+	if(fits.NAXIS < 3 || fits.depth < 1) {
+		fits.depth = 1
+	}
+
+	return offset
+}
+
+//decode_FITS parses the header, converts the pixels and computes the statistics, shared with the command line
+//it panics on unsupported or truncated files like the rest of the reader
+func decode_FITS(fits *FITS, buffer *bytes.Buffer, log *slog.Logger) {
+	length := buffer.Len()
+	offset := read_FITS_header(fits, buffer)
 
-	if(subaru.fits.BITPIX != -32) {
+	log.Debug("FITS header read", "bytes", length, "header_length", offset, "bitpix", fits.BITPIX,
+		"width", fits.width, "height", fits.height, "depth", fits.depth)
+
+	if(fits.BITPIX != -32) {
 		panic(errors.New("UNSUPPORTED BITPIX"))
 	}
 
+	fits.wcs = make_FITS_wcs(fits.header)
+
 	//FITS DATA BEGINS AT buffer.Bytes()[offset:]
 	//need to convert from BIG-ENDIAN to LITTLE-ENDIAN and []byte to float32
 	src := buffer.Bytes()
-	fmt.Println("src buffer length:", len(src))	
 
 	//first read the remaining part of the FITS HEADER in one go
 	//then buffer.Bytes() will point to the remaining unread data (FITS DATA + padding)
@@ -490,8 +531,8 @@ func read_FITS_from_buffer(subaru *SubaruDataset, buffer *bytes.Buffer) {
 	//it might be better to stick with C/C++ or use Rust
 	//But after trying Rust a bit, Rust seems too strict, too convoluted
 	
-	total_size := subaru.fits.width*subaru.fits.height
-	subaru.fits.data = make([]float32, total_size)
+	total_size := fits.width*fits.height*fits.depth
+	fits.data = make([]float32, total_size)
 	
 	/*
 floatBuf := make([]byte, 4)//four bytes in float32
@@ -499,25 +540,176 @@ for i := 0; i < total_size; i++ {
 		_, _ = buffer.Read(floatBuf)
 		bits := binary.BigEndian.Uint32(floatBuf)
 		float := math.Float32frombits(bits)
-		subaru.fits.data[i] = float
+		fits.data[i] = float
 
 		if(i > total_size - 10) {
 			fmt.Println("bytes:", floatBuf, "float:", float)
 		}
 	}*/
 
-	//take slices of src
-	//process them in parallel
-	//read_FITS_bytes(src, 0, subaru.fits.data)
+	if(len(src) < 4*total_size) {
+		panic(errors.New("TRUNCATED FITS DATA"))
+	}
+
+	//convert in parallel, chunks are whole pixels and the data is complete once parallel_for returns
+	data := fits.data
 
-	go read_FITS_bytes(src[0:4*total_size/2], 0, subaru.fits.data)
-	go read_FITS_bytes(src[4*total_size/2:4*total_size], total_size/2, subaru.fits.data)	
-	
-	fmt.Println("subaru_fits_thread finished.")
+	parallel_for(total_size, PARALLEL_GRAIN, func(chunk, start, end int) {
+		read_FITS_bytes(src[4*start:4*end], start, data)
+	})
+
+	//a cube is displayed through its mean plane
+	if(fits.depth > 1) {
+		fits.cube = fits.data
+		fits.data = cube_mean_plane(fits)
+	}
+
+	make_image_statistics(fits)
+}
+
+func read_FITS_from_buffer(subaru *SubaruDataset, buffer *bytes.Buffer) {
+	log := dataset_logger(subaru.dataId)
+	start := time.Now()
+
+	defer metrics.decode_seconds.since(metric_labels("source", "fits"), start)
+
+	decode_FITS(&subaru.fits, buffer, log)
+
+	subaru.Lock()
+	subaru.has_fits = true
+	subaru.Unlock()
+
+	send_image_info_notification(subaru)
+
+	//the next load maps the decoded pixels instead, during a shutdown flush_caches writes it
+	if done, err := begin_cache_io(); err == nil {
+		if err := write_pixel_cache(subaru.dataId, &subaru.fits); err != nil {
+			log.Warn("pixel cache not written", "error", err)
+		}
+
+		done()
+	}
+
+	log.Info("dataset loaded", "width", subaru.fits.width, "height", subaru.fits.height, "depth", subaru.fits.depth, "duration", time.Since(start))
+}
+
+//parse_FITS_card splits a header card into the keyword and its value, string values are unquoted and comments removed
+func parse_FITS_card(card string) (string, string, bool) {
+	if(len(card) < 10 || card[8:10] != "= ") {
+		return "", "", false
+	}
+
+	key := strings.TrimSpace(card[0:8])
+	value := strings.TrimSpace(card[10:])
+
+	if(strings.HasPrefix(value, "'")) {
+		//a quoted string, '' stands for a single quote
+		var str strings.Builder
+
+		for i := 1; i < len(value); i++ {
+			if(value[i] == '\'') {
+				if(i+1 < len(value) && value[i+1] == '\'') {
+					str.WriteByte('\'')
+					i++
+					continue
+				}
+
+				break
+			}
+
+			str.WriteByte(value[i])
+		}
+
+		return key, strings.TrimRight(str.String(), " "), true
+	}
+
+	if pos := strings.Index(value, "/"); pos >= 0 {
+		value = strings.TrimSpace(value[:pos])
+	}
+
+	return key, value, true
+}
+
+//FITS_header_value looks a keyword up in the primary header
+func FITS_header_value(fits *FITS, keyword string) (string, bool) {
+	for _, card := range fits.header {
+		if key, value, ok := parse_FITS_card(card); ok && key == keyword {
+			return value, true
+		}
+	}
+
+	return "", false
+}
+
+func FITS_header_float(fits *FITS, keyword string) (float64, bool) {
+	value, ok := FITS_header_value(fits, keyword)
+
+	if(!ok) {
+		return 0, false
+	}
+
+	f, err := strconv.ParseFloat(strings.Replace(value, "D", "E", 1), 64)
+
+	if(err != nil) {
+		return 0, false
+	}
+
+	return f, true
+}
+
+func make_FITS_wcs(header []string) *wcs.WCS {
+	hdr := make(wcs.Header)
+
+	for _, card := range header {
+		if key, value, ok := parse_FITS_card(card); ok {
+			hdr[key] = value
+		}
+	}
+
+	world, err := wcs.New(hdr)
+
+	if(err != nil) {
+		logger.Warn("no usable WCS", "error", err)
+		return nil
+	}
+
+	return world
 }
 
 func read_FITS_from_file(subaru *SubaruDataset, fp *os.File) {
-	fmt.Println("reading FITS file for", subaru.dataId)
+	log := dataset_logger(subaru.dataId)
+	log.Debug("reading FITS file", "file", fp.Name())
+
+	start := time.Now()
+	fits, err := open_pixel_cache(subaru.dataId, fp)
+
+	count_cache("pixels", err == nil)
+
+	if err == nil {
+		metrics.decode_seconds.since(metric_labels("source", "pixels"), start)
+
+		subaru.Lock()
+		subaru.fits = fits
+		subaru.has_fits = true
+
+		//evicted while loading
+		if(subaru.retired && subaru.holders == 0) {
+			unmap_dataset(subaru)
+		}
+
+		subaru.Unlock()
+
+		send_image_info_notification(subaru)
+
+		log.Info("dataset loaded from the pixel cache", "width", fits.width, "height", fits.height, "depth", fits.depth, "duration", time.Since(start))
+		return
+	}
+
+	log.Debug("pixel cache unavailable", "error", err)
+
+	if _, err := fp.Seek(0, 0); err != nil {
+		panic(err)
+	}
 
 	// get the file size
 	stat, err := fp.Stat()
@@ -530,28 +722,66 @@ func read_FITS_from_file(subaru *SubaruDataset, fp *os.File) {
 	if(err != nil) {
 		panic(err)
 	} else {
-		fmt.Println("uncompressed size:", len(buf), "file size:", stat.Size())
+		log.Debug("FITS file read", "bytes", len(buf), "file_size", stat.Size())
 
 		read_FITS_from_buffer(subaru, bytes.NewBuffer(buf))
 	}
 }
 
+//recover_dataset is deferred by the goroutines loading a dataset: a panic of the readers is logged
+//and the dataset forgotten instead of bringing the server down
+func recover_dataset(subaru *SubaruDataset) {
+	if r := recover(); r != nil {
+		dataset_logger(subaru.dataId).Error("dataset not loaded", "error", r)
+		drop_failed_dataset(subaru)
+	}
+}
+
 func subaru_fits_thread(subaru *SubaruDataset) {	
+	defer recover_dataset(subaru)
+
 	filename := FITSCACHE + "/" + subaru.dataId + ".fits"
 	
 	fitsfile, err := os.Open(filename)
 	defer fitsfile.Close()
 
+	count_cache("fits", err == nil)
+
 	if err != nil {
-		tmpfile, err := os.Create(filename+".tmp")
+		log := dataset_logger(subaru.dataId)
+
+		done, err := begin_cache_io()
+
+		if(err != nil) {
+			log.Info("FITS download not started", "error", err)
+			return
+		}
+
+		defer done()
+
+		chunk := downloadChunk{previous_size: 0, size: 0, subaru: subaru, gzip: false}
+
+		//a download checkpointed by a shutdown is resumed
+		tmpfile, err := resume_partial(filename, &chunk.buf)
 		defer tmpfile.Close()
 
 		if(err != nil) {
 			panic(err)
 		}
 
-		fmt.Printf("subaru_fits_thread: %s\n", subaru.file_url)
+		chunk.fp = tmpfile
+		chunk.size = int64(chunk.buf.Len())
+		chunk.previous_size = chunk.size
+		offset := chunk.size
+		chunk.resumed.offset = offset
+
+		log.Info("downloading FITS file", "url", subaru.file_url, "file_size", subaru.file_size, "resume_from", offset)
+
+		easy := curl.EasyInit()
+		defer easy.Cleanup()
+
 		easy.Setopt(curl.OPT_URL, subaru.file_url)
+		easy.Setopt(curl.OPT_RESUME_FROM_LARGE, offset)
 
 		// make callback functions		
 		header_callback := func (buf []byte, userdata interface{}) bool {
@@ -560,6 +790,7 @@ func subaru_fits_thread(subaru *SubaruDataset) {
 
 			header := string(buf)
 			chunk := userdata.(*downloadChunk)			
+			chunk.resumed.header(header)
 
 			if(strings.Contains(header, "gzip") || strings.Contains(header, ".fits.gz")) {
 				chunk.gzip = true
@@ -576,6 +807,29 @@ func subaru_fits_thread(subaru *SubaruDataset) {
 			//subaru := chunk.subaru			
 			file := chunk.fp			
 
+			//returning false stops the transfer
+			if(download_aborted()) {
+				return false
+			}
+
+			restart, err := chunk.resumed.restart()
+
+			if(err != nil) {
+				chunk.err = err
+				return false
+			}
+
+			//the server sent the whole file instead of the rest
+			if(restart) {
+				if err := file.Truncate(0) ; err != nil {
+					chunk.err = err
+					return false
+				}
+
+				chunk.buf.Reset()
+				chunk.size, chunk.previous_size, offset = 0, 0, 0
+			}
+
 			//append buf to chunk.buf
 			chunk.buf.Write(buf)
 			
@@ -592,28 +846,55 @@ func subaru_fits_thread(subaru *SubaruDataset) {
 
 			if( (chunk.size - chunk.previous_size) >= int64(NOTIFICATION_CHUNK)) {
 				chunk.previous_size = chunk.size
-				//send_progress_notification(subaru.dataId, chunk.size, chunk.progress)
+				send_progress_notification(subaru.dataId, chunk.size, chunk.progress)
 			}
 			
 			return true
 		}		
 
-		chunk := downloadChunk{fp: tmpfile, previous_size: 0, size: 0, subaru: subaru, gzip: false}
-		
 		easy.Setopt(curl.OPT_WRITEFUNCTION, writeFile)
 		easy.Setopt(curl.OPT_WRITEDATA, &chunk)
 
 		easy.Setopt(curl.OPT_HEADERFUNCTION, header_callback)
 		easy.Setopt(curl.OPT_HEADERDATA, &chunk)		
 
-		if err := easy.Perform(); err != nil {
-			fmt.Printf("ERROR: %+v\n", err)
-			panic(err)
+		start := time.Now()
+		err = easy.Perform()
+
+		if(chunk.err != nil) {
+			err = chunk.err
+		}
+
+		count_download(subaru.file_url, chunk.size - offset, start, err)
+
+		if(err != nil && download_aborted()) {
+			tmpfile.Close()
+
+			//gzip data only reaches the disk once uncompressed
+			if(chunk.gzip) {
+				os.Remove(filename+".tmp")
+			} else {
+				os.Rename(filename+".tmp", filename+".partial")
+				log.Info("FITS download checkpointed", "bytes", chunk.size)
+			}
+
+			return
+		}
+
+		if err != nil {
+			log.Error("FITS download failed", "url", subaru.file_url, "error", err)
+			os.Remove(filename+".tmp")
+			drop_failed_dataset(subaru)
+			return
 		} else {
-			fmt.Println("len(chunk.buf):", chunk.buf.Len())
+			log.Debug("FITS download complete", "bytes", chunk.buf.Len(), "gzip", chunk.gzip, "duration", time.Since(start))
 
+			//the next request downloads the file again
 			if(int64(chunk.buf.Len()) != subaru.file_size) {
-				panic(errors.New("received wrong amount of data"))
+				log.Error("received wrong amount of data", "bytes", chunk.buf.Len(), "file_size", subaru.file_size)
+				os.Remove(filename+".tmp")
+				drop_failed_dataset(subaru)
+				return
 			}
 			
 			if(chunk.gzip) {				
@@ -629,9 +910,12 @@ func subaru_fits_thread(subaru *SubaruDataset) {
 					if(err != nil) {
 						panic(err)
 					} else {
-						fmt.Println("uncompressed size:", len(buf))
+						log.Debug("FITS file uncompressed", "bytes", len(buf))
 
-						go read_FITS_from_buffer(subaru, bytes.NewBuffer(buf))
+						go func(buffer *bytes.Buffer) {
+							defer recover_dataset(subaru)
+							read_FITS_from_buffer(subaru, buffer)
+						}(bytes.NewBuffer(buf))
 
 						// write a chunk to disk	
 						if _, err := tmpfile.Write(buf) ; err != nil {
@@ -640,7 +924,10 @@ func subaru_fits_thread(subaru *SubaruDataset) {
 					}										
 				}
 			} else {								
-				go read_FITS_from_buffer(subaru, &chunk.buf)
+				go func() {
+					defer recover_dataset(subaru)
+					read_FITS_from_buffer(subaru, &chunk.buf)
+				}()
 			}
 			
 			os.Rename(filename+".tmp", filename)						
@@ -650,15 +937,24 @@ func subaru_fits_thread(subaru *SubaruDataset) {
 	}
 }
 
-func launch_subaru(dataId, votable string) SubaruDataset {
-	datasets.RLock()
+//launch_subaru returns the dataset, loading it first when needed; no new datasets are accepted during a shutdown
+//the dataset is registered before its VOTable is read so that concurrent requests wait for it instead of loading it again
+func launch_subaru(dataId, votable string) (*SubaruDataset, error) {
+	//the dataId names the cache files and is pasted into the archive query
+	if(!safe_dataId.MatchString(dataId)) {
+		return nil, fmt.Errorf("%w '%s'", errInvalidDataId, dataId)
+	}
+
+	datasets.Lock()
 	subaru, ok := datasets.subaru[dataId]
-	datasets.RUnlock()
-	
+
 	if(!ok) {
-		fmt.Printf("no dataset found, creating a new one\n")
+		if err := accepting_datasets(); err != nil {
+			datasets.Unlock()
+			return nil, err
+		}
 
-		var subaru SubaruDataset
+		subaru = new(SubaruDataset)
 
 		subaru.dataId = dataId
 		subaru.current_pos = -1
@@ -677,23 +973,56 @@ func launch_subaru(dataId, votable string) SubaruDataset {
 		subaru.file_path_pos = -1
 		subaru.file_url_pos = -1
 		subaru.timestamp = time.Now()
+		subaru.votable_ready = make(chan struct{})
 
-		subaru_votable(&subaru, votable)		
-		
-		datasets.Lock()
 		datasets.subaru[dataId] = subaru
-		datasets.Unlock()
+	}
+
+	datasets.Unlock()
+
+	if(ok) {
+		//virtual datasets have no VOTable
+		if(subaru.votable_ready != nil) {
+			<-subaru.votable_ready
+		}
 
-		go subaru_fits_thread(&subaru)
+		if(subaru.votable_err != nil) {
+			return nil, subaru.votable_err
+		}
 
-		return subaru
-	} else {		
 		subaru.Lock()
 		subaru.timestamp = time.Now()
 		subaru.Unlock()
 
-		return subaru
-	}		
+		return subaru, nil
+	}
+
+	dataset_logger(dataId).Info("creating dataset")
+
+	if err := load_votable(subaru, votable); err != nil {
+		drop_failed_dataset(subaru)
+		return nil, err
+	}
+
+	go subaru_fits_thread(subaru)
+
+	return subaru, nil
+}
+
+//load_votable reads the metadata of a new dataset and releases the requests waiting for it, the readers panic on failures
+func load_votable(subaru *SubaruDataset, votable string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("the VOTable of %s could not be read: %v", subaru.dataId, r)
+		}
+
+		subaru.votable_err = err
+		close(subaru.votable_ready)
+	}()
+
+	subaru_votable(subaru, votable)
+
+	return nil
 }
 
 func execute_subaru(dataId, votable string) (strings.Builder, error) {
@@ -710,8 +1039,13 @@ func execute_subaru(dataId, votable string) (strings.Builder, error) {
 		buffer.WriteString("</p>")
 		buffer.WriteString("</h1>")*/
 
-		subaru := launch_subaru(dataId, votable)
-		fmt.Printf("dataId: %s\ttimestamp: %s\n", subaru.dataId, subaru.timestamp.String())
+		subaru, err := launch_subaru(dataId, votable)
+
+		if(err != nil) {
+			return buffer, err
+		}
+
+		dataset_logger(subaru.dataId).Debug("dataset requested", "timestamp", subaru.timestamp)
 
 		buffer.WriteString("<!DOCTYPE html>\n<html xmlns:xlink=\"http://www.w3.org/1999/xlink\">\n<head>\n<meta charset=\"utf-8\">\n")
 		buffer.WriteString("<link rel=\"stylesheet\" type=\"text/css\" href=\"http://fonts.googleapis.com/css?family=Inconsolata\">\n")//Orbitron
@@ -732,7 +1066,7 @@ func execute_subaru(dataId, votable string) (strings.Builder, error) {
 
 		buffer.WriteString("<title>SubaruWebQL</title></head><body>\n")
 		
-		buffer.WriteString(fmt.Sprintf("<div id='votable' style='width: 0; height: 0;' data-dataId='%s' data-processId='%s' data-title='%s' data-date='%s' data-objects='%s' data-band-name='%s' data-band-ref='%s' data-band-hi='%s' data-band-lo='%s' data-band-unit='%s' data-ra='%s' data-dec='%s' data-filesize='%s' data-server-version='%s'></div>\n", dataId, subaru.processId, subaru.title, subaru.date_obs, subaru.objects, subaru.band_name, subaru.band_ref, subaru.band_hi, subaru.band_lo, subaru.band_unit, subaru.ra, subaru.dec, subaru.file_size, VERSION_STRING))
+		buffer.WriteString(fmt.Sprintf("<div id='votable' style='width: 0; height: 0;' data-dataId='%s' data-processId='%s' data-title='%s' data-date='%s' data-objects='%s' data-band-name='%s' data-band-ref='%s' data-band-hi='%s' data-band-lo='%s' data-band-unit='%s' data-ra='%s' data-dec='%s' data-filesize='%d' data-server-version='%s'></div>\n", dataId, subaru.processId, subaru.title, subaru.date_obs, subaru.objects, subaru.band_name, subaru.band_ref, subaru.band_hi, subaru.band_lo, subaru.band_unit, subaru.ra, subaru.dec, subaru.file_size, VERSION_STRING))
 
 		buffer.WriteString(`<script>
 const golden_ratio = 1.6180339887;
@@ -751,18 +1085,49 @@ function resize(){mainRenderer();}
 }
 
 func main() {
-	easy = curl.EasyInit()
-	defer easy.Cleanup()	
-	
+	LOG_FORMAT = env_or_default("SUBARUWEBQL_LOG_FORMAT", LOG_FORMAT)
+	LOG_LEVEL = env_or_default("SUBARUWEBQL_LOG_LEVEL", LOG_LEVEL)
+	ADMIN_TOKEN = env_or_default("SUBARUWEBQL_ADMIN_TOKEN", ADMIN_TOKEN)
+
+	if err := init_logging(os.Stderr, LOG_FORMAT, LOG_LEVEL); err != nil {
+		logger.Error("logging not configured", "error", err)
+		os.Exit(1)
+	}
+
+	if zp := env_or_default("SUBARUWEBQL_PHOT_ZEROPOINT", ""); zp != "" {
+		value, err := strconv.ParseFloat(zp, 64)
+
+		if(err != nil) {
+			logger.Error("invalid SUBARUWEBQL_PHOT_ZEROPOINT", "error", err)
+			os.Exit(1)
+		}
+
+		PHOT_ZEROPOINT = value
+	}
+
+	//a command runs the FITS pipeline on local files instead of starting the server
+	if(len(os.Args) > 1) {
+		os.Exit(run_cli(os.Args[1:]))
+	}
+
 	app := iris.New()	
 
+	//request ids and the access log
+	app.Use(access_log)
+	app.Use(release_held_datasets)
+
 	app.Get("/subaruwebql/SubaruWebQL.html", func(ctx iris.Context) {		
 		votable := ctx.FormValue("votable")
 		dataId := ctx.FormValue("dataId")		
 
 		page, err := execute_subaru(dataId, votable)			
 
-		if err != nil {
+		if(errors.Is(err, errShuttingDown)) {
+			http_error(ctx, iris.StatusServiceUnavailable, err)
+		} else if(errors.Is(err, errInvalidDataId)) {
+			http_error(ctx, iris.StatusBadRequest, err)
+		} else if err != nil {
+			request_logger(ctx).Error("page not served", "error", err)
 			ctx.StatusCode(iris.StatusInternalServerError)
 			ctx.Writef("SubaruWebQL Internal Server Error\nVOTable: %s\ndataId: %s", votable, dataId)			
 		} else {
@@ -770,14 +1135,63 @@ func main() {
 		}
 	})
 
+	//binary websocket: progress notifications and image streaming
+	ws := new_websocket_server()
+	app.Get("/subaruwebql/websocket/progress/{dataId}", ws.Handler())
+
+	app.Get("/subaruwebql/pixel", pixel_handler)
+	app.Get("/subaruwebql/region", region_handler)
+	app.Get("/subaruwebql/cutout", cutout_handler)
+	app.Get("/subaruwebql/profile/line", line_profile_handler)
+	app.Get("/subaruwebql/profile/radial", radial_profile_handler)
+	app.Get("/subaruwebql/sources", sources_handler)
+	app.Get("/subaruwebql/photometry", photometry_handler)
+	app.Get("/subaruwebql/background", background_handler)
+	app.Get("/subaruwebql/contours", contours_handler)
+	app.Get("/subaruwebql/rgb", rgb_handler)
+	app.Get("/subaruwebql/reproject", reproject_handler)
+	app.Get("/subaruwebql/mosaic", mosaic_handler)
+	app.Get("/subaruwebql/compare", compare_handler)
+	app.Get("/subaruwebql/catalogue", catalogue_handler)
+	app.Get("/subaruwebql/regions", regions_export_handler)
+	app.Post("/subaruwebql/regions", regions_import_handler)
+	app.Get("/subaruwebql/regions/statistics", regions_statistics_handler)
+	app.Get("/subaruwebql/cube/plane", cube_plane_handler)
+	app.Get("/subaruwebql/cube/moment", cube_moment_handler)
+	app.Get("/subaruwebql/cube/spectrum", cube_spectrum_handler)
+	app.Get("/subaruwebql/exposure", exposure_handler)
+	app.Post("/subaruwebql/prefetch", prefetch_handler)
+	app.Get("/subaruwebql/prefetch", prefetch_status_handler)
+	app.Get("/metrics", metrics_handler)
+	register_admin_routes(app)
+
 	//root is at http://localhost:8081/subaruwebql/subaru.html
 	app.StaticWeb("/", "./htdocs/")	
 	app.Favicon("./htdocs/favicon.ico")			
 		
-	fmt.Printf("%s started.\n", SERVER_STRING)
+	//SIGTERM/SIGINT drain the daemon: downloads get SHUTDOWN_TIMEOUT to finish, websockets are closed and the caches flushed
+	stopped := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		sig := <-signals
+		logger.Info("shutting down", "signal", sig.String())
+
+		graceful_shutdown(app)
+		close(stopped)
+	}()
+
+	logger.Info("started", "server", SERVER_STRING, "version", VERSION_STRING)
 	
 	// Start the server using a network address.
-	app.Run(iris.Addr(":8081"))
+	if err := app.Run(iris.Addr(SERVER_ADDRESS), iris.WithoutInterruptHandler, iris.WithoutServerError(iris.ErrServerClosed)); err != nil {
+		logger.Error("server failed", "error", err)
+		os.Exit(1)
+	}
+
+	//the server stops accepting connections before the shutdown is complete
+	<-stopped
 
-	fmt.Printf("%s daemon ended.\n", SERVER_STRING)
+	logger.Info("daemon ended", "server", SERVER_STRING)
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+//a minimal VOTable 1.3 writer for the tables we send back to the client
+
+type VOField struct {
+	Name     string
+	Datatype string //double, float, int, long, char, boolean
+	Unit     string
+	UCD      string
+	Desc     string
+}
+
+type VOTable struct {
+	Resource string
+	Name     string
+	Params   []VOParam
+	Fields   []VOField
+	Rows     [][]interface{}
+}
+
+type VOParam struct {
+	Name     string
+	Datatype string
+	Unit     string
+	UCD      string
+	Value    string
+}
+
+func xml_escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func votable_attr(name, value string) string {
+	if value == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(" %s=\"%s\"", name, xml_escape(value))
+}
+
+//votable_value formats a cell, NaN (or nil) becomes an empty cell
+func votable_value(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return ""
+		}
+		return fmt.Sprintf("%.10g", value)
+	case float32:
+		if math.IsNaN(float64(value)) || math.IsInf(float64(value), 0) {
+			return ""
+		}
+		return fmt.Sprintf("%.7g", value)
+	case *float64:
+		if value == nil {
+			return ""
+		}
+		return votable_value(*value)
+	case bool:
+		if value {
+			return "T"
+		}
+		return "F"
+	case string:
+		return xml_escape(value)
+	default:
+		return xml_escape(fmt.Sprint(value))
+	}
+}
+
+func (t *VOTable) Write(w io.Writer) error {
+	var b strings.Builder
+
+	b.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	b.WriteString("<VOTABLE version=\"1.3\" xmlns=\"http://www.ivoa.net/xml/VOTable/v1.3\">\n")
+	b.WriteString(fmt.Sprintf("<RESOURCE%s>\n", votable_attr("name", t.Resource)))
+	b.WriteString(fmt.Sprintf("<INFO name=\"server\" value=\"%s\"/>\n", xml_escape(SERVER_STRING)))
+	b.WriteString(fmt.Sprintf("<TABLE%s>\n", votable_attr("name", t.Name)))
+
+	for _, p := range t.Params {
+		b.WriteString(fmt.Sprintf("<PARAM%s%s%s%s%s", votable_attr("name", p.Name), votable_attr("datatype", p.Datatype), votable_attr("unit", p.Unit), votable_attr("ucd", p.UCD), votable_attr("value", p.Value)))
+
+		if p.Datatype == "char" {
+			b.WriteString(" arraysize=\"*\"")
+		}
+
+		b.WriteString("/>\n")
+	}
+
+	for _, f := range t.Fields {
+		b.WriteString(fmt.Sprintf("<FIELD%s%s%s%s", votable_attr("name", f.Name), votable_attr("datatype", f.Datatype), votable_attr("unit", f.Unit), votable_attr("ucd", f.UCD)))
+
+		if f.Datatype == "char" {
+			b.WriteString(" arraysize=\"*\"")
+		}
+
+		if f.Desc != "" {
+			b.WriteString(fmt.Sprintf("><DESCRIPTION>%s</DESCRIPTION></FIELD>\n", xml_escape(f.Desc)))
+		} else {
+			b.WriteString("/>\n")
+		}
+	}
+
+	b.WriteString("<DATA><TABLEDATA>\n")
+
+	for _, row := range t.Rows {
+		b.WriteString("<TR>")
+
+		for _, cell := range row {
+			b.WriteString("<TD>")
+			b.WriteString(votable_value(cell))
+			b.WriteString("</TD>")
+		}
+
+		b.WriteString("</TR>\n")
+	}
+
+	b.WriteString("</TABLEDATA></DATA>\n</TABLE>\n</RESOURCE>\n</VOTABLE>\n")
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
@@ -0,0 +1,189 @@
+package wcs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+const MAX_ITERATIONS = 50
+const PIXEL_TOLERANCE = 1e-8   //[pixel]
+const DEGREE_TOLERANCE = 1e-12 //[deg]
+
+//SIP polynomial distortions (Shupe et al. 2005), applied to pixel offsets from CRPIX
+type sip struct {
+	a, b          [10][10]float64
+	ap, bp        [10][10]float64
+	order         [2]int
+	inverse_order [2]int
+}
+
+func read_sip_coefficients(h Header, name string, order int, dst *[10][10]float64) {
+	for p := 0; p <= order; p++ {
+		for q := 0; p+q <= order; q++ {
+			dst[p][q] = h.float_default(fmt.Sprintf("%s_%d_%d", name, p, q), 0)
+		}
+	}
+}
+
+func new_sip(h Header) *sip {
+	s := new(sip)
+
+	s.order[0] = int(h.float_default("A_ORDER", 0))
+	s.order[1] = int(h.float_default("B_ORDER", 0))
+	s.inverse_order[0] = int(h.float_default("AP_ORDER", 0))
+	s.inverse_order[1] = int(h.float_default("BP_ORDER", 0))
+
+	for i := 0; i < 2; i++ {
+		if s.order[i] > 9 {
+			s.order[i] = 9
+		}
+
+		if s.inverse_order[i] > 9 {
+			s.inverse_order[i] = 9
+		}
+	}
+
+	read_sip_coefficients(h, "A", s.order[0], &s.a)
+	read_sip_coefficients(h, "B", s.order[1], &s.b)
+	read_sip_coefficients(h, "AP", s.inverse_order[0], &s.ap)
+	read_sip_coefficients(h, "BP", s.inverse_order[1], &s.bp)
+
+	return s
+}
+
+func sip_polynomial(c *[10][10]float64, order int, u, v float64) float64 {
+	sum := 0.0
+	up := 1.0
+
+	for p := 0; p <= order; p++ {
+		vq := 1.0
+
+		for q := 0; p+q <= order; q++ {
+			sum += c[p][q] * up * vq
+			vq *= v
+		}
+
+		up *= u
+	}
+
+	return sum
+}
+
+func (s *sip) forward(u, v float64) (float64, float64) {
+	return u + sip_polynomial(&s.a, s.order[0], u, v), v + sip_polynomial(&s.b, s.order[1], u, v)
+}
+
+//inverse starts from the AP/BP polynomials when present and refines by fixed-point iteration
+func (s *sip) inverse(U, V float64) (float64, float64, error) {
+	u := U + sip_polynomial(&s.ap, s.inverse_order[0], U, V)
+	v := V + sip_polynomial(&s.bp, s.inverse_order[1], U, V)
+
+	for i := 0; i < MAX_ITERATIONS; i++ {
+		un := U - sip_polynomial(&s.a, s.order[0], u, v)
+		vn := V - sip_polynomial(&s.b, s.order[1], u, v)
+
+		converged := math.Abs(un-u) < PIXEL_TOLERANCE && math.Abs(vn-v) < PIXEL_TOLERANCE
+		u, v = un, vn
+
+		if converged {
+			return u, v, nil
+		}
+	}
+
+	return u, v, errors.New("SIP: the inverse did not converge")
+}
+
+//TPV polynomial distortions, applied to intermediate world coordinates [deg]
+type tpv struct {
+	pv1, pv2 [40]float64
+}
+
+func new_tpv(h Header) *tpv {
+	t := new(tpv)
+
+	for k := 0; k < 40; k++ {
+		t.pv1[k] = h.float_default(fmt.Sprintf("PV1_%d", k), 0)
+		t.pv2[k] = h.float_default(fmt.Sprintf("PV2_%d", k), 0)
+	}
+
+	//the identity is assumed when no coefficients are given
+	_, has1 := h.float("PV1_1")
+	_, has2 := h.float("PV2_1")
+
+	if !has1 {
+		t.pv1[1] = 1
+	}
+
+	if !has2 {
+		t.pv2[1] = 1
+	}
+
+	return t
+}
+
+//tpv_polynomial evaluates the 40-term TPV polynomial, terms 3, 11, 23 and 39 are odd powers of r
+func tpv_polynomial(c *[40]float64, x, y float64) float64 {
+	r := math.Hypot(x, y)
+
+	var xp, yp [8]float64
+	xp[0], yp[0] = 1, 1
+
+	for i := 1; i < 8; i++ {
+		xp[i] = xp[i-1] * x
+		yp[i] = yp[i-1] * y
+	}
+
+	sum := c[0]
+	k := 1
+
+	for n := 1; n <= 7; n++ {
+		for j := 0; j <= n; j++ {
+			sum += c[k] * xp[n-j] * yp[j]
+			k++
+		}
+
+		if n%2 == 1 {
+			sum += c[k] * math.Pow(r, float64(n))
+			k++
+		}
+	}
+
+	return sum
+}
+
+func (t *tpv) forward(xi, eta float64) (float64, float64) {
+	return tpv_polynomial(&t.pv1, xi, eta), tpv_polynomial(&t.pv2, eta, xi)
+}
+
+//inverse solves forward(xi, eta) = (X, Y) by Newton's method with a numerical Jacobian
+func (t *tpv) inverse(X, Y float64) (float64, float64, error) {
+	xi, eta := X, Y
+	const h = 1e-7
+
+	for i := 0; i < MAX_ITERATIONS; i++ {
+		fx, fy := t.forward(xi, eta)
+		dx, dy := fx-X, fy-Y
+
+		if math.Abs(dx) < DEGREE_TOLERANCE && math.Abs(dy) < DEGREE_TOLERANCE {
+			return xi, eta, nil
+		}
+
+		fx1, fy1 := t.forward(xi+h, eta)
+		fx2, fy2 := t.forward(xi, eta+h)
+
+		j11, j21 := (fx1-fx)/h, (fy1-fy)/h
+		j12, j22 := (fx2-fx)/h, (fy2-fy)/h
+
+		det := j11*j22 - j12*j21
+
+		if det == 0 {
+			break
+		}
+
+		xi -= (j22*dx - j12*dy) / det
+		eta -= (-j21*dx + j11*dy) / det
+	}
+
+	return xi, eta, errors.New("TPV: the inverse did not converge")
+}
@@ -0,0 +1,196 @@
+package wcs
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+//celestial reference frames, positions are converted through FK5 J2000 (ICRS is treated as FK5 J2000,
+//the 20 mas frame bias is ignored; FK4 B1950 ignores the E-terms of aberration and proper motions)
+const ICRS = "ICRS"
+const FK5 = "FK5"
+const FK4 = "FK4"
+const GALACTIC = "GALACTIC"
+const ECLIPTIC = "ECLIPTIC"
+
+//FK5 J2000 -> Galactic
+var fk5_to_galactic = [3][3]float64{
+	{-0.0548755604162154, -0.8734370902348850, -0.4838350155487132},
+	{0.4941094278755837, -0.4448296299600112, 0.7469822444972189},
+	{-0.8676661490190047, -0.1980763734312015, 0.4559837761750669},
+}
+
+//FK4 B1950 -> FK5 J2000
+var fk4_to_fk5 = [3][3]float64{
+	{0.9999256782, -0.0111820611, -0.0048579477},
+	{0.0111820610, 0.9999374784, -0.0000271765},
+	{0.0048579479, -0.0000271474, 0.9999881997},
+}
+
+//the mean obliquity of the ecliptic at J2000 [deg]
+const OBLIQUITY_J2000 = 23.4392911
+
+func to_vector(lon, lat float64) [3]float64 {
+	lon *= D2R
+	lat *= D2R
+
+	return [3]float64{math.Cos(lat) * math.Cos(lon), math.Cos(lat) * math.Sin(lon), math.Sin(lat)}
+}
+
+func from_vector(v [3]float64) (float64, float64) {
+	lon := R2D * math.Atan2(v[1], v[0])
+	lat := R2D * math.Atan2(v[2], math.Hypot(v[0], v[1]))
+
+	return normalise_ra(lon), lat
+}
+
+func rotate(m *[3][3]float64, v [3]float64) [3]float64 {
+	var r [3]float64
+
+	for i := 0; i < 3; i++ {
+		r[i] = m[i][0]*v[0] + m[i][1]*v[1] + m[i][2]*v[2]
+	}
+
+	return r
+}
+
+func rotate_transposed(m *[3][3]float64, v [3]float64) [3]float64 {
+	var r [3]float64
+
+	for i := 0; i < 3; i++ {
+		r[i] = m[0][i]*v[0] + m[1][i]*v[1] + m[2][i]*v[2]
+	}
+
+	return r
+}
+
+func ecliptic_matrix() [3][3]float64 {
+	eps := D2R * OBLIQUITY_J2000
+
+	return [3][3]float64{
+		{1, 0, 0},
+		{0, math.Cos(eps), math.Sin(eps)},
+		{0, -math.Sin(eps), math.Cos(eps)},
+	}
+}
+
+func to_fk5(frame string, v [3]float64) ([3]float64, error) {
+	switch frame {
+	case ICRS, FK5:
+		return v, nil
+	case FK4:
+		return rotate(&fk4_to_fk5, v), nil
+	case GALACTIC:
+		return rotate_transposed(&fk5_to_galactic, v), nil
+	case ECLIPTIC:
+		m := ecliptic_matrix()
+		return rotate_transposed(&m, v), nil
+	default:
+		return v, fmt.Errorf("unknown frame %s", frame)
+	}
+}
+
+func from_fk5(frame string, v [3]float64) ([3]float64, error) {
+	switch frame {
+	case ICRS, FK5:
+		return v, nil
+	case FK4:
+		return rotate_transposed(&fk4_to_fk5, v), nil
+	case GALACTIC:
+		return rotate(&fk5_to_galactic, v), nil
+	case ECLIPTIC:
+		m := ecliptic_matrix()
+		return rotate(&m, v), nil
+	default:
+		return v, fmt.Errorf("unknown frame %s", frame)
+	}
+}
+
+//Convert transforms a position [deg] between two of the supported frames
+func Convert(lon, lat float64, from, to string) (float64, float64, error) {
+	from = strings.ToUpper(from)
+	to = strings.ToUpper(to)
+
+	v, err := to_fk5(from, to_vector(lon, lat))
+
+	if err != nil {
+		return math.NaN(), math.NaN(), err
+	}
+
+	if v, err = from_fk5(to, v); err != nil {
+		return math.NaN(), math.NaN(), err
+	}
+
+	lon, lat = from_vector(v)
+
+	return lon, lat, nil
+}
+
+//Frame returns the celestial frame of the image axes
+func (w *WCS) Frame() string {
+	if strings.HasPrefix(w.CTYPE1, "GLON") {
+		return GALACTIC
+	}
+
+	if strings.HasPrefix(w.CTYPE1, "ELON") {
+		return ECLIPTIC
+	}
+
+	switch w.RADESYS {
+	case FK4, "FK4-NO-E":
+		return FK4
+	case FK5:
+		return FK5
+	default:
+		return ICRS
+	}
+}
+
+//FormatHMS formats an angle [deg] as hours, minutes and seconds
+func FormatHMS(deg float64) string {
+	hours := normalise_ra(deg) / 15.0
+
+	h := math.Floor(hours)
+	m := math.Floor(60.0 * (hours - h))
+	s := 3600.0 * (hours - h - m/60.0)
+
+	//avoid 60.000 after rounding
+	if s >= 59.9995 {
+		s = 0
+		m++
+	}
+
+	if m >= 60 {
+		m = 0
+		h++
+	}
+
+	return fmt.Sprintf("%02.0f:%02.0f:%06.3f", math.Mod(h, 24), m, s)
+}
+
+//FormatDMS formats an angle [deg] as signed degrees, arcminutes and arcseconds
+func FormatDMS(deg float64) string {
+	sign := "+"
+
+	if deg < 0 {
+		sign = "-"
+		deg = -deg
+	}
+
+	d := math.Floor(deg)
+	m := math.Floor(60.0 * (deg - d))
+	s := 3600.0 * (deg - d - m/60.0)
+
+	if s >= 59.995 {
+		s = 0
+		m++
+	}
+
+	if m >= 60 {
+		m = 0
+		d++
+	}
+
+	return fmt.Sprintf("%s%02.0f:%02.0f:%05.2f", sign, d, m, s)
+}
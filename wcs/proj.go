@@ -0,0 +1,84 @@
+package wcs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+//project_to_native maps projection-plane coordinates [deg] onto native spherical coordinates (phi, theta) [deg]
+func project_to_native(proj string, x, y float64) (float64, float64, error) {
+	if proj == "CAR" {
+		return x, y, nil
+	}
+
+	//zenithal projections
+	r := math.Hypot(x, y)
+
+	phi := 0.0
+
+	if r != 0 {
+		phi = R2D * math.Atan2(x, -y)
+	}
+
+	var theta float64
+
+	switch proj {
+	case "TAN":
+		theta = R2D * math.Atan2(R2D, r)
+
+	case "SIN":
+		if r > R2D {
+			return 0, 0, errors.New("SIN: point outside the projection boundary")
+		}
+
+		theta = R2D * math.Acos(r/R2D)
+
+	case "ZEA":
+		arg := r / (2.0 * R2D)
+
+		if arg > 1 {
+			return 0, 0, errors.New("ZEA: point outside the projection boundary")
+		}
+
+		theta = 90.0 - 2.0*R2D*math.Asin(arg)
+
+	default:
+		return 0, 0, fmt.Errorf("unsupported projection %s", proj)
+	}
+
+	return phi, theta, nil
+}
+
+//native_to_project is the inverse of project_to_native
+func native_to_project(proj string, phi, theta float64) (float64, float64, error) {
+	if proj == "CAR" {
+		return phi, theta, nil
+	}
+
+	var r float64
+
+	switch proj {
+	case "TAN":
+		if theta <= 0 {
+			return 0, 0, errors.New("TAN: point on or beyond the native equator")
+		}
+
+		r = R2D / math.Tan(D2R*theta)
+
+	case "SIN":
+		if theta < 0 {
+			return 0, 0, errors.New("SIN: point on the far hemisphere")
+		}
+
+		r = R2D * math.Cos(D2R*theta)
+
+	case "ZEA":
+		r = 2.0 * R2D * math.Sin(D2R*(90.0-theta)/2.0)
+
+	default:
+		return 0, 0, fmt.Errorf("unsupported projection %s", proj)
+	}
+
+	return r * math.Sin(D2R*phi), -r * math.Cos(D2R*phi), nil
+}
@@ -0,0 +1,393 @@
+//Package wcs implements celestial World Coordinate System transformations
+//(Greisen & Calabretta 2002, Calabretta & Greisen 2002) for 2D FITS images.
+//Supported projections: TAN, SIN, ZEA and CAR, optionally with SIP or TPV distortions.
+//Pixel coordinates follow the FITS convention: the centre of the first pixel is (1, 1).
+package wcs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const D2R = math.Pi / 180.0
+const R2D = 180.0 / math.Pi
+
+type WCS struct {
+	CTYPE1  string
+	CTYPE2  string
+	CRVAL1  float64
+	CRVAL2  float64
+	CRPIX1  float64
+	CRPIX2  float64
+	CD      [2][2]float64 //the effective linear transformation [deg/pixel]
+	EQUINOX float64
+	RADESYS string
+	LONPOLE float64
+	LATPOLE float64
+	Proj    string //TAN, SIN, ZEA or CAR
+	sip     *sip
+	tpv     *tpv
+	cdinv   [2][2]float64
+	theta0  float64
+	alphap  float64 //celestial coordinates of the native pole [rad]
+	deltap  float64
+	phip    float64 //native longitude of the celestial pole [rad]
+}
+
+//Header maps FITS keywords onto their (unquoted, comment-free) values
+type Header map[string]string
+
+func (h Header) float(key string) (float64, bool) {
+	value, ok := h[key]
+
+	if !ok {
+		return 0, false
+	}
+
+	//Fortran-style exponents are still found in old headers
+	value = strings.Replace(strings.TrimSpace(value), "D", "E", 1)
+	f, err := strconv.ParseFloat(value, 64)
+
+	if err != nil {
+		return 0, false
+	}
+
+	return f, true
+}
+
+func (h Header) float_default(key string, def float64) float64 {
+	if f, ok := h.float(key); ok {
+		return f
+	}
+
+	return def
+}
+
+func (h Header) string(key string) string {
+	return strings.TrimSpace(h[key])
+}
+
+//New builds a WCS from the primary header keywords
+func New(h Header) (*WCS, error) {
+	w := new(WCS)
+
+	w.CTYPE1 = strings.ToUpper(h.string("CTYPE1"))
+	w.CTYPE2 = strings.ToUpper(h.string("CTYPE2"))
+
+	if len(w.CTYPE1) < 8 || len(w.CTYPE2) < 8 {
+		return nil, fmt.Errorf("unsupported CTYPE1/2 '%s' '%s'", w.CTYPE1, w.CTYPE2)
+	}
+
+	w.Proj = w.CTYPE1[5:8]
+
+	if w.CTYPE2[5:8] != w.Proj {
+		return nil, fmt.Errorf("mismatched projections %s and %s", w.CTYPE1, w.CTYPE2)
+	}
+
+	switch w.Proj {
+	case "TAN", "SIN", "ZEA", "TPV":
+		w.theta0 = 90.0
+	case "CAR":
+		w.theta0 = 0.0
+	default:
+		return nil, fmt.Errorf("unsupported projection %s", w.Proj)
+	}
+
+	var ok1, ok2 bool
+
+	if w.CRVAL1, ok1 = h.float("CRVAL1"); !ok1 {
+		return nil, errors.New("missing CRVAL1")
+	}
+
+	if w.CRVAL2, ok2 = h.float("CRVAL2"); !ok2 {
+		return nil, errors.New("missing CRVAL2")
+	}
+
+	w.CRPIX1 = h.float_default("CRPIX1", 0)
+	w.CRPIX2 = h.float_default("CRPIX2", 0)
+
+	if err := w.make_linear(h); err != nil {
+		return nil, err
+	}
+
+	w.RADESYS = h.string("RADESYS")
+
+	if w.RADESYS == "" {
+		w.RADESYS = h.string("RADECSYS")
+	}
+
+	if equinox, ok := h.float("EQUINOX"); ok {
+		w.EQUINOX = equinox
+	} else if epoch, ok := h.float("EPOCH"); ok {
+		w.EQUINOX = epoch
+	}
+
+	if w.RADESYS == "" {
+		switch {
+		case w.EQUINOX == 0:
+			w.RADESYS = "ICRS"
+		case w.EQUINOX < 1984.0:
+			w.RADESYS = "FK4"
+		default:
+			w.RADESYS = "FK5"
+		}
+	}
+
+	if w.EQUINOX == 0 && (w.RADESYS == "FK5" || w.RADESYS == "FK4") {
+		if w.RADESYS == "FK5" {
+			w.EQUINOX = 2000.0
+		} else {
+			w.EQUINOX = 1950.0
+		}
+	}
+
+	//distortions
+	if strings.HasSuffix(w.CTYPE1, "-SIP") {
+		w.sip = new_sip(h)
+	}
+
+	if w.Proj == "TPV" {
+		w.tpv = new_tpv(h)
+		w.Proj = "TAN"
+	}
+
+	if err := w.make_celestial(h); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+//make_linear prefers CD, then PC with CDELT, then CDELT with CROTA2
+func (w *WCS) make_linear(h Header) error {
+	_, has_cd11 := h.float("CD1_1")
+	_, has_cd22 := h.float("CD2_2")
+
+	if has_cd11 || has_cd22 {
+		w.CD[0][0] = h.float_default("CD1_1", 0)
+		w.CD[0][1] = h.float_default("CD1_2", 0)
+		w.CD[1][0] = h.float_default("CD2_1", 0)
+		w.CD[1][1] = h.float_default("CD2_2", 0)
+	} else {
+		cdelt1 := h.float_default("CDELT1", 1)
+		cdelt2 := h.float_default("CDELT2", 1)
+
+		_, has_pc11 := h.float("PC1_1")
+		_, has_pc22 := h.float("PC2_2")
+
+		if has_pc11 || has_pc22 {
+			w.CD[0][0] = cdelt1 * h.float_default("PC1_1", 1)
+			w.CD[0][1] = cdelt1 * h.float_default("PC1_2", 0)
+			w.CD[1][0] = cdelt2 * h.float_default("PC2_1", 0)
+			w.CD[1][1] = cdelt2 * h.float_default("PC2_2", 1)
+		} else {
+			rho := D2R * h.float_default("CROTA2", 0)
+
+			w.CD[0][0] = cdelt1 * math.Cos(rho)
+			w.CD[0][1] = -cdelt2 * math.Sin(rho)
+			w.CD[1][0] = cdelt1 * math.Sin(rho)
+			w.CD[1][1] = cdelt2 * math.Cos(rho)
+		}
+	}
+
+	det := w.CD[0][0]*w.CD[1][1] - w.CD[0][1]*w.CD[1][0]
+
+	if det == 0 {
+		return errors.New("singular CD matrix")
+	}
+
+	w.cdinv[0][0] = w.CD[1][1] / det
+	w.cdinv[0][1] = -w.CD[0][1] / det
+	w.cdinv[1][0] = -w.CD[1][0] / det
+	w.cdinv[1][1] = w.CD[0][0] / det
+
+	return nil
+}
+
+//make_celestial works out the celestial coordinates of the native pole (Paper II, section 2.4)
+func (w *WCS) make_celestial(h Header) error {
+	alpha0 := D2R * w.CRVAL1
+	delta0 := D2R * w.CRVAL2
+	theta0 := D2R * w.theta0
+	phi0 := 0.0
+
+	lonpole := 0.0
+
+	if w.CRVAL2 < w.theta0 {
+		lonpole = 180.0
+	}
+
+	w.LONPOLE = h.float_default("LONPOLE", lonpole)
+	w.LATPOLE = h.float_default("LATPOLE", 90.0)
+	w.phip = D2R * w.LONPOLE
+
+	if w.theta0 == 90.0 {
+		//zenithal projections: the reference point is the native pole
+		w.alphap = alpha0
+		w.deltap = delta0
+		return nil
+	}
+
+	dphi := w.phip - phi0
+	a := math.Atan2(math.Sin(theta0), math.Cos(theta0)*math.Cos(dphi))
+	c := math.Sqrt(1.0 - math.Pow(math.Cos(theta0)*math.Sin(dphi), 2))
+
+	if c == 0 {
+		return errors.New("invalid LONPOLE")
+	}
+
+	arg := math.Sin(delta0) / c
+
+	if math.Abs(arg) > 1 {
+		return errors.New("invalid reference point")
+	}
+
+	b := math.Acos(arg)
+
+	//pick the solution closest to LATPOLE
+	deltap := a + b
+	alt := a - b
+
+	if math.Abs(alt-D2R*w.LATPOLE) < math.Abs(deltap-D2R*w.LATPOLE) && alt >= -math.Pi/2 && alt <= math.Pi/2 {
+		deltap = alt
+	}
+
+	if deltap > math.Pi/2 || deltap < -math.Pi/2 {
+		deltap = alt
+	}
+
+	w.deltap = deltap
+
+	if math.Abs(math.Abs(deltap)-math.Pi/2) < 1e-12 {
+		if deltap > 0 {
+			w.alphap = alpha0 + dphi - math.Pi
+		} else {
+			w.alphap = alpha0 - dphi
+		}
+	} else {
+		y := math.Sin(dphi) * math.Cos(theta0) / math.Cos(delta0)
+		x := (math.Sin(theta0) - math.Sin(deltap)*math.Sin(delta0)) / (math.Cos(deltap) * math.Cos(delta0))
+		w.alphap = alpha0 - math.Atan2(y, x)
+	}
+
+	return nil
+}
+
+//PixelToSky converts FITS pixel coordinates into celestial coordinates [deg]
+func (w *WCS) PixelToSky(x, y float64) (float64, float64, error) {
+	u := x - w.CRPIX1
+	v := y - w.CRPIX2
+
+	if w.sip != nil {
+		u, v = w.sip.forward(u, v)
+	}
+
+	//intermediate world coordinates [deg]
+	xi := w.CD[0][0]*u + w.CD[0][1]*v
+	eta := w.CD[1][0]*u + w.CD[1][1]*v
+
+	if w.tpv != nil {
+		xi, eta = w.tpv.forward(xi, eta)
+	}
+
+	phi, theta, err := project_to_native(w.Proj, xi, eta)
+
+	if err != nil {
+		return math.NaN(), math.NaN(), err
+	}
+
+	ra, dec := w.native_to_celestial(phi, theta)
+
+	return ra, dec, nil
+}
+
+//SkyToPixel converts celestial coordinates [deg] into FITS pixel coordinates
+func (w *WCS) SkyToPixel(ra, dec float64) (float64, float64, error) {
+	phi, theta := w.celestial_to_native(ra, dec)
+
+	xi, eta, err := native_to_project(w.Proj, phi, theta)
+
+	if err != nil {
+		return math.NaN(), math.NaN(), err
+	}
+
+	if w.tpv != nil {
+		if xi, eta, err = w.tpv.inverse(xi, eta); err != nil {
+			return math.NaN(), math.NaN(), err
+		}
+	}
+
+	u := w.cdinv[0][0]*xi + w.cdinv[0][1]*eta
+	v := w.cdinv[1][0]*xi + w.cdinv[1][1]*eta
+
+	if w.sip != nil {
+		if u, v, err = w.sip.inverse(u, v); err != nil {
+			return math.NaN(), math.NaN(), err
+		}
+	}
+
+	return u + w.CRPIX1, v + w.CRPIX2, nil
+}
+
+//PixelScale returns the mean pixel size [arcsec], ignoring distortions
+func (w *WCS) PixelScale() float64 {
+	det := w.CD[0][0]*w.CD[1][1] - w.CD[0][1]*w.CD[1][0]
+
+	return 3600.0 * math.Sqrt(math.Abs(det))
+}
+
+func (w *WCS) native_to_celestial(phi, theta float64) (float64, float64) {
+	phi *= D2R
+	theta *= D2R
+
+	dphi := phi - w.phip
+	x := math.Sin(theta)*math.Cos(w.deltap) - math.Cos(theta)*math.Sin(w.deltap)*math.Cos(dphi)
+	y := -math.Cos(theta) * math.Sin(dphi)
+
+	ra := R2D * (w.alphap + math.Atan2(y, x))
+	dec := R2D * math.Asin(clamp(math.Sin(theta)*math.Sin(w.deltap)+math.Cos(theta)*math.Cos(w.deltap)*math.Cos(dphi)))
+
+	return normalise_ra(ra), dec
+}
+
+func (w *WCS) celestial_to_native(ra, dec float64) (float64, float64) {
+	alpha := D2R * ra
+	delta := D2R * dec
+
+	dalpha := alpha - w.alphap
+	x := math.Sin(delta)*math.Cos(w.deltap) - math.Cos(delta)*math.Sin(w.deltap)*math.Cos(dalpha)
+	y := -math.Cos(delta) * math.Sin(dalpha)
+
+	phi := R2D * (w.phip + math.Atan2(y, x))
+	theta := R2D * math.Asin(clamp(math.Sin(delta)*math.Sin(w.deltap)+math.Cos(delta)*math.Cos(w.deltap)*math.Cos(dalpha)))
+
+	//native longitudes are kept within [-180, 180)
+	phi = math.Mod(phi+540.0, 360.0) - 180.0
+
+	return phi, theta
+}
+
+func clamp(x float64) float64 {
+	if x > 1 {
+		return 1
+	}
+
+	if x < -1 {
+		return -1
+	}
+
+	return x
+}
+
+func normalise_ra(ra float64) float64 {
+	ra = math.Mod(ra, 360.0)
+
+	if ra < 0 {
+		ra += 360.0
+	}
+
+	return ra
+}
@@ -0,0 +1,149 @@
+package wcs
+
+import (
+	"math"
+	"testing"
+)
+
+//header returns a 2048 x 4096 image with 0.2"/pixel around (150, 2) in the given projection
+func header(ctype1, ctype2 string, extra map[string]string) Header {
+	h := Header{
+		"CTYPE1": ctype1, "CTYPE2": ctype2,
+		"CRVAL1": "150.0", "CRVAL2": "2.0",
+		"CRPIX1": "1024.5", "CRPIX2": "2048.5",
+		"CD1_1": "-5.5555555555556E-05", "CD1_2": "1.0E-06",
+		"CD2_1": "1.0E-06", "CD2_2": "5.5555555555556E-05",
+		"RADESYS": "ICRS",
+	}
+
+	for key, value := range extra {
+		h[key] = value
+	}
+
+	return h
+}
+
+var sip_cards = map[string]string{
+	"A_ORDER": "2", "B_ORDER": "2",
+	"A_2_0": "2.0E-07", "A_1_1": "-1.5E-07", "A_0_2": "5.0E-08",
+	"B_2_0": "-4.0E-08", "B_1_1": "1.0E-07", "B_0_2": "3.0E-07",
+}
+
+var tpv_cards = map[string]string{
+	"PV1_0": "0", "PV1_1": "1", "PV1_2": "0", "PV1_4": "2.0E-03", "PV1_7": "-1.0E-02",
+	"PV2_0": "0", "PV2_1": "1", "PV2_2": "0", "PV2_4": "-1.5E-03", "PV2_8": "5.0E-03",
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		h    Header
+	}{
+		{"TAN", header("RA---TAN", "DEC--TAN", nil)},
+		{"SIN", header("RA---SIN", "DEC--SIN", nil)},
+		{"ZEA", header("RA---ZEA", "DEC--ZEA", nil)},
+		{"CAR", header("RA---CAR", "DEC--CAR", nil)},
+		{"TAN-SIP", header("RA---TAN-SIP", "DEC--TAN-SIP", sip_cards)},
+		{"SIN-SIP", header("RA---SIN-SIP", "DEC--SIN-SIP", sip_cards)},
+		{"ZEA-SIP", header("RA---ZEA-SIP", "DEC--ZEA-SIP", sip_cards)},
+		{"CAR-SIP", header("RA---CAR-SIP", "DEC--CAR-SIP", sip_cards)},
+		{"TPV", header("RA---TPV", "DEC--TPV", tpv_cards)},
+	}
+
+	pixels := [][2]float64{{1, 1}, {1024.5, 2048.5}, {2048, 1}, {1, 4096}, {2048, 4096}, {300.25, 3100.75}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w, err := New(test.h)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, p := range pixels {
+				ra, dec, err := w.PixelToSky(p[0], p[1])
+
+				if err != nil {
+					t.Fatalf("PixelToSky(%g, %g): %v", p[0], p[1], err)
+				}
+
+				x, y, err := w.SkyToPixel(ra, dec)
+
+				if err != nil {
+					t.Fatalf("SkyToPixel(%g, %g): %v", ra, dec, err)
+				}
+
+				if math.Abs(x-p[0]) > 1e-6 || math.Abs(y-p[1]) > 1e-6 {
+					t.Errorf("(%g, %g) -> (%g, %g) -> (%g, %g)", p[0], p[1], ra, dec, x, y)
+				}
+			}
+		})
+	}
+}
+
+func TestReferencePixel(t *testing.T) {
+	for _, proj := range []string{"TAN", "SIN", "ZEA", "CAR"} {
+		w, err := New(header("RA---"+proj, "DEC--"+proj, nil))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ra, dec, err := w.PixelToSky(1024.5, 2048.5)
+
+		if err != nil || math.Abs(ra-150) > 1e-10 || math.Abs(dec-2) > 1e-10 {
+			t.Errorf("%s: CRPIX -> (%g, %g), %v", proj, ra, dec, err)
+		}
+
+		if scale := w.PixelScale(); math.Abs(scale-0.2) > 1e-3 {
+			t.Errorf("%s: pixel scale %g", proj, scale)
+		}
+	}
+}
+
+func TestSIPDistortion(t *testing.T) {
+	plain, _ := New(header("RA---TAN", "DEC--TAN", nil))
+	distorted, _ := New(header("RA---TAN-SIP", "DEC--TAN-SIP", sip_cards))
+
+	ra0, dec0, _ := plain.PixelToSky(2048, 4096)
+	ra1, dec1, _ := distorted.PixelToSky(2048, 4096)
+
+	if ra0 == ra1 && dec0 == dec1 {
+		t.Error("the SIP coefficients are ignored")
+	}
+}
+
+func TestInvalidHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		h    Header
+	}{
+		{"unsupported projection", header("RA---AIT", "DEC--AIT", nil)},
+		{"mismatched projections", header("RA---TAN", "DEC--SIN", nil)},
+		{"short CTYPE", header("RA", "DEC", nil)},
+		{"no CRVAL1", func() Header { h := header("RA---TAN", "DEC--TAN", nil); delete(h, "CRVAL1"); return h }()},
+	}
+
+	for _, test := range tests {
+		if _, err := New(test.h); err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+}
+
+//the FK4 transformation is good to a few tenths of a milliarcsecond
+func TestConvert(t *testing.T) {
+	for _, frame := range []string{FK4, FK5, ICRS} {
+		lon, lat, err := Convert(150, 2, ICRS, frame)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lon, lat, err = Convert(lon, lat, frame, ICRS)
+
+		if err != nil || math.Abs(lon-150) > 1e-7 || math.Abs(lat-2) > 1e-7 {
+			t.Errorf("ICRS -> %s -> ICRS: (%g, %g), %v", frame, lon, lat, err)
+		}
+	}
+}
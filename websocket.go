@@ -0,0 +1,578 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/websocket"
+)
+
+//binary websocket protocol
+//every message starts with a 16-byte little-endian frame header:
+//	0: uint8  protocol version (WS_PROTOCOL_VERSION)
+//	1: uint8  message type (WS_MSG_*)
+//	2: uint16 flags (WS_FLAG_*)
+//	4: uint32 request id, echoed back in the reply
+//	8: uint32 length of the fixed parameters following the header
+//	12: uint32 uncompressed length of the pixel payload following the parameters
+//the pixel payload is LZ4-compressed (a raw LZ4 block) when WS_FLAG_LZ4 is set
+//pixels are either uint8 (tone-mapped) or little-endian float32 (WS_FLAG_FLOAT32), rows in the FITS order (bottom-up)
+//bits 2-3 of the flags select the display layer (DISPLAY_*) for image info, viewport and tile requests
+
+const WS_PROTOCOL_VERSION = 1
+const WS_HEADER_LENGTH = 16
+
+//client -> server
+const WS_MSG_VIEWPORT = 1
+const WS_MSG_TILE = 2
+const WS_MSG_IMAGE_INFO = 3
+const WS_MSG_PIXEL = 4
+const WS_MSG_REGION = 5 //the parameters hold a JSON RegionSpec
+const WS_MSG_BLINK = 6  //a viewport request followed by the dataId of the blink partner
+
+//server -> client
+const WS_MSG_PROGRESS = 16
+const WS_MSG_VIEWPORT_DATA = 17
+const WS_MSG_TILE_DATA = 18
+const WS_MSG_PIXEL_DATA = 19  //the parameters hold a JSON document
+const WS_MSG_REGION_DATA = 20 //ditto
+const WS_MSG_BLINK_DATA = 21  //viewport data parameters followed by uint32 frame (0: this dataset, 1: the partner)
+const WS_MSG_IMAGE_INFO_DATA = 22
+const WS_MSG_ERROR = 31
+
+const WS_FLAG_LZ4 = 1
+const WS_FLAG_FLOAT32 = 2
+const WS_FLAG_LAYER_MASK = 0x0C
+const WS_FLAG_LAYER_SHIFT = 2
+
+const TILE_SIZE = 256
+const MAX_VIEWPORT_PIXELS = 4096 * 4096
+
+type wsHeader struct {
+	version     uint8
+	msg_type    uint8
+	flags       uint16
+	request_id  uint32
+	params_len  uint32
+	payload_len uint32
+}
+
+//connections interested in a dataset, dataId -> connection ID -> connection
+var ws_sessions = struct {
+	sync.RWMutex
+	conns map[string]map[string]websocket.Connection
+}{conns: make(map[string]map[string]websocket.Connection)}
+
+func new_websocket_server() *websocket.Server {
+	ws := websocket.New(websocket.Config{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		BinaryMessages:  true,
+	})
+
+	ws.OnConnection(subaru_websocket)
+
+	return ws
+}
+
+func subaru_websocket(c websocket.Connection) {
+	dataId := c.Context().Params().Get("dataId")
+	log := dataset_logger(dataId).With("connection", c.ID())
+	log.Info("websocket connected")
+
+	metrics.websocket_accepted.add("", 1)
+
+	ws_sessions.Lock()
+	if ws_sessions.conns[dataId] == nil {
+		ws_sessions.conns[dataId] = make(map[string]websocket.Connection)
+	}
+	ws_sessions.conns[dataId][c.ID()] = c
+	ws_sessions.Unlock()
+
+	c.OnDisconnect(func() {
+		log.Info("websocket closed")
+
+		ws_sessions.Lock()
+		delete(ws_sessions.conns[dataId], c.ID())
+		if len(ws_sessions.conns[dataId]) == 0 {
+			delete(ws_sessions.conns, dataId)
+		}
+		ws_sessions.Unlock()
+	})
+
+	c.OnMessage(func(msg []byte) {
+		hdr, params, err := parse_ws_frame(msg)
+
+		if err != nil {
+			send_ws_error(c, 0, err)
+			return
+		}
+
+		if err := handle_ws_message(c, dataId, hdr, params); err != nil {
+			send_ws_error(c, hdr.request_id, err)
+		}
+	})
+
+	//the image might already be in memory
+	if subaru, release, ok := hold_loaded_dataset(dataId); ok {
+		c.EmitMessage(make_image_info_frame(&subaru.fits, 0, 0))
+		release()
+	}
+}
+
+func parse_ws_frame(msg []byte) (wsHeader, []byte, error) {
+	var hdr wsHeader
+
+	if len(msg) < WS_HEADER_LENGTH {
+		return hdr, nil, errors.New("frame too short")
+	}
+
+	hdr.version = msg[0]
+	hdr.msg_type = msg[1]
+	hdr.flags = binary.LittleEndian.Uint16(msg[2:])
+	hdr.request_id = binary.LittleEndian.Uint32(msg[4:])
+	hdr.params_len = binary.LittleEndian.Uint32(msg[8:])
+	hdr.payload_len = binary.LittleEndian.Uint32(msg[12:])
+
+	if hdr.version != WS_PROTOCOL_VERSION {
+		return hdr, nil, fmt.Errorf("unsupported protocol version %d", hdr.version)
+	}
+
+	if uint64(len(msg)) < uint64(WS_HEADER_LENGTH)+uint64(hdr.params_len) {
+		return hdr, nil, errors.New("truncated frame")
+	}
+
+	return hdr, msg[WS_HEADER_LENGTH : WS_HEADER_LENGTH+int(hdr.params_len)], nil
+}
+
+//make_ws_frame builds a frame, compressing the pixels when WS_FLAG_LZ4 is set
+func make_ws_frame(msg_type uint8, flags uint16, request_id uint32, params []byte, pixels []byte) []byte {
+	payload := pixels
+
+	if flags&WS_FLAG_LZ4 != 0 && len(pixels) > 0 {
+		payload = lz4_compress_block(pixels)
+	}
+
+	frame := make([]byte, WS_HEADER_LENGTH, WS_HEADER_LENGTH+len(params)+len(payload))
+	frame[0] = WS_PROTOCOL_VERSION
+	frame[1] = msg_type
+	binary.LittleEndian.PutUint16(frame[2:], flags)
+	binary.LittleEndian.PutUint32(frame[4:], request_id)
+	binary.LittleEndian.PutUint32(frame[8:], uint32(len(params)))
+	binary.LittleEndian.PutUint32(frame[12:], uint32(len(pixels)))
+
+	frame = append(frame, params...)
+	frame = append(frame, payload...)
+
+	return frame
+}
+
+func send_ws_error(c websocket.Connection, request_id uint32, err error) {
+	logger.Warn("websocket request failed", "connection", c.ID(), "request_id", request_id, "error", err)
+	c.EmitMessage(make_ws_frame(WS_MSG_ERROR, 0, request_id, []byte(err.Error()), nil))
+}
+
+func send_ws_json(c websocket.Connection, msg_type uint8, request_id uint32, v interface{}) error {
+	doc, err := json.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+
+	return c.EmitMessage(make_ws_frame(msg_type, 0, request_id, doc, nil))
+}
+
+func get_dataset(dataId string) (*SubaruDataset, bool) {
+	datasets.RLock()
+	subaru, ok := datasets.subaru[dataId]
+	datasets.RUnlock()
+
+	return subaru, ok
+}
+
+//get_loaded_dataset only succeeds once the FITS data has been fully decoded
+func get_loaded_dataset(dataId string) (*SubaruDataset, bool) {
+	subaru, ok := get_dataset(dataId)
+
+	if !ok {
+		return nil, false
+	}
+
+	subaru.RLock()
+	has_fits := subaru.has_fits
+	subaru.RUnlock()
+
+	return subaru, has_fits
+}
+
+//hold_loaded_dataset is get_loaded_dataset for readers of the pixels, release must be called when done
+func hold_loaded_dataset(dataId string) (subaru *SubaruDataset, release func(), ok bool) {
+	subaru, ok = get_dataset(dataId)
+
+	if !ok {
+		return nil, nil, false
+	}
+
+	release = hold_dataset(subaru)
+
+	subaru.RLock()
+	has_fits := subaru.has_fits
+	subaru.RUnlock()
+
+	if !has_fits {
+		release()
+		return nil, nil, false
+	}
+
+	return subaru, release, true
+}
+
+func handle_ws_message(c websocket.Connection, dataId string, hdr wsHeader, params []byte) error {
+	subaru, release, ok := hold_loaded_dataset(dataId)
+
+	if !ok {
+		return fmt.Errorf("%s has not been loaded yet", dataId)
+	}
+
+	defer release()
+
+	switch hdr.msg_type {
+	case WS_MSG_IMAGE_INFO:
+		fits, err := display_layer(subaru, int(hdr.flags&WS_FLAG_LAYER_MASK)>>WS_FLAG_LAYER_SHIFT)
+
+		if err != nil {
+			return err
+		}
+
+		return c.EmitMessage(make_image_info_frame(fits, hdr.flags&WS_FLAG_LAYER_MASK, hdr.request_id))
+
+	case WS_MSG_VIEWPORT:
+		//int32 x, y, width, height, dst_width, dst_height
+		if len(params) < 24 {
+			return errors.New("malformed viewport request")
+		}
+
+		x := int(int32(binary.LittleEndian.Uint32(params[0:])))
+		y := int(int32(binary.LittleEndian.Uint32(params[4:])))
+		width := int(int32(binary.LittleEndian.Uint32(params[8:])))
+		height := int(int32(binary.LittleEndian.Uint32(params[12:])))
+		dst_width := int(int32(binary.LittleEndian.Uint32(params[16:])))
+		dst_height := int(int32(binary.LittleEndian.Uint32(params[20:])))
+
+		fits, err := display_layer(subaru, int(hdr.flags&WS_FLAG_LAYER_MASK)>>WS_FLAG_LAYER_SHIFT)
+
+		if err != nil {
+			return err
+		}
+
+		frame, err := make_viewport_frame(fits, hdr, x, y, width, height, dst_width, dst_height)
+
+		if err != nil {
+			return err
+		}
+
+		return c.EmitMessage(frame)
+
+	case WS_MSG_TILE:
+		//int32 level, tx, ty; a tile covers TILE_SIZE << level image pixels on each side
+		if len(params) < 12 {
+			return errors.New("malformed tile request")
+		}
+
+		level := int(int32(binary.LittleEndian.Uint32(params[0:])))
+		tx := int(int32(binary.LittleEndian.Uint32(params[4:])))
+		ty := int(int32(binary.LittleEndian.Uint32(params[8:])))
+
+		fits, err := display_layer(subaru, int(hdr.flags&WS_FLAG_LAYER_MASK)>>WS_FLAG_LAYER_SHIFT)
+
+		if err != nil {
+			return err
+		}
+
+		frame, err := make_tile_frame(fits, hdr, level, tx, ty)
+
+		if err != nil {
+			return err
+		}
+
+		return c.EmitMessage(frame)
+
+	case WS_MSG_PIXEL:
+		//float64 a, b; int32 mode (0: a, b are FITS pixel coordinates, 1: RA, Dec [deg]); int32 radius
+		if len(params) < 24 {
+			return errors.New("malformed pixel request")
+		}
+
+		a := math.Float64frombits(binary.LittleEndian.Uint64(params[0:]))
+		b := math.Float64frombits(binary.LittleEndian.Uint64(params[8:]))
+		mode := int32(binary.LittleEndian.Uint32(params[16:]))
+		radius := int(int32(binary.LittleEndian.Uint32(params[20:])))
+
+		var info PixelInfo
+		var err error
+
+		if mode == 1 {
+			info, err = query_sky(subaru, a, b, radius)
+		} else {
+			info, err = query_pixel(subaru, a, b, radius)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return send_ws_json(c, WS_MSG_PIXEL_DATA, hdr.request_id, info)
+
+	case WS_MSG_REGION:
+		var spec RegionSpec
+
+		if err := json.Unmarshal(params, &spec); err != nil {
+			return err
+		}
+
+		r, err := resolve_region(&subaru.fits, spec)
+
+		if err != nil {
+			return err
+		}
+
+		stats, err := region_statistics(subaru, r)
+
+		if err != nil {
+			return err
+		}
+
+		return send_ws_json(c, WS_MSG_REGION_DATA, hdr.request_id, stats)
+
+	case WS_MSG_BLINK:
+		//int32 x, y, width, height, dst_width, dst_height; the partner dataId
+		if len(params) < 25 {
+			return errors.New("malformed blink request")
+		}
+
+		partner, release_partner, ok := hold_loaded_dataset(string(params[24:]))
+
+		if !ok {
+			return fmt.Errorf("%s has not been loaded yet", string(params[24:]))
+		}
+
+		defer release_partner()
+
+		x := int(int32(binary.LittleEndian.Uint32(params[0:])))
+		y := int(int32(binary.LittleEndian.Uint32(params[4:])))
+		width := int(int32(binary.LittleEndian.Uint32(params[8:])))
+		height := int(int32(binary.LittleEndian.Uint32(params[12:])))
+		dst_width := int(int32(binary.LittleEndian.Uint32(params[16:])))
+		dst_height := int(int32(binary.LittleEndian.Uint32(params[20:])))
+
+		frames, err := make_blink_frames(subaru, partner, hdr, x, y, width, height, dst_width, dst_height)
+
+		if err != nil {
+			return err
+		}
+
+		for _, frame := range frames {
+			if err := c.EmitMessage(frame); err != nil {
+				return err
+			}
+		}
+
+		return nil
+
+	default:
+		return fmt.Errorf("unknown message type %d", hdr.msg_type)
+	}
+}
+
+//image info parameters (60 bytes): int32 width, height; float32 min, max, median, mad, black, sensitivity;
+//float64 RA, Dec [deg] of the image centre and the pixel scale [arcsec] (NaN without a WCS);
+//uint32 depth at offset 56 (the planes of a cube, 1 for an image)
+func make_image_info_frame(fits *FITS, flags uint16, request_id uint32) []byte {
+	ra, dec, scale := math.NaN(), math.NaN(), math.NaN()
+
+	//the number of planes of a data cube, 1 for an image
+	depth := 1
+
+	if is_cube(fits) {
+		depth = fits.depth
+	}
+
+	if fits.wcs != nil {
+		if r, d, err := fits.wcs.PixelToSky(0.5*float64(fits.width+1), 0.5*float64(fits.height+1)); err == nil {
+			ra, dec = r, d
+		}
+
+		scale = fits.wcs.PixelScale()
+	}
+
+	params := make([]byte, 60)
+	binary.LittleEndian.PutUint32(params[0:], uint32(fits.width))
+	binary.LittleEndian.PutUint32(params[4:], uint32(fits.height))
+	binary.LittleEndian.PutUint32(params[8:], math.Float32bits(fits.min))
+	binary.LittleEndian.PutUint32(params[12:], math.Float32bits(fits.max))
+	binary.LittleEndian.PutUint32(params[16:], math.Float32bits(fits.median))
+	binary.LittleEndian.PutUint32(params[20:], math.Float32bits(fits.mad))
+	binary.LittleEndian.PutUint32(params[24:], math.Float32bits(fits.black))
+	binary.LittleEndian.PutUint32(params[28:], math.Float32bits(fits.sensitivity))
+	binary.LittleEndian.PutUint64(params[32:], math.Float64bits(ra))
+	binary.LittleEndian.PutUint64(params[40:], math.Float64bits(dec))
+	binary.LittleEndian.PutUint64(params[48:], math.Float64bits(scale))
+	binary.LittleEndian.PutUint32(params[56:], uint32(depth))
+
+	return make_ws_frame(WS_MSG_IMAGE_INFO_DATA, flags, request_id, params, nil)
+}
+
+//encode_pixels returns either tone-mapped bytes or little-endian float32 depending on the request flags
+func encode_pixels(fits *FITS, flags uint16, pixels []float32) []byte {
+	if flags&WS_FLAG_FLOAT32 == 0 {
+		return tone_map(fits, pixels)
+	}
+
+	buf := make([]byte, 4*len(pixels))
+
+	for i, value := range pixels {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(value))
+	}
+
+	return buf
+}
+
+//viewport data parameters: int32 x, y, width, height, dst_width, dst_height (after clipping)
+func make_viewport_frame(fits *FITS, hdr wsHeader, x, y, width, height, dst_width, dst_height int) ([]byte, error) {
+	defer metrics.render_seconds.since(metric_labels("kind", "viewport"), time.Now())
+
+	params, pixels, err := make_viewport(fits, x, y, width, height, dst_width, dst_height)
+
+	if err != nil {
+		return nil, err
+	}
+
+	flags := hdr.flags & (WS_FLAG_LZ4 | WS_FLAG_FLOAT32 | WS_FLAG_LAYER_MASK)
+
+	return make_ws_frame(WS_MSG_VIEWPORT_DATA, flags, hdr.request_id, params, encode_pixels(fits, flags, pixels)), nil
+}
+
+//make_viewport clips the region to the image and downsamples it, returning the viewport data parameters and the pixels
+func make_viewport(fits *FITS, x, y, width, height, dst_width, dst_height int) ([]byte, []float32, error) {
+	//clip the region to the image
+	if x < 0 {
+		width += x
+		x = 0
+	}
+
+	if y < 0 {
+		height += y
+		y = 0
+	}
+
+	if x+width > fits.width {
+		width = fits.width - x
+	}
+
+	if y+height > fits.height {
+		height = fits.height - y
+	}
+
+	if width <= 0 || height <= 0 {
+		return nil, nil, errors.New("the viewport lies outside the image")
+	}
+
+	//never upsample on the server
+	if dst_width <= 0 || dst_width > width {
+		dst_width = width
+	}
+
+	if dst_height <= 0 || dst_height > height {
+		dst_height = height
+	}
+
+	if dst_width*dst_height > MAX_VIEWPORT_PIXELS {
+		return nil, nil, errors.New("the requested viewport is too large")
+	}
+
+	pixels := downsample_region(fits, x, y, width, height, dst_width, dst_height)
+
+	params := make([]byte, 24)
+	binary.LittleEndian.PutUint32(params[0:], uint32(x))
+	binary.LittleEndian.PutUint32(params[4:], uint32(y))
+	binary.LittleEndian.PutUint32(params[8:], uint32(width))
+	binary.LittleEndian.PutUint32(params[12:], uint32(height))
+	binary.LittleEndian.PutUint32(params[16:], uint32(dst_width))
+	binary.LittleEndian.PutUint32(params[20:], uint32(dst_height))
+
+	return params, pixels, nil
+}
+
+//tile data parameters: int32 level, tx, ty, tile_width, tile_height
+//edge tiles are smaller than TILE_SIZE
+func make_tile_frame(fits *FITS, hdr wsHeader, level, tx, ty int) ([]byte, error) {
+	defer metrics.render_seconds.since(metric_labels("kind", "tile"), time.Now())
+
+	if level < 0 || level > 16 {
+		return nil, fmt.Errorf("invalid tile level %d", level)
+	}
+
+	scale := 1 << uint(level)
+	span := TILE_SIZE * scale
+
+	x := tx * span
+	y := ty * span
+
+	if tx < 0 || ty < 0 || x >= fits.width || y >= fits.height {
+		return nil, fmt.Errorf("tile (%d, %d) at level %d lies outside the image", tx, ty, level)
+	}
+
+	width := span
+	height := span
+
+	if x+width > fits.width {
+		width = fits.width - x
+	}
+
+	if y+height > fits.height {
+		height = fits.height - y
+	}
+
+	tile_width := (width + scale - 1) / scale
+	tile_height := (height + scale - 1) / scale
+
+	pixels := downsample_region(fits, x, y, width, height, tile_width, tile_height)
+
+	params := make([]byte, 20)
+	binary.LittleEndian.PutUint32(params[0:], uint32(level))
+	binary.LittleEndian.PutUint32(params[4:], uint32(tx))
+	binary.LittleEndian.PutUint32(params[8:], uint32(ty))
+	binary.LittleEndian.PutUint32(params[12:], uint32(tile_width))
+	binary.LittleEndian.PutUint32(params[16:], uint32(tile_height))
+
+	flags := hdr.flags & (WS_FLAG_LZ4 | WS_FLAG_FLOAT32 | WS_FLAG_LAYER_MASK)
+
+	return make_ws_frame(WS_MSG_TILE_DATA, flags, hdr.request_id, params, encode_pixels(fits, flags, pixels)), nil
+}
+
+func broadcast_ws_frame(dataId string, frame []byte) {
+	ws_sessions.RLock()
+	defer ws_sessions.RUnlock()
+
+	for _, c := range ws_sessions.conns[dataId] {
+		c.EmitMessage(frame)
+	}
+}
+
+//progress parameters: int64 bytes received, int32 progress [%]
+func send_progress_notification(dataId string, size int64, progress int) {
+	params := make([]byte, 12)
+	binary.LittleEndian.PutUint64(params[0:], uint64(size))
+	binary.LittleEndian.PutUint32(params[8:], uint32(progress))
+
+	broadcast_ws_frame(dataId, make_ws_frame(WS_MSG_PROGRESS, 0, 0, params, nil))
+}
+
+func send_image_info_notification(subaru *SubaruDataset) {
+	broadcast_ws_frame(subaru.dataId, make_image_info_frame(&subaru.fits, 0, 0))
+}